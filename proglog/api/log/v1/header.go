@@ -0,0 +1,36 @@
+package v1
+
+// keyのヘッダーの値を返す
+// 同じキーのヘッダーが複数ある場合は、最後に追加されたものを返す
+func (x *Record) Header(key string) ([]byte, bool) {
+	headers := x.GetHeaders()
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].GetKey() == key {
+			return headers[i].GetValue(), true
+		}
+	}
+	return nil, false
+}
+
+// ヘッダーを追加する
+// 同じキーのヘッダーがあっても置き換えない
+func (x *Record) AddHeader(key string, value []byte) {
+	x.Headers = append(x.Headers, &Header{Key: key, Value: value})
+}
+
+// keyのヘッダーをすべて取り除いてから、ヘッダーを追加する
+func (x *Record) SetHeader(key string, value []byte) {
+	x.DelHeader(key)
+	x.AddHeader(key, value)
+}
+
+// keyのヘッダーをすべて取り除く
+func (x *Record) DelHeader(key string) {
+	headers := x.Headers[:0]
+	for _, h := range x.Headers {
+		if h.GetKey() != key {
+			headers = append(headers, h)
+		}
+	}
+	x.Headers = headers
+}
@@ -0,0 +1,34 @@
+package v1_test
+
+import (
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordHeader(t *testing.T) {
+	record := &api.Record{}
+	_, ok := record.Header("trace-id")
+	require.False(t, ok)
+
+	record.AddHeader("trace-id", []byte("a"))
+	record.AddHeader("content-type", []byte("text/plain"))
+	record.AddHeader("trace-id", []byte("b"))
+	v, ok := record.Header("trace-id")
+	require.True(t, ok)
+	require.Equal(t, []byte("b"), v)
+	require.Len(t, record.Headers, 3)
+
+	record.SetHeader("trace-id", []byte("c"))
+	require.Len(t, record.Headers, 2)
+	v, _ = record.Header("trace-id")
+	require.Equal(t, []byte("c"), v)
+
+	record.DelHeader("trace-id")
+	_, ok = record.Header("trace-id")
+	require.False(t, ok)
+	v, ok = record.Header("content-type")
+	require.True(t, ok)
+	require.Equal(t, []byte("text/plain"), v)
+}
@@ -0,0 +1,157 @@
+// replayは、デッドレターログに退避したレコードを元のログに追加し直す
+//
+// サーバーのGET /dead-letter/recordsからapi.RecordBatchとしてレコードを読み込み、デッドレターログで加えたヘッダーを取り除いてPOST /recordsで追加する
+// 最後に次に読み込むデッドレターログのオフセットを出力するので、途中で止まった場合は-offsetに指定して再開できる
+// シグナルを受け取るか-timeoutを過ぎると、送っているリクエストを取り消して止まる
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"google.golang.org/protobuf/proto"
+)
+
+func main() {
+	addr := flag.String("addr", "http://127.0.0.1:8888", "address of the server")
+	offset := flag.Uint64("offset", 0, "offset in the dead-letter log to start replaying from")
+	topic := flag.String("topic", "", "replay only records dead-lettered from this topic")
+	max := flag.Int("max", 0, "maximum number of records to replay (0 for all)")
+	timeout := flag.Duration("timeout", 0, "time to stop replaying after (0 for no timeout)")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cancel := func() {}
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	next, n, err := replay(ctx, *addr, *offset, *topic, *max)
+	cancel()
+	stop()
+
+	log.Printf("replayed %d records, next offset: %d", n, next)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// デッドレターログのoffから順にレコードを元のログに追加し直す
+// 次に読み込むオフセットと、追加し直したレコードの数を返す
+func replay(ctx context.Context, addr string, off uint64, topic string, max int) (uint64, int, error) {
+	var n int
+	for max == 0 || n < max {
+		page, err := fetch(ctx, addr, off)
+		if err != nil {
+			return off, n, err
+		}
+		for _, record := range page.Records {
+			if max != 0 && n >= max {
+				return off, n, nil
+			}
+			if t, _ := record.Header(deadletter.HeaderOriginalTopic); topic != "" && string(t) != topic {
+				off = record.Offset + 1
+				continue
+			}
+			original, err := deadletter.Original(record)
+			if err != nil {
+				return off, n, err
+			}
+			produced, err := produce(ctx, addr, original)
+			if err != nil {
+				return off, n, fmt.Errorf("failed to replay dead letter %d: %w", record.Offset, err)
+			}
+			origOff, _ := record.Header(deadletter.HeaderOriginalOffset)
+			log.Printf("dead letter %d (original offset %s) -> offset %d", record.Offset, origOff, produced)
+			off = record.Offset + 1
+			n++
+		}
+		// フィルターなどで読み飛ばしたレコードがあっても先に進む
+		if len(page.Records) == 0 && page.NextOffset <= off {
+			break
+		}
+		if page.NextOffset > off {
+			off = page.NextOffset
+		}
+		if off >= page.HighWatermark {
+			break
+		}
+	}
+	return off, n, nil
+}
+
+// デッドレターログのoffからレコードをまとめて読み込む
+// JSONではレコードの情報が失われることがあるので、api.RecordBatchとして受け取る
+func fetch(ctx context.Context, addr string, off uint64) (*api.RecordBatch, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/dead-letter/records?"+url.Values{"offset": {strconv.FormatUint(off, 10)}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-protobuf")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	p, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var page api.RecordBatch
+	if err = proto.Unmarshal(p, &page); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letters: %w", err)
+	}
+	return &page, nil
+}
+
+// レコードを追加し、そのオフセットを返す
+// ヘッダーの並びをそのまま送れるように、api.Recordとして送る
+func produce(ctx context.Context, addr string, record *api.Record) (uint64, error) {
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+"/records", bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return 0, responseError(res)
+	}
+	var produced server.ProduceResponse
+	if err = json.NewDecoder(res.Body).Decode(&produced); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return produced.Offset, nil
+}
+
+func responseError(res *http.Response) error {
+	var e server.ErrorResponse
+	body, _ := io.ReadAll(res.Body)
+	if err := json.Unmarshal(body, &e); err != nil || e.Error.Message == "" {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return fmt.Errorf("%s: %s", res.Status, e.Error.Message)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	commitlog "github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	testcases := map[string]func(t *testing.T, addr string, l *commitlog.Log){
+		"replay records losslessly":       testReplayLossless,
+		"replay only records of topic":    testReplayTopic,
+		"resume from printed next offset": testReplayResume,
+		"stop when context is canceled":   testReplayCanceled,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "replay-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			l, err := commitlog.NewLog(dir, commitlog.Config{})
+			require.NoError(t, err)
+			defer l.Close()
+			dlDir, err := ioutil.TempDir("", "replay-dead-letter-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dlDir)
+			dl, err := commitlog.NewLog(dlDir, commitlog.Config{})
+			require.NoError(t, err)
+			defer dl.Close()
+			srv := httptest.NewServer(server.NewHTTPServer("", l, server.Config{DeadLetter: dl, Topic: "orders"}).Handler)
+			defer srv.Close()
+
+			for i, topic := range []string{"orders", "payments", "orders", "orders"} {
+				record := &api.Record{Key: []byte{byte(i)}, Value: []byte{'a' + byte(i)}, Offset: uint64(i)}
+				record.AddHeader("trace-id", []byte{0xff, byte(i)})
+				record.AddHeader("trace-id", []byte("b"))
+				_, err = dl.Append(deadletter.Record(record, topic, "bad payload"))
+				require.NoError(t, err)
+			}
+
+			fn(t, srv.URL, l)
+		})
+	}
+}
+
+// JSONでは表せないヘッダーの値や同じキーのヘッダーも、そのまま元のログに追加し直すかテストする
+func testReplayLossless(t *testing.T, addr string, l *commitlog.Log) {
+	next, n, err := replay(context.Background(), addr, 0, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, uint64(4), next)
+
+	for i := 0; i < 4; i++ {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, record.Key)
+		require.Equal(t, []byte{'a' + byte(i)}, record.Value)
+		require.Len(t, record.Headers, 2)
+		require.Equal(t, "trace-id", record.Headers[0].Key)
+		require.Equal(t, []byte{0xff, byte(i)}, record.Headers[0].Value)
+		require.Equal(t, "trace-id", record.Headers[1].Key)
+		require.Equal(t, []byte("b"), record.Headers[1].Value)
+	}
+}
+
+// -topicを指定すると、そのトピックから退避したレコードだけを追加し直すかテストする
+func testReplayTopic(t *testing.T, addr string, l *commitlog.Log) {
+	next, n, err := replay(context.Background(), addr, 0, "orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, uint64(4), next)
+	requireValues(t, l, "a", "c", "d")
+}
+
+// -maxで止めた後、出力された次のオフセットから重複せずに再開できるかテストする
+func testReplayResume(t *testing.T, addr string, l *commitlog.Log) {
+	next, n, err := replay(context.Background(), addr, 0, "orders", 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, uint64(3), next)
+	requireValues(t, l, "a", "c")
+
+	next, n, err = replay(context.Background(), addr, next, "orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, uint64(4), next)
+	requireValues(t, l, "a", "c", "d")
+
+	// 末尾まで追加し直した後は何もしない
+	next, n, err = replay(context.Background(), addr, next, "orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, uint64(4), next)
+	requireValues(t, l, "a", "c", "d")
+}
+
+// コンテキストを取り消すと、レコードを追加せずに止まるかテストする
+func testReplayCanceled(t *testing.T, addr string, l *commitlog.Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	next, n, err := replay(ctx, addr, 0, "", 0)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, n)
+	require.Equal(t, uint64(0), next)
+	requireValues(t, l)
+}
+
+func requireValues(t *testing.T, l *commitlog.Log, values ...string) {
+	t.Helper()
+	for i, v := range values {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(v), record.Value)
+	}
+	_, err := l.Read(uint64(len(values)))
+	require.Error(t, err)
+}
@@ -1,12 +1,92 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"time"
 
+	commitlog "github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/queue"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/schema"
 	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
 )
 
 func main() {
-	srv := server.NewHTTPServer("127.0.0.1:8888")
+	dir := flag.String("dir", "data", "directory to store the log")
+	schemaDir := flag.String("schema-dir", "schemas", "directory to store the schema registry log")
+	deadLetterDir := flag.String("dead-letter-dir", "dead-letter", "directory to store the dead-letter log")
+	queueDir := flag.String("queue-dir", "queue", "directory to store the state of the work queue")
+	maxAttempts := flag.Int("queue-max-attempts", 5, "number of deliveries before a queued record is dead-lettered (0 for unlimited)")
+	ackTimeout := flag.Duration("ack-timeout", 10*time.Second, "time to wait for replicas when producing with acks=quorum")
+	topic := flag.String("topic", "records", "name of the log recorded in dead-lettered records")
+	flag.Parse()
+
+	for _, d := range []string{*dir, *schemaDir, *deadLetterDir, *queueDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	config := commitlog.Config{}
+	config.Delay.OnError = func(err error) {
+		log.Printf("failed to deliver delayed records: %v", err)
+	}
+	config.Cleanup.OnError = func(err error) {
+		log.Printf("failed to remove expired segments: %v", err)
+	}
+	clog, err := commitlog.NewLog(*dir, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// スキーマはレコードとは別のログに記録する
+	schemaLog, err := commitlog.NewLog(*schemaDir, commitlog.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry, err := schema.NewRegistry(schemaLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deadLetter, err := commitlog.NewLog(*deadLetterDir, commitlog.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 配る回数の上限に達したレコードは、デッドレターログに移す
+	q, err := queue.New(*queueDir, clog, queue.Config{
+		MaxAttempts: *maxAttempts,
+		DeadLetter:  deadLetter,
+		Topic:       *topic,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 遅延レコードを配信時刻になったら配信する
+	go func() {
+		if err := clog.RunScheduler(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// すべてのレコードの有効期限が切れたセグメントを削除する
+	go func() {
+		if err := clog.RunCleanup(context.Background(), time.Minute); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// このサーバーはレプリカを持たないので、Replicatorを指定せず、acks=quorumの追加は400で拒否する
+	// 複製するには、server.Replicatorを実装してserver.ConfigのReplicatorに指定し、
+	// ログのConfig.Replication.Enabledを有効にして、複製されたレコードだけを返すようにする
+	srv := server.NewHTTPServer("127.0.0.1:8888", clog, server.Config{
+		Schemas:    registry,
+		DeadLetter: deadLetter,
+		Topic:      *topic,
+		Queue:      q,
+		AckTimeout: *ackTimeout,
+	})
 	log.Fatal(srv.ListenAndServe())
 }
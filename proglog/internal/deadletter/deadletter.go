@@ -0,0 +1,61 @@
+// deadletterパッケージは、コンシューマーが処理できなかったレコードを退避するデッドレターログのレコードを扱う
+//
+// デッドレターログのレコードは元のレコードのキー、値、ヘッダーをそのまま持ち、
+// 元のオフセット、ログの名前(トピック)、処理できなかった理由をヘッダーに加える
+// 原因を直した後は、Originalで元のレコードに戻して元のログに追加し直せる
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// デッドレターログのレコードに加えるヘッダー
+// 元のレコードのヘッダーと区別できるように、すべてheaderPrefixで始める
+const (
+	headerPrefix         = "dead-letter-"
+	HeaderOriginalOffset = headerPrefix + "original-offset"
+	HeaderOriginalTopic  = headerPrefix + "original-topic"
+	HeaderReason         = headerPrefix + "reason"
+)
+
+// デッドレターログのレコードではないときに返すエラー
+var ErrNotDeadLetter = errors.New("not a dead letter record")
+
+// topicのログから読み込んだレコードを、reasonの理由で退避するためのデッドレターログのレコードを返す
+// プロデューサーやトランザクションの情報は元のログでだけ意味を持つので、引き継がない
+func Record(record *api.Record, topic, reason string) *api.Record {
+	dl := &api.Record{
+		Key:   record.Key,
+		Value: record.Value,
+	}
+	for _, h := range record.Headers {
+		dl.AddHeader(h.Key, h.Value)
+	}
+	dl.SetHeader(HeaderOriginalOffset, []byte(strconv.FormatUint(record.Offset, 10)))
+	dl.SetHeader(HeaderOriginalTopic, []byte(topic))
+	dl.SetHeader(HeaderReason, []byte(reason))
+	return dl
+}
+
+// デッドレターログのレコードから、元のログに追加し直すレコードを返す
+// デッドレターログで加えたヘッダーを取り除き、元のレコードのヘッダーだけを残す
+func Original(record *api.Record) (*api.Record, error) {
+	if _, ok := record.Header(HeaderOriginalOffset); !ok {
+		return nil, fmt.Errorf("offset %d: %w", record.Offset, ErrNotDeadLetter)
+	}
+	original := &api.Record{
+		Key:   record.Key,
+		Value: record.Value,
+	}
+	for _, h := range record.Headers {
+		if !strings.HasPrefix(h.Key, headerPrefix) {
+			original.AddHeader(h.Key, h.Value)
+		}
+	}
+	return original, nil
+}
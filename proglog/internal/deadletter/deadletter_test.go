@@ -0,0 +1,47 @@
+package deadletter_test
+
+import (
+	"errors"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetter(t *testing.T) {
+	record := &api.Record{
+		Key:           []byte("k"),
+		Value:         []byte("hello world"),
+		Offset:        42,
+		ProducerId:    "p",
+		Sequence:      3,
+		TransactionId: "tx",
+		Headers:       []*api.Header{{Key: "trace-id", Value: []byte("a")}},
+	}
+
+	dl := deadletter.Record(record, "orders", "failed to parse")
+	require.Equal(t, []byte("k"), dl.Key)
+	require.Equal(t, []byte("hello world"), dl.Value)
+	require.Empty(t, dl.ProducerId)
+	require.Empty(t, dl.TransactionId)
+	for key, want := range map[string]string{
+		"trace-id":                      "a",
+		deadletter.HeaderOriginalOffset: "42",
+		deadletter.HeaderOriginalTopic:  "orders",
+		deadletter.HeaderReason:         "failed to parse",
+	} {
+		v, ok := dl.Header(key)
+		require.True(t, ok, key)
+		require.Equal(t, want, string(v))
+	}
+
+	original, err := deadletter.Original(dl)
+	require.NoError(t, err)
+	require.Equal(t, []byte("k"), original.Key)
+	require.Equal(t, []byte("hello world"), original.Value)
+	require.Equal(t, []*api.Header{{Key: "trace-id", Value: []byte("a")}}, original.Headers)
+
+	_, err = deadletter.Original(record)
+	require.True(t, errors.Is(err, deadletter.ErrNotDeadLetter))
+}
@@ -0,0 +1,531 @@
+// filterパッケージは、コンシュームするレコードを選ぶための式を解析して評価する
+//
+// 式はレコードのフィールドと値を比較する条件を、&&(and)、||(or)、!(not)と括弧で組み合わせたもの
+//
+//	headers.content-type == "application/json" && value.amount >= 100
+//	key == "user-1" || !headers.internal
+//
+// フィールドには次のものを指定できる
+//   - key: レコードのキーを文字列として扱う
+//   - value: レコードの値を文字列として扱う
+//   - headers.<name>: nameのヘッダーの値を文字列として扱う。同じ名前のヘッダーが複数ある場合は最後のもの
+//   - value.<path>: 値をJSONとして解析し、ドットで区切ったパスのフィールドを扱う。配列の要素は添字で指定する
+//
+// 比較演算子は==、!=、<、<=、>、>=で、右辺には文字列("...")、数値、true、false、nullを書ける
+// 比較演算子を書かずにフィールドだけを書くと、そのフィールドが存在するかどうかを調べる
+// 存在しないフィールドや型の合わないフィールドとの比較は、!=だけがtrueになる
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// 式を解析できないときに返すエラー
+var ErrSyntax = errors.New("invalid filter expression")
+
+// 解析した式
+// 複数のゴルーチンから同時にMatchを呼び出せる
+type Filter struct {
+	expr string
+	root node
+}
+
+// 式を解析してFilterを返す
+func Parse(expr string) (*Filter, error) {
+	p := &parser{lex: &lexer{src: expr}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// レコードが式を満たすかどうかを返す
+func (f *Filter) Match(record *api.Record) bool {
+	return f.root.eval(&view{record: record})
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// 式を評価するレコード
+// 値をJSONとして解析するのは、value.<path>のフィールドを初めて参照したときの一度だけにする
+type view struct {
+	record  *api.Record
+	decoded bool
+	value   interface{}
+	valid   bool
+}
+
+// JSONとして解析したレコードの値を返す
+// JSONでない場合はfalseを返す
+func (v *view) json() (interface{}, bool) {
+	if !v.decoded {
+		v.decoded = true
+		v.valid = json.Unmarshal(v.record.Value, &v.value) == nil
+	}
+	return v.value, v.valid
+}
+
+type node interface {
+	eval(v *view) bool
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(v *view) bool { return n.left.eval(v) || n.right.eval(v) }
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(v *view) bool { return n.left.eval(v) && n.right.eval(v) }
+
+type notNode struct{ node node }
+
+func (n *notNode) eval(v *view) bool { return !n.node.eval(v) }
+
+// フィールドが存在するかどうかを調べる
+type existsNode struct{ field field }
+
+func (n *existsNode) eval(v *view) bool {
+	_, ok := n.field.resolve(v)
+	return ok
+}
+
+// フィールドとリテラルを比較する
+type compareNode struct {
+	field field
+	op    string
+	lit   interface{}
+}
+
+func (n *compareNode) eval(v *view) bool {
+	got, ok := n.field.resolve(v)
+	if !ok {
+		return n.op == "!="
+	}
+	c, ok := compare(got, n.lit)
+	if !ok {
+		return n.op == "!="
+	}
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// フィールドの値とリテラルを比較し、フィールドの値が小さければ負、等しければ0、大きければ正の値を返す
+// 比較できない型の場合はfalseを返す
+// 文字列のフィールドは、リテラルが数値や真偽値であればその型として解析してから比較する
+func compare(got, lit interface{}) (int, bool) {
+	switch lit := lit.(type) {
+	case string:
+		s, ok := got.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(s, lit), true
+	case float64:
+		var f float64
+		switch got := got.(type) {
+		case float64:
+			f = got
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(got, 64); err != nil {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		switch {
+		case f < lit:
+			return -1, true
+		case f > lit:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case bool:
+		var b bool
+		switch got := got.(type) {
+		case bool:
+			b = got
+		case string:
+			var err error
+			if b, err = strconv.ParseBool(got); err != nil {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		if b == lit {
+			return 0, true
+		}
+		// 真偽値には順序が無いので、等しくないことだけが分かればよい
+		return 1, true
+	default:
+		// nullはJSONのnullとだけ等しい
+		if got == nil {
+			return 0, true
+		}
+		return 1, true
+	}
+}
+
+// 式で参照するレコードのフィールド
+type field struct {
+	kind string
+	// headersではヘッダーの名前、valueではJSONのパス
+	path []string
+}
+
+const (
+	fieldKey    = "key"
+	fieldValue  = "value"
+	fieldHeader = "headers"
+)
+
+func parseField(name string) (field, error) {
+	parts := strings.Split(name, ".")
+	switch parts[0] {
+	case fieldKey:
+		if len(parts) > 1 {
+			return field{}, fmt.Errorf("key has no fields: %s", name)
+		}
+		return field{kind: fieldKey}, nil
+	case fieldValue:
+		for _, p := range parts[1:] {
+			if p == "" {
+				return field{}, fmt.Errorf("empty path element: %s", name)
+			}
+		}
+		return field{kind: fieldValue, path: parts[1:]}, nil
+	case fieldHeader:
+		// ヘッダーの名前にはドットを含められる
+		header := strings.TrimPrefix(name, fieldHeader+".")
+		if len(parts) < 2 || header == "" {
+			return field{}, fmt.Errorf("header name is required: %s", name)
+		}
+		return field{kind: fieldHeader, path: []string{header}}, nil
+	default:
+		return field{}, fmt.Errorf("unknown field: %s", name)
+	}
+}
+
+// フィールドの値を返す
+// フィールドが存在しない場合はfalseを返す
+func (f field) resolve(v *view) (interface{}, bool) {
+	switch f.kind {
+	case fieldKey:
+		if v.record.Key == nil {
+			return nil, false
+		}
+		return string(v.record.Key), true
+	case fieldHeader:
+		h, ok := v.record.Header(f.path[0])
+		if !ok {
+			return nil, false
+		}
+		return string(h), true
+	default:
+		if len(f.path) == 0 {
+			return string(v.record.Value), true
+		}
+		cur, ok := v.json()
+		if !ok {
+			return nil, false
+		}
+		for _, p := range f.path {
+			switch c := cur.(type) {
+			case map[string]interface{}:
+				if cur, ok = c[p]; !ok {
+					return nil, false
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(p)
+				if err != nil || i < 0 || i >= len(c) {
+					return nil, false
+				}
+				cur = c[i]
+			default:
+				return nil, false
+			}
+		}
+		return cur, true
+	}
+}
+
+// 再帰下降構文解析器
+// 優先順位の低い順に、||、&&、!、括弧と比較になる
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d: %w", fmt.Sprintf(format, args...), p.tok.pos, ErrSyntax)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.is(tokOp, "||") || p.tok.is(tokIdent, "or") {
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.is(tokOp, "&&") || p.tok.is(tokIdent, "and") {
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.tok.is(tokOp, "!") || p.tok.is(tokIdent, "not") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.tok.kind == tokLParen {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ) but got %s", p.tok)
+		}
+		return n, p.advance()
+	}
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected field but got %s", p.tok)
+	}
+	f, err := parseField(p.tok.text)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp || !isComparison(p.tok.text) {
+		return &existsNode{field: f}, nil
+	}
+	op := p.tok.text
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	lit, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if lit == nil && op != "==" && op != "!=" {
+		return nil, p.errorf("null can only be compared with == or !=")
+	}
+	return &compareNode{field: f, op: op, lit: lit}, nil
+}
+
+func (p *parser) parseLiteral() (interface{}, error) {
+	tok := p.tok
+	var lit interface{}
+	switch {
+	case tok.kind == tokString:
+		lit = tok.text
+	case tok.kind == tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.text)
+		}
+		lit = f
+	case tok.is(tokIdent, "true"):
+		lit = true
+	case tok.is(tokIdent, "false"):
+		lit = false
+	case tok.is(tokIdent, "null"):
+		lit = nil
+	default:
+		return nil, p.errorf("expected literal but got %s", tok)
+	}
+	return lit, p.advance()
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t' || l.src[l.pos] == '\n') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case c == '"':
+		return l.string()
+	case isDigit(c) || (c == '-' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		l.pos++
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || strings.IndexByte(".eE+-", l.src[l.pos]) >= 0) {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case isIdentStart(c):
+		for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!"} {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at %d: %w", c, start, ErrSyntax)
+}
+
+// ダブルクォートで囲まれた文字列を読み込む
+// エスケープはGoの文字列リテラルと同じ
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case '"':
+			l.pos++
+			s, err := strconv.Unquote(l.src[start:l.pos])
+			if err != nil {
+				return token{}, fmt.Errorf("invalid string at %d: %w", start, ErrSyntax)
+			}
+			return token{kind: tokString, text: s, pos: start}, nil
+		}
+		l.pos++
+	}
+	return token{}, fmt.Errorf("unterminated string at %d: %w", start, ErrSyntax)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// フィールドの名前にはヘッダーの名前やJSONのパスを含むので、ハイフンやドットも使える
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '-' || c == '.'
+}
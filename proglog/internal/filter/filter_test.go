@@ -0,0 +1,84 @@
+package filter_test
+
+import (
+	"errors"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/filter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	record := &api.Record{
+		Key:   []byte("user-1"),
+		Value: []byte(`{"amount": 150, "status": "paid", "paid": true, "note": null, "items": [{"sku": "a"}, {"sku": "b"}]}`),
+		Headers: []*api.Header{
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "retry", Value: []byte("3")},
+		},
+	}
+	for expr, want := range map[string]bool{
+		`key == "user-1"`: true,
+		`key != "user-1"`: false,
+		`headers.content-type == "application/json"`:   true,
+		`headers.retry > 2`:                            true,
+		`headers.retry`:                                true,
+		`headers.missing`:                              false,
+		`headers.missing == "x"`:                       false,
+		`headers.missing != "x"`:                       true,
+		`value.amount >= 100 && value.amount < 200`:    true,
+		`value.amount > 150`:                           false,
+		`value.status == "paid"`:                       true,
+		`value.status == 1`:                            false,
+		`value.status != 1`:                            true,
+		`value.paid == true`:                           true,
+		`value.note == null`:                           true,
+		`value.amount == null`:                         false,
+		`value.items.1.sku == "b"`:                     true,
+		`value.items.2.sku`:                            false,
+		`!value.missing`:                               true,
+		`not value.missing and value.amount == 150`:    true,
+		`value.status == "due" || key == "user-1"`:     true,
+		`(value.status == "due" || key == "x") && key`: false,
+		`value.status == "due" || !(key == "x")`:       true,
+	} {
+		expr, want := expr, want
+		t.Run(expr, func(t *testing.T) {
+			f, err := filter.Parse(expr)
+			require.NoError(t, err)
+			require.Equal(t, want, f.Match(record))
+		})
+	}
+}
+
+func TestFilterNonJSONValue(t *testing.T) {
+	record := &api.Record{Value: []byte("hello world")}
+
+	f, err := filter.Parse(`value.a`)
+	require.NoError(t, err)
+	require.False(t, f.Match(record))
+
+	f, err = filter.Parse(`value == "hello world" && !key`)
+	require.NoError(t, err)
+	require.True(t, f.Match(record))
+}
+
+func TestFilterSyntaxError(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`key ==`,
+		`key == "a`,
+		`(key == "a"`,
+		`key == "a")`,
+		`unknown == 1`,
+		`headers == "a"`,
+		`key.a`,
+		`value.a < null`,
+		`key == "a" &&`,
+		`key # 1`,
+	} {
+		_, err := filter.Parse(expr)
+		require.True(t, errors.Is(err, filter.ErrSyntax), "expr: %q, err: %v", expr, err)
+	}
+}
@@ -0,0 +1,501 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// バックアップの内容を記録するマニフェストのファイル名
+const backupManifestName = "manifest.json"
+
+const backupManifestVersion = 1
+
+var (
+	// バックアップとして解釈できないデータから復元しようとしたときに返すエラー
+	ErrBackupFormat = errors.New("invalid backup format")
+	// 差分バックアップの基になるバックアップが足りないときに返すエラー
+	ErrBackupIncomplete = errors.New("incomplete backup chain")
+)
+
+// バックアップを取った時点のログの状態を記録する
+// 差分バックアップを取るときは、前回のバックアップのマニフェストを渡す
+// オブジェクトストアにだけ存在するセグメントも含むので、LowestOffsetはLog.LowestOffsetと一致する
+type BackupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// 前回のバックアップを基にした差分バックアップかどうか
+	Incremental  bool   `json:"incremental"`
+	LowestOffset uint64 `json:"lowest_offset"`
+	NextOffset   uint64 `json:"next_offset"`
+	// バックアップを取った時点でログを構成していたすべてのセグメント
+	Segments []BackupSegment `json:"segments"`
+}
+
+// バックアップに記録するセグメントの情報
+type BackupSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	StoreSize  uint64 `json:"store_size"`
+	IndexSize  uint64 `json:"index_size"`
+	Sealed     bool   `json:"sealed"`
+	// このバックアップにセグメントのファイルが含まれているかどうか
+	// 差分バックアップでは、前回のバックアップに封印された状態で含まれていたセグメントは含まれない
+	Included bool `json:"included"`
+}
+
+// バックアップに含めるセグメントの内容
+type backupSegment struct {
+	BackupSegment
+	// 前回のバックアップに含まれていたリモートのセグメントはダウンロードしないのでnilになる
+	segment *segment
+	// アクティブなセグメントのインデックスはバックアップを取り始めた時点の内容をコピーしておく
+	index []byte
+}
+
+// バックアップの書き込み先
+type backupTarget interface {
+	// 封印されたセグメントの変更されないファイルsrcを含める
+	// srcをそのまま使えない場合はrから読み込む
+	addFile(name, src string, r io.Reader, size uint64) error
+	// rから読み込んだsizeバイトをファイルとして含める
+	addReader(name string, r io.Reader, size uint64) error
+}
+
+// ログのバックアップをディレクトリに取る
+// 封印されたセグメントはできるだけハードリンクで、アクティブなセグメントはバックアップを取り始めた時点の内容をコピーする
+// オブジェクトストアにだけ存在するセグメントはダウンロードして含める
+// prevに前回のバックアップのマニフェストを渡すと、それ以降に封印されたセグメントとアクティブなセグメントだけを含む差分バックアップになる
+func (l *Log) Backup(dir string, prev *BackupManifest) (*BackupManifest, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	m, err := l.backup(&dirBackupTarget{dir: dir}, prev)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err = os.WriteFile(path.Join(dir, backupManifestName), b, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return m, nil
+}
+
+// ログのバックアップをtar形式でwに書き出す
+// 差分バックアップについてはBackupと同じ
+func (l *Log) BackupTar(w io.Writer, prev *BackupManifest) (*BackupManifest, error) {
+	tw := tar.NewWriter(w)
+	m, err := l.backup(&tarBackupTarget{w: tw}, prev)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err = writeTarFile(tw, backupManifestName, bytes.NewReader(b), uint64(len(b))); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	return m, nil
+}
+
+func (l *Log) backup(target backupTarget, prev *BackupManifest) (*BackupManifest, error) {
+	// 前回のバックアップに封印された状態で含まれていたセグメントは変更されていないので含めなくてよい
+	shipped := make(map[uint64]BackupSegment)
+	if prev != nil {
+		for _, s := range prev.Segments {
+			if s.Sealed {
+				shipped[s.BaseOffset] = s
+			}
+		}
+	}
+	m, remote, local := l.captureBackup(shipped, prev != nil)
+	defer releaseBackupSegments(local)
+	// ダウンロードしている間も追加できるように、ロックを解放してからダウンロードする
+	segments, err := l.remoteBackupSegments(remote, shipped)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseBackupSegments(segments)
+	// リモートのセグメントはローカルのセグメントより古いので、前に並べる
+	segments = append(segments, local...)
+	m.LowestOffset = segments[0].BaseOffset
+	m.Segments = make([]BackupSegment, 0, len(segments))
+	for _, s := range segments {
+		m.Segments = append(m.Segments, s.BackupSegment)
+		if !s.Included {
+			continue
+		}
+		if err = s.write(target); err != nil {
+			return nil, fmt.Errorf("failed to back up segment %d: %w", s.BaseOffset, err)
+		}
+	}
+	return m, nil
+}
+
+// バックアップに含めたセグメントへの参照を解放する
+func releaseBackupSegments(segments []*backupSegment) {
+	for _, s := range segments {
+		if s.segment != nil {
+			_ = s.segment.release()
+		}
+	}
+}
+
+// ロックを保持している間にバックアップに含めるセグメントの範囲を決め、ローカルのセグメントを参照する
+// オブジェクトストアにだけ存在するセグメントは、範囲だけを返す
+func (l *Log) captureBackup(shipped map[uint64]BackupSegment, incremental bool) (*BackupManifest, []remoteSegment, []*backupSegment) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	m := &BackupManifest{
+		Version:     backupManifestVersion,
+		CreatedAt:   time.Now(),
+		Incremental: incremental,
+		NextOffset:  l.segments[len(l.segments)-1].nextOffset,
+	}
+	var remote []remoteSegment
+	if l.tier != nil {
+		remote = append(remote, l.tier.remote...)
+	}
+	segments := make([]*backupSegment, 0, len(l.segments))
+	for _, s := range l.segments {
+		bs := &backupSegment{
+			BackupSegment: BackupSegment{
+				BaseOffset: s.baseOffset,
+				NextOffset: s.nextOffset,
+				StoreSize:  s.end,
+				IndexSize:  s.index.size,
+				Sealed:     s.sealed,
+			},
+			segment: s,
+		}
+		_, ok := shipped[s.baseOffset]
+		bs.Included = !(s.sealed && ok)
+		if bs.Included && !s.sealed {
+			bs.index = make([]byte, s.index.size)
+			copy(bs.index, s.index.mmap[:s.index.size])
+		}
+		s.acquire()
+		segments = append(segments, bs)
+	}
+	return m, remote, segments
+}
+
+// オブジェクトストアにだけ存在するセグメントのうち、前回のバックアップに含まれていないものをダウンロードして参照する
+// 前回のバックアップに含まれていたものは、マニフェストに記録するためにその情報だけを返す
+func (l *Log) remoteBackupSegments(remote []remoteSegment, shipped map[uint64]BackupSegment) ([]*backupSegment, error) {
+	segments := make([]*backupSegment, 0, len(remote))
+	for _, rs := range remote {
+		if s, ok := shipped[rs.BaseOffset]; ok {
+			s.Included = false
+			segments = append(segments, &backupSegment{BackupSegment: s})
+			continue
+		}
+		s, err := l.tier.open(rs)
+		if err != nil {
+			releaseBackupSegments(segments)
+			return nil, fmt.Errorf("failed to open remote segment %d: %w", rs.BaseOffset, err)
+		}
+		segments = append(segments, &backupSegment{
+			BackupSegment: BackupSegment{
+				BaseOffset: s.baseOffset,
+				NextOffset: s.nextOffset,
+				StoreSize:  s.end,
+				IndexSize:  s.index.size,
+				Sealed:     true,
+				Included:   true,
+			},
+			segment: s,
+		})
+	}
+	return segments, nil
+}
+
+// セグメントのファイルをバックアップに書き込む
+func (s *backupSegment) write(target backupTarget) error {
+	storeName := path.Base(s.segment.store.Name())
+	indexName := path.Base(s.segment.index.Name())
+	// セグメントを参照しているので、バックアップ中に切り詰められてもストアとインデックスから読み込める
+	store := io.NewSectionReader(s.segment.store, 0, int64(s.StoreSize))
+	if s.Sealed {
+		if err := target.addFile(storeName, s.segment.store.Name(), store, s.StoreSize); err != nil {
+			return err
+		}
+		index := io.NewSectionReader(s.segment.index.file, 0, int64(s.IndexSize))
+		if err := target.addFile(indexName, s.segment.index.Name(), index, s.IndexSize); err != nil {
+			return err
+		}
+		return target.addReader(path.Base(s.segment.sealedFilePath()), bytes.NewReader(nil), 0)
+	}
+	// アクティブなセグメントはバックアップを取り始めた時点までの内容だけを書き込む
+	if err := target.addReader(storeName, store, s.StoreSize); err != nil {
+		return err
+	}
+	return target.addReader(indexName, bytes.NewReader(s.index), s.IndexSize)
+}
+
+// ディレクトリにバックアップを書き込む
+type dirBackupTarget struct {
+	dir string
+}
+
+// 封印されたファイルは変更されないので、できるだけハードリンクする
+// 別のファイルシステムにある、すでに削除されているなどでリンクできない場合はコピーする
+func (d *dirBackupTarget) addFile(name, src string, r io.Reader, size uint64) error {
+	dst := path.Join(d.dir, name)
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove existing file: %w", err)
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return d.addReader(name, r, size)
+}
+
+func (d *dirBackupTarget) addReader(name string, r io.Reader, size uint64) error {
+	return writeFile(path.Join(d.dir, name), r, size)
+}
+
+// tarアーカイブにバックアップを書き込む
+type tarBackupTarget struct {
+	w *tar.Writer
+}
+
+func (t *tarBackupTarget) addFile(name, _ string, r io.Reader, size uint64) error {
+	return t.addReader(name, r, size)
+}
+
+func (t *tarBackupTarget) addReader(name string, r io.Reader, size uint64) error {
+	return writeTarFile(t.w, name, r, size)
+}
+
+func writeTarFile(w *tar.Writer, name string, r io.Reader, size uint64) error {
+	err := w.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(size),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+	}
+	if _, err = io.CopyN(w, r, int64(size)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// rからsizeバイトを読み込んでファイルに書き込み、ストレージに同期する
+func writeFile(name string, r io.Reader, size uint64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if _, err = io.CopyN(f, r, int64(size)); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", name, err)
+	}
+	return nil
+}
+
+// ディレクトリに取ったバックアップのマニフェストを読み込む
+// 差分バックアップを取るときに前回のバックアップとして渡す
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	b, err := os.ReadFile(path.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return decodeBackupManifest(b)
+}
+
+func decodeBackupManifest(b []byte) (*BackupManifest, error) {
+	m := &BackupManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", ErrBackupFormat)
+	}
+	if m.Version != backupManifestVersion {
+		return nil, fmt.Errorf("manifest version %d: %w", m.Version, ErrBackupFormat)
+	}
+	return m, nil
+}
+
+// ディレクトリに取ったバックアップからNewLogで開けるディレクトリdstを作る
+// 差分バックアップから復元する場合は、完全バックアップから順にすべてのバックアップを渡す
+func RestoreBackup(dst string, dirs ...string) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	var last *BackupManifest
+	for _, dir := range dirs {
+		m, err := ReadBackupManifest(dir)
+		if err != nil {
+			return err
+		}
+		for _, s := range m.Segments {
+			if !s.Included {
+				continue
+			}
+			for _, ext := range s.exts() {
+				name := fmt.Sprintf("%d%s", s.BaseOffset, ext)
+				if err = copyFile(path.Join(dst, name), path.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+		last = m
+	}
+	return finishRestore(dst, last)
+}
+
+// tar形式のバックアップからNewLogで開けるディレクトリdstを作る
+// 差分バックアップから復元する場合は、完全バックアップから順にすべてのアーカイブを渡す
+func RestoreBackupTar(dst string, archives ...io.Reader) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	var last *BackupManifest
+	for _, archive := range archives {
+		m, err := extractBackupTar(dst, archive)
+		if err != nil {
+			return err
+		}
+		last = m
+	}
+	return finishRestore(dst, last)
+}
+
+// tarアーカイブのセグメントのファイルをdstに展開し、マニフェストを返す
+func extractBackupTar(dst string, r io.Reader) (*BackupManifest, error) {
+	tr := tar.NewReader(r)
+	var m *BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if hdr.Name == backupManifestName {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read manifest: %w", err)
+			}
+			if m, err = decodeBackupManifest(b); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// セグメントのファイル以外はディレクトリの外に書き込まれる恐れがあるので受け付けない
+		if !isSegmentFileName(hdr.Name) {
+			return nil, fmt.Errorf("unexpected file %q: %w", hdr.Name, ErrBackupFormat)
+		}
+		if err = writeFile(path.Join(dst, hdr.Name), tr, uint64(hdr.Size)); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("missing manifest: %w", ErrBackupFormat)
+	}
+	return m, nil
+}
+
+// 最後のバックアップのマニフェストに従って復元したディレクトリを検証し、含まれないセグメントのファイルを削除する
+func finishRestore(dst string, m *BackupManifest) error {
+	if m == nil {
+		return fmt.Errorf("no backup given: %w", ErrBackupIncomplete)
+	}
+	want := make(map[string]uint64)
+	for _, s := range m.Segments {
+		for _, ext := range s.exts() {
+			want[fmt.Sprintf("%d%s", s.BaseOffset, ext)] = s.size(ext)
+		}
+	}
+	files, err := os.ReadDir(dst)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !isSegmentFileName(file.Name()) {
+			continue
+		}
+		if _, ok := want[file.Name()]; ok {
+			continue
+		}
+		// 以前のバックアップには含まれていたが、その後切り詰められたセグメント
+		if err = os.Remove(path.Join(dst, file.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", file.Name(), err)
+		}
+	}
+	// 復元先に残っていたプロデューサーやトランザクションの状態は別のレコードから作ったものなので、
+	// 復元したレコードから作り直す
+	if err = os.Remove(path.Join(dst, stateFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state: %w", err)
+	}
+	// ハイウォーターマークも別のレコードを指しているので引き継がない
+	if err = os.Remove(path.Join(dst, highWatermarkFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove high watermark: %w", err)
+	}
+	for name, size := range want {
+		fi, err := os.Stat(path.Join(dst, name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, ErrBackupIncomplete)
+		}
+		if uint64(fi.Size()) != size {
+			return fmt.Errorf("%s has %d bytes, want %d: %w", name, fi.Size(), size, ErrBackupIncomplete)
+		}
+	}
+	return nil
+}
+
+// セグメントを構成するファイルの拡張子を返す
+func (s BackupSegment) exts() []string {
+	if s.Sealed {
+		return []string{storeFileExt, indexFileExt, sealedFileExt}
+	}
+	return []string{storeFileExt, indexFileExt}
+}
+
+// セグメントを構成するファイルのサイズを返す
+func (s BackupSegment) size(ext string) uint64 {
+	switch ext {
+	case storeFileExt:
+		return s.StoreSize
+	case indexFileExt:
+		return s.IndexSize
+	default:
+		return 0
+	}
+}
+
+func copyFile(dst, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	return writeFile(dst, f, uint64(fi.Size()))
+}
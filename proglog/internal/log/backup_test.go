@@ -0,0 +1,206 @@
+package log_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log){
+		"full backup to directory":        testBackupDir,
+		"incremental backup to directory": testBackupDirIncremental,
+		"incremental backup to tar":       testBackupTarIncremental,
+		"reject incomplete chain":         testBackupIncompleteChain,
+		"discard stale producer state":    testBackupStaleState,
+		"discard stale high watermark":    testBackupStaleHighWatermark,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "backup-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0o755))
+			l, err := log.NewLog(filepath.Join(dir, "log"), c)
+			require.NoError(t, err)
+			appendRecords(t, l, 10)
+
+			fn(t, l)
+		})
+	}
+}
+
+// ディレクトリに取ったバックアップからNewLogで開けるディレクトリを復元できるかテストする
+func testBackupDir(t *testing.T, l *log.Log) {
+	backup := filepath.Join(filepath.Dir(l.Dir), "backup")
+	m, err := l.Backup(backup, nil)
+	require.NoError(t, err)
+	require.False(t, m.Incremental)
+	require.Equal(t, uint64(10), m.NextOffset)
+
+	// 封印されたセグメントはハードリンクされる
+	want, err := os.Stat(filepath.Join(l.Dir, "0.store"))
+	require.NoError(t, err)
+	got, err := os.Stat(filepath.Join(backup, "0.store"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(want, got))
+
+	// バックアップを取った後に追加したレコードは含まれない
+	appendRecords(t, l, 1)
+
+	restored := filepath.Join(filepath.Dir(l.Dir), "restored")
+	require.NoError(t, log.RestoreBackup(restored, backup))
+	n, err := log.NewLog(restored, l.Config)
+	require.NoError(t, err)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+	requireRecords(t, n, 0, 10)
+}
+
+// 差分バックアップが新しいセグメントだけを含み、完全バックアップと合わせて復元できるかテストする
+func testBackupDirIncremental(t *testing.T, l *log.Log) {
+	base := filepath.Dir(l.Dir)
+	full, err := l.Backup(filepath.Join(base, "full"), nil)
+	require.NoError(t, err)
+
+	appendRecords(t, l, 10)
+	require.NoError(t, l.Truncate(2))
+
+	prev, err := log.ReadBackupManifest(filepath.Join(base, "full"))
+	require.NoError(t, err)
+	require.Equal(t, full.NextOffset, prev.NextOffset)
+	incr, err := l.Backup(filepath.Join(base, "incr"), prev)
+	require.NoError(t, err)
+	require.True(t, incr.Incremental)
+
+	// 前回のバックアップに封印された状態で含まれていたセグメントは含まれない
+	for _, s := range incr.Segments {
+		_, err = os.Stat(filepath.Join(base, "incr", fmt.Sprintf("%d.store", s.BaseOffset)))
+		if s.Included {
+			require.NoError(t, err)
+		} else {
+			require.True(t, os.IsNotExist(err))
+		}
+	}
+	_, err = os.Stat(filepath.Join(base, "incr", "3.store"))
+	require.True(t, os.IsNotExist(err))
+
+	restored := filepath.Join(base, "restored")
+	require.NoError(t, log.RestoreBackup(restored, filepath.Join(base, "full"), filepath.Join(base, "incr")))
+	n, err := log.NewLog(restored, l.Config)
+	require.NoError(t, err)
+	requireSameLog(t, l, n)
+
+	// 切り詰められたセグメントは復元されない
+	_, err = os.Stat(filepath.Join(restored, "0.store"))
+	require.True(t, os.IsNotExist(err))
+}
+
+// tar形式の完全バックアップと差分バックアップから復元できるかテストする
+func testBackupTarIncremental(t *testing.T, l *log.Log) {
+	var full, incr bytes.Buffer
+	m, err := l.BackupTar(&full, nil)
+	require.NoError(t, err)
+
+	appendRecords(t, l, 10)
+	_, err = l.BackupTar(&incr, m)
+	require.NoError(t, err)
+
+	restored := filepath.Join(filepath.Dir(l.Dir), "restored")
+	require.NoError(t, log.RestoreBackupTar(restored, &full, &incr))
+	n, err := log.NewLog(restored, l.Config)
+	require.NoError(t, err)
+	requireSameLog(t, l, n)
+}
+
+// 差分バックアップだけからは復元できないかテストする
+func testBackupIncompleteChain(t *testing.T, l *log.Log) {
+	base := filepath.Dir(l.Dir)
+	m, err := l.Backup(filepath.Join(base, "full"), nil)
+	require.NoError(t, err)
+	appendRecords(t, l, 10)
+	_, err = l.Backup(filepath.Join(base, "incr"), m)
+	require.NoError(t, err)
+
+	err = log.RestoreBackup(filepath.Join(base, "restored"), filepath.Join(base, "incr"))
+	require.True(t, errors.Is(err, log.ErrBackupIncomplete), err)
+}
+
+func appendRecords(t *testing.T, l *log.Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+func requireRecords(t *testing.T, l *log.Log, from, to uint64) {
+	t.Helper()
+	for off := from; off < to; off++ {
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+}
+
+// 復元先に残っていたプロデューサーの状態を使わずに、復元したレコードから作り直すかテストする
+func testBackupStaleState(t *testing.T, l *log.Log) {
+	backup := filepath.Join(filepath.Dir(l.Dir), "backup")
+	_, err := l.Backup(backup, nil)
+	require.NoError(t, err)
+
+	restored := filepath.Join(filepath.Dir(l.Dir), "restored")
+	require.NoError(t, os.Mkdir(restored, 0o755))
+	stale, err := log.NewLog(restored, l.Config)
+	require.NoError(t, err)
+	for seq := uint64(0); seq < 3; seq++ {
+		_, err = stale.Append(&api.Record{Value: []byte("stale"), ProducerId: "p", Sequence: seq})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stale.Close())
+
+	require.NoError(t, log.RestoreBackup(restored, backup))
+	n, err := log.NewLog(restored, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.Append(&api.Record{Value: []byte("fresh"), ProducerId: "p", Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+// 復元先に残っていたハイウォーターマークを使わず、復元したレコードを複製されていないものとして扱うかテストする
+func testBackupStaleHighWatermark(t *testing.T, l *log.Log) {
+	backup := filepath.Join(filepath.Dir(l.Dir), "backup")
+	_, err := l.Backup(backup, nil)
+	require.NoError(t, err)
+
+	c := l.Config
+	c.Replication.Enabled = true
+	restored := filepath.Join(filepath.Dir(l.Dir), "restored")
+	require.NoError(t, os.Mkdir(restored, 0o755))
+	stale, err := log.NewLog(restored, c)
+	require.NoError(t, err)
+	appendRecords(t, stale, 20)
+	require.NoError(t, stale.SetHighWatermark(20))
+	require.NoError(t, stale.Close())
+
+	require.NoError(t, log.RestoreBackup(restored, backup))
+	n, err := log.NewLog(restored, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(0), n.HighWatermark())
+	require.Equal(t, uint64(10), n.LogEndOffset())
+}
@@ -1,9 +1,44 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// インデックスエントリを書き込む間隔となるストアのバイト数
+		// 0の場合はすべてのレコードにエントリを書き込む密なインデックスになる
+		// 大きくするほどインデックスは小さくなるが、読み込み時にストアを読み進める量が増える
+		IndexIntervalBytes uint64
+	}
+	Tier struct {
+		// 封印されたセグメントをアップロードするオブジェクトストア
+		// nilの場合はすべてのセグメントをローカルに保持する
+		ObjectStore ObjectStore
+		// アップロードした後もローカルに残しておく、封印されたセグメントの数
+		LocalSegments int
+		// ダウンロードしたリモートのセグメントをキャッシュしておく数
+		// 0の場合は1つだけキャッシュする
+		CacheSegments int
+	}
+	Replication struct {
+		// trueの場合、ハイウォーターマークはSetHighWatermarkで進めるまで進まず、
+		// コンシューマーはレプリカに複製されたレコードだけを読み込む
+		// falseの場合は、追加したレコードをすぐに読み込めるようにする
+		Enabled bool
+	}
+	Delay struct {
+		// RunSchedulerが遅延レコードの配信に失敗したときに、配信し直すまで待つ時間
+		// 0の場合は1秒待つ
+		RetryInterval time.Duration
+		// RunSchedulerが遅延レコードの配信に失敗したときに呼ばれる
+		// nilの場合はエラーを無視して配信し直す
+		OnError func(error)
+	}
+	Cleanup struct {
+		// RunCleanupが有効期限の切れたセグメントの削除に失敗したときに呼ばれる
+		// nilの場合はエラーを無視して、次の間隔で削除し直す
+		OnError func(error)
 	}
 }
@@ -0,0 +1,200 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// 遅延レコードを配信するときに追加するレコードに付ける、元の遅延レコードのオフセットを表すヘッダー
+const HeaderDelayedOffset = "delayed-offset"
+
+// トランザクションのレコードに配信時刻を指定したときに返すエラー
+// トランザクションのレコードはコミットしたときにまとめて見えるようになるので、遅らせることはできない
+var ErrDelayedTransaction = errors.New("transactional records cannot be delayed")
+
+// 配信を待っている遅延レコード
+type delayedRecord struct {
+	Offset    uint64 `json:"offset"`
+	DeliverAt int64  `json:"deliver_at"`
+}
+
+// 遅延レコードを配信を待つレコードとして記録するか、配信したレコードを配信を待つレコードから取り除く
+// 配信を待つレコードは配信時刻の順に並べておく
+func (l *Log) recordDelayed(record *api.Record) {
+	if record.DeliverAt != 0 {
+		d := delayedRecord{Offset: record.Offset, DeliverAt: record.DeliverAt}
+		i := sort.Search(len(l.state.Delayed), func(i int) bool {
+			e := l.state.Delayed[i]
+			return e.DeliverAt > d.DeliverAt || (e.DeliverAt == d.DeliverAt && e.Offset > d.Offset)
+		})
+		l.state.Delayed = append(l.state.Delayed, delayedRecord{})
+		copy(l.state.Delayed[i+1:], l.state.Delayed[i:])
+		l.state.Delayed[i] = d
+		return
+	}
+	v, ok := record.Header(HeaderDelayedOffset)
+	if !ok {
+		return
+	}
+	off, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return
+	}
+	l.removeDelayed(off)
+}
+
+// offの遅延レコードを配信を待つレコードから取り除く
+// 配信を待っていなかった場合はfalseを返す
+func (l *Log) removeDelayed(off uint64) bool {
+	for i, d := range l.state.Delayed {
+		if d.Offset == off {
+			l.state.Delayed = append(l.state.Delayed[:i], l.state.Delayed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// lowestより前の遅延レコードは読み込めないので、配信を待つレコードから取り除く
+func (l *Log) pruneDelayed(lowest uint64) {
+	delayed := l.state.Delayed[:0]
+	for _, d := range l.state.Delayed {
+		if d.Offset >= lowest {
+			delayed = append(delayed, d)
+		}
+	}
+	l.state.Delayed = delayed
+}
+
+// 配信を待っている遅延レコードのうち、最も早い配信時刻を返す
+// 配信を待っているレコードが無い場合はfalseを返す
+func (l *Log) NextDelivery() (time.Time, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.state.Delayed) == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, l.state.Delayed[0].DeliverAt), true
+}
+
+// 配信時刻がnow以前になった遅延レコードを配信し、配信したレコードの数を返す
+// 遅延レコードは読み込むときに読み飛ばされるので、配信時刻を外したレコードを末尾に追加することで配信する
+// 追加したレコードにはHeaderDelayedOffsetのヘッダーで元のオフセットを記録するので、
+// 再起動してセグメントから状態を作り直しても、配信したレコードを二度配信しない
+func (l *Log) DeliverDue(now time.Time) (int, error) {
+	l.mu.RLock()
+	var due []delayedRecord
+	for _, d := range l.state.Delayed {
+		if d.DeliverAt > now.UnixNano() {
+			break
+		}
+		due = append(due, d)
+	}
+	l.mu.RUnlock()
+	var n int
+	for _, d := range due {
+		// 読み込んでいる間も追加できるように、ロックを解放してから読み込む
+		// 複製されていない遅延レコードも配信する時刻になれば配信し、配信したレコードとともに複製される
+		original, err := l.read(d.Offset)
+		// ロックを解放している間に切り詰められたレコードは、もう配信できないので取り除く
+		if errors.Is(err, ErrOffsetOutOfRange) {
+			l.mu.Lock()
+			l.removeDelayed(d.Offset)
+			l.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to read delayed record %d: %w", d.Offset, err)
+		}
+		record := &api.Record{
+			Key:       original.Key,
+			Value:     original.Value,
+			Headers:   original.Headers,
+			ExpiresAt: original.ExpiresAt,
+		}
+		record.SetHeader(HeaderDelayedOffset, []byte(strconv.FormatUint(d.Offset, 10)))
+		delivered, err := l.deliver(d.Offset, record)
+		if err != nil {
+			return n, err
+		}
+		if delivered {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// offの遅延レコードがまだ配信を待っていれば、recordを追加して配信する
+// 配信する前に有効期限が切れたレコードは、追加せずに配信を待つレコードから取り除く
+func (l *Log) deliver(off uint64, record *api.Record) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := -1
+	for j, d := range l.state.Delayed {
+		if d.Offset == off {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return false, nil
+	}
+	if expired(record, time.Now().UnixNano()) {
+		l.state.Delayed = append(l.state.Delayed[:i], l.state.Delayed[i+1:]...)
+		return false, nil
+	}
+	if _, err := l.append(record); err != nil {
+		return false, fmt.Errorf("failed to deliver delayed record %d: %w", off, err)
+	}
+	return true, nil
+}
+
+// Config.Delay.RetryIntervalが0のときに、配信し直すまで待つ時間
+const defaultDeliveryRetryInterval = time.Second
+
+// ctxがキャンセルされるまで、配信時刻になった遅延レコードを配信し続ける
+// レコードが追加されるたびに次の配信時刻を調べ直すので、より早い配信時刻のレコードが追加されても遅れない
+// 配信に失敗してもスケジューラーは止まらず、Config.Delay.OnErrorにエラーを渡してRetryInterval後に配信し直す
+func (l *Log) RunScheduler(ctx context.Context) error {
+	retry := l.Config.Delay.RetryInterval
+	if retry == 0 {
+		retry = defaultDeliveryRetryInterval
+	}
+	for {
+		// 配信してから待ち始めるまでの間の追加を見逃さないように、配信する前に取得する
+		appended := l.Appended()
+		var (
+			timer *time.Timer
+			fire  <-chan time.Time
+		)
+		if _, err := l.DeliverDue(time.Now()); err != nil {
+			if l.Config.Delay.OnError != nil {
+				l.Config.Delay.OnError(err)
+			}
+			// 失敗したレコードの配信時刻はすでに過ぎているので、追加を待たずに配信し直す
+			appended = nil
+			timer = time.NewTimer(retry)
+			fire = timer.C
+		} else if next, ok := l.NextDelivery(); ok {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-appended:
+		case <-fire:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
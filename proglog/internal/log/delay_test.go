@@ -0,0 +1,258 @@
+package log_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayedDelivery(t *testing.T) {
+	testcases := map[string]func(t *testing.T, dir string, l *log.Log){
+		"hide until delivered":        testDelayedHidden,
+		"deliver past due at once":    testDelayedPastDue,
+		"resume from persisted state": testDelayedPersisted,
+		"rebuild from records":        testDelayedRebuild,
+		"run scheduler":               testDelayedScheduler,
+		"reject delayed transaction":  testDelayedTransaction,
+		"ignore forged header":        testDelayedForgedHeader,
+		"retry after failure":         testDelayedSchedulerRetry,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "delay-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, dir, l)
+		})
+	}
+}
+
+// 配信時刻になるまで遅延レコードが読み飛ばされ、配信すると末尾に追加されるかテストする
+func testDelayedHidden(t *testing.T, _ string, l *log.Log) {
+	defer l.Close()
+	at := time.Now().Add(time.Hour)
+	appendValue(t, l, "before")
+	appendDelayed(t, l, "delayed", at)
+	appendValue(t, l, "after")
+
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "before", "after")
+	next, ok := l.NextDelivery()
+	require.True(t, ok)
+	require.Equal(t, at.UnixNano(), next.UnixNano())
+
+	n, err := l.DeliverDue(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, "delayed", string(record.Value))
+	require.Equal(t, uint64(3), record.Offset)
+	v, _ := record.Header(log.HeaderDelayedOffset)
+	require.Equal(t, "1", string(v))
+
+	// 配信したレコードは二度配信しない
+	n, err = l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	_, ok = l.NextDelivery()
+	require.False(t, ok)
+}
+
+// 配信時刻を過ぎたレコードは、遅らせずに読み込めるかテストする
+func testDelayedPastDue(t *testing.T, _ string, l *log.Log) {
+	defer l.Close()
+	appendDelayed(t, l, "late", time.Now().Add(-time.Second))
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "late")
+	_, ok := l.NextDelivery()
+	require.False(t, ok)
+}
+
+// 再起動しても、配信を待っている遅延レコードを覚えているかテストする
+func testDelayedPersisted(t *testing.T, dir string, l *log.Log) {
+	at := time.Now().Add(time.Hour)
+	appendDelayed(t, l, "delayed", at)
+	require.NoError(t, l.Close())
+
+	l, err := log.NewLog(dir, l.Config)
+	require.NoError(t, err)
+	defer l.Close()
+	next, ok := l.NextDelivery()
+	require.True(t, ok)
+	require.Equal(t, at.UnixNano(), next.UnixNano())
+	n, err := l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+// 永続化した状態が無くても、セグメントのレコードから配信を待つレコードを作り直せるかテストする
+func testDelayedRebuild(t *testing.T, dir string, l *log.Log) {
+	at := time.Now().Add(time.Hour)
+	appendDelayed(t, l, "delivered", at)
+	appendDelayed(t, l, "pending", at.Add(time.Hour))
+	for i := 0; i < 3; i++ {
+		appendValue(t, l, "filler")
+	}
+	n, err := l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(filepath.Join(dir, "state.json")))
+
+	l, err = log.NewLog(dir, l.Config)
+	require.NoError(t, err)
+	defer l.Close()
+	next, ok := l.NextDelivery()
+	require.True(t, ok)
+	require.Equal(t, at.Add(time.Hour).UnixNano(), next.UnixNano())
+	n, err = l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+// スケジューラーが、配信時刻になった遅延レコードを配信するかテストする
+func testDelayedScheduler(t *testing.T, _ string, l *log.Log) {
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.RunScheduler(ctx)
+	}()
+	appendDelayed(t, l, "delayed", time.Now().Add(50*time.Millisecond))
+
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		appended := l.Appended()
+		record, err := it.Next()
+		if err == nil {
+			require.Equal(t, "delayed", string(record.Value))
+			break
+		}
+		select {
+		case <-appended:
+		case <-timeout:
+			t.Fatal("delayed record was not delivered")
+		}
+	}
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+}
+
+// トランザクションのレコードは遅らせられないかテストする
+func testDelayedTransaction(t *testing.T, _ string, l *log.Log) {
+	defer l.Close()
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("tx"), DeliverAt: time.Now().Add(time.Hour).UnixNano()})
+	require.True(t, errors.Is(err, log.ErrDelayedTransaction))
+}
+
+// クライアントが付けたHeaderDelayedOffsetのヘッダーで、遅延レコードの配信を取り消せないかテストする
+func testDelayedForgedHeader(t *testing.T, _ string, l *log.Log) {
+	defer l.Close()
+	at := time.Now().Add(time.Hour)
+	appendDelayed(t, l, "delayed", at)
+	forged := &api.Record{Value: []byte("forged")}
+	forged.AddHeader(log.HeaderDelayedOffset, []byte("0"))
+	off, err := l.Append(forged)
+	require.NoError(t, err)
+
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	_, ok := record.Header(log.HeaderDelayedOffset)
+	require.False(t, ok)
+	_, ok = l.NextDelivery()
+	require.True(t, ok)
+	n, err := l.DeliverDue(at)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+// 配信に失敗してもスケジューラーが止まらず、読み込めるようになったら配信し直すかテストする
+func testDelayedSchedulerRetry(t *testing.T, dir string, l *log.Log) {
+	require.NoError(t, l.Close())
+	errs := make(chan error, 10)
+	c := l.Config
+	c.Delay.RetryInterval = 10 * time.Millisecond
+	c.Delay.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendDelayed(t, l, "delayed", time.Now().Add(50*time.Millisecond))
+	require.NoError(t, l.Sync())
+
+	// ストアのレコードを壊して、遅延レコードを読み込めないようにする
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	original := make([]byte, 4)
+	_, err = f.ReadAt(original, 8)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 8)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- l.RunScheduler(ctx)
+	}()
+	// 失敗した後も配信し直し続ける
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduler did not retry delivery")
+		}
+	}
+
+	_, err = f.WriteAt(original, 8)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ok := l.NextDelivery()
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	record, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "delayed", string(record.Value))
+
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+}
+
+func appendDelayed(t *testing.T, l *log.Log, value string, at time.Time) {
+	t.Helper()
+	_, err := l.Append(&api.Record{Value: []byte(value), DeliverAt: at.UnixNano()})
+	require.NoError(t, err)
+}
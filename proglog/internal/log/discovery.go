@@ -0,0 +1,120 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var baseDecimal = 10
+
+// 対になるファイルが見つからないセグメントのファイルを退避するディレクトリ
+const orphanDir = "orphaned"
+
+var (
+	// 隣り合うセグメントの間にオフセットの抜けがあるときに返すエラー
+	ErrSegmentGap = errors.New("gap between segments")
+	// 隣り合うセグメントのオフセットの範囲が重なっているときに返すエラー
+	ErrSegmentOverlap = errors.New("overlapping segments")
+)
+
+// ディレクトリ内のファイルをベースオフセットと拡張子でグループ化し、開くことのできるセグメントのベースオフセットを昇順で返す
+// ストアファイルとインデックスファイルの両方が揃っていないセグメントのファイルは退避ディレクトリに移動する
+func (l *Log) discoverSegments() ([]uint64, error) {
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	groups := make(map[uint64]map[string]string)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ext := path.Ext(file.Name())
+		switch ext {
+		case storeFileExt, indexFileExt, sealedFileExt:
+		default:
+			// セグメントを構成しないファイルは無視する
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), baseDecimal, 64)
+		if err != nil {
+			continue
+		}
+		if groups[off] == nil {
+			groups[off] = make(map[string]string)
+		}
+		groups[off][ext] = file.Name()
+	}
+	baseOffsets := make([]uint64, 0, len(groups))
+	for off, group := range groups {
+		_, hasStore := group[storeFileExt]
+		_, hasIndex := group[indexFileExt]
+		if !hasStore || !hasIndex {
+			if err = l.quarantine(group); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// 対になるファイルが見つからないセグメントのファイルを退避ディレクトリに移動する
+// 削除はしないので、運用者が内容を確認して復旧することができる
+func (l *Log) quarantine(group map[string]string) error {
+	dir := path.Join(l.Dir, orphanDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create orphan directory: %w", err)
+	}
+	for _, name := range group {
+		if err := os.Rename(path.Join(l.Dir, name), path.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to quarantine orphaned file %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ベースオフセットの昇順に並んだセグメントのオフセットの範囲が連続しているか検証する
+func checkSegmentRanges(segments []*segment) error {
+	for i := 1; i < len(segments); i++ {
+		prev, cur := segments[i-1], segments[i]
+		if prev.nextOffset < cur.baseOffset {
+			return fmt.Errorf("segment %d ends at %d but next segment starts at %d: %w",
+				prev.baseOffset, prev.nextOffset, cur.baseOffset, ErrSegmentGap)
+		}
+		if prev.nextOffset > cur.baseOffset {
+			return fmt.Errorf("segment %d ends at %d but next segment starts at %d: %w",
+				prev.baseOffset, prev.nextOffset, cur.baseOffset, ErrSegmentOverlap)
+		}
+	}
+	return nil
+}
+
+// 開いたセグメントをすべて閉じる
+// セットアップに失敗したときの後始末で使うので、エラーは無視する
+func closeSegments(segments []*segment) {
+	for _, s := range segments {
+		_ = s.Close()
+	}
+}
+
+// セグメントを構成するファイルの名前かどうかを返す
+func isSegmentFileName(name string) bool {
+	ext := path.Ext(name)
+	switch ext {
+	case storeFileExt, indexFileExt, sealedFileExt:
+	default:
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimSuffix(name, ext), baseDecimal, 64)
+	return err == nil
+}
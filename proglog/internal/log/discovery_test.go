@@ -0,0 +1,102 @@
+package log_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverSegments(t *testing.T) {
+	testcases := map[string]func(t *testing.T, dir string, c log.Config){
+		"ignore stray files":         testIgnoreStrayFiles,
+		"quarantine orphaned files":  testQuarantineOrphans,
+		"refuse to start on gap":     testRefuseGap,
+		"refuse to start on overlap": testRefuseOverlap,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "discovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 32
+
+			// オフセット0, 2, 4から始まる3つのセグメントを作る
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 4; i++ {
+				_, err = l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.Close())
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+// セグメントを構成しないファイルがあっても、既存のセグメントを正しく開けるかテストする
+func testIgnoreStrayFiles(t *testing.T, dir string, c log.Config) {
+	for _, name := range []string{"README", "notes.txt", "2.timeindex"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "1"), 0o755))
+
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// 無視したファイルには手を付けない
+	_, err = os.Stat(filepath.Join(dir, "2.timeindex"))
+	require.NoError(t, err)
+}
+
+// ストアファイルとインデックスファイルの対が揃っていないファイルが退避されるかテストする
+func testQuarantineOrphans(t *testing.T, dir string, c log.Config) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10.store"), []byte("orphan"), 0o644))
+
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	_, err = os.Stat(filepath.Join(dir, "10.store"))
+	require.True(t, os.IsNotExist(err))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "orphaned", "10.store"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("orphan"), b)
+}
+
+// セグメントが抜けている場合に起動を拒否するかテストする
+func testRefuseGap(t *testing.T, dir string, c log.Config) {
+	// インデックスファイルが無くなったセグメントは退避され、その部分のオフセットが抜ける
+	require.NoError(t, os.Remove(filepath.Join(dir, "2.index")))
+
+	_, err := log.NewLog(dir, c)
+	require.True(t, errors.Is(err, log.ErrSegmentGap), err)
+	_, err = os.Stat(filepath.Join(dir, "orphaned", "2.store"))
+	require.NoError(t, err)
+}
+
+// セグメントのオフセットの範囲が重なっている場合に起動を拒否するかテストする
+func testRefuseOverlap(t *testing.T, dir string, c log.Config) {
+	for _, ext := range []string{".store", ".index", ".sealed"} {
+		require.NoError(t, os.Rename(filepath.Join(dir, "2"+ext), filepath.Join(dir, "1"+ext)))
+	}
+
+	_, err := log.NewLog(dir, c)
+	require.True(t, errors.Is(err, log.ErrSegmentOverlap), err)
+}
@@ -0,0 +1,113 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// レコードの有効期限がnowまでに切れているかどうかを返す
+func expired(record *api.Record, now int64) bool {
+	return record.ExpiresAt != 0 && record.ExpiresAt <= now
+}
+
+// 封印されたセグメントのすべてのレコードの有効期限が切れる時刻を返す
+// 有効期限の無いレコードを含む場合はfalseを返す
+// 封印されたセグメントは変更されないので、一度ストアを読み込んだら結果を覚えておく
+func (s *segment) expiry() (int64, bool, error) {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	if !s.expiryScanned {
+		s.expiresAt, s.expires = 0, true
+		err := s.scan(func(record *api.Record) error {
+			if record.ExpiresAt == 0 {
+				s.expires = false
+			} else if record.ExpiresAt > s.expiresAt {
+				s.expiresAt = record.ExpiresAt
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		s.expiryScanned = true
+	}
+	return s.expiresAt, s.expires, nil
+}
+
+// 先頭から続く、すべてのレコードの有効期限がnowまでに切れたセグメントを削除し、削除したセグメントの数を返す
+// ログの途中のセグメントは、オフセットが連続しなくなるので削除しない
+// アクティブなセグメントは追加されるレコードの有効期限が分からないので削除しない
+// ストアを読み込んで有効期限を求める間も追加や読み込みができるように、書き込みロックは削除するときだけ取得する
+func (l *Log) RemoveExpired(now time.Time) (int, error) {
+	last, ok, err := l.expiredOffset(now)
+	if err != nil || !ok {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 読み込みロックを解放している間にリモートのセグメントが増えていれば、ローカルのセグメントは先頭ではなくなる
+	if !l.localHead() {
+		return 0, nil
+	}
+	// 有効期限が切れたレコードが有効期限内に戻ることは無いので、その間に切り詰められていてもlastまでは削除できる
+	before := len(l.segments)
+	if err := l.truncate(last); err != nil {
+		return 0, err
+	}
+	return before - len(l.segments), nil
+}
+
+// 先頭から続く、すべてのレコードの有効期限がnowまでに切れたセグメントのうち、最後のレコードのオフセットを返す
+// 削除できるセグメントが無い場合はfalseを返す
+func (l *Log) expiredOffset(now time.Time) (uint64, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.localHead() {
+		return 0, false, nil
+	}
+	var (
+		last    uint64
+		expired bool
+	)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if !s.sealed {
+			break
+		}
+		at, ok, err := s.expiry()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read expiry of segment %d: %w", s.baseOffset, err)
+		}
+		if !ok || at > now.UnixNano() {
+			break
+		}
+		last, expired = s.nextOffset-1, true
+	}
+	return last, expired, nil
+}
+
+// ローカルの最も古いセグメントが、ログの先頭のセグメントかどうかを返す
+// オブジェクトストアにだけ存在する、より古いセグメントがあればローカルのセグメントは先頭ではない
+func (l *Log) localHead() bool {
+	return l.tier == nil || len(l.tier.remote) == 0 || l.tier.remote[0].BaseOffset >= l.segments[0].baseOffset
+}
+
+// ctxがキャンセルされるまで、intervalごとに有効期限が切れたセグメントを削除する
+// 削除に失敗してもConfig.Cleanup.OnErrorを呼び出すだけで止まらず、次の間隔で削除し直す
+// ctxがキャンセルされたときだけ、そのエラーを返す
+func (l *Log) RunCleanup(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := l.RemoveExpired(time.Now()); err != nil && l.Config.Cleanup.OnError != nil {
+			l.Config.Cleanup.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package log_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log){
+		"skip expired records":               testExpirySkip,
+		"remove expired segments":            testExpiryRemove,
+		"keep segments with lasting records": testExpiryKeep,
+		"remove while appending":             testExpiryConcurrent,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "expiry-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+
+			fn(t, l)
+		})
+	}
+}
+
+// 有効期限が切れたレコードを読み飛ばすかテストする
+func testExpirySkip(t *testing.T, l *log.Log) {
+	now := time.Now()
+	appendValue(t, l, "lasting")
+	appendExpiring(t, l, "expired", now.Add(-time.Second))
+	appendExpiring(t, l, "valid", now.Add(time.Hour))
+
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "lasting", "valid")
+}
+
+// すべてのレコードの有効期限が切れた先頭のセグメントを削除するかテストする
+func testExpiryRemove(t *testing.T, l *log.Log) {
+	at := time.Now().Add(time.Hour)
+	for i := 0; i < 6; i++ {
+		appendExpiring(t, l, "session", at)
+	}
+	appendValue(t, l, "lasting")
+
+	n, err := l.RemoveExpired(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = l.RemoveExpired(at)
+	require.NoError(t, err)
+	require.Greater(t, n, 0)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+	require.LessOrEqual(t, lowest, uint64(6))
+
+	// 有効期限の無いレコードは残る
+	record, err := l.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, "lasting", string(record.Value))
+}
+
+// 有効期限の無いレコードを含むセグメントより後ろは、期限が切れても削除しないかテストする
+func testExpiryKeep(t *testing.T, l *log.Log) {
+	at := time.Now().Add(time.Hour)
+	appendValue(t, l, "lasting")
+	for i := 0; i < 6; i++ {
+		appendExpiring(t, l, "session", at)
+	}
+	n, err := l.RemoveExpired(at)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+}
+
+// 追加や他の削除と同時に削除しても、有効期限が切れたセグメントだけを削除するかテストする
+func testExpiryConcurrent(t *testing.T, l *log.Log) {
+	at := time.Now().Add(time.Hour)
+	for i := 0; i < 20; i++ {
+		appendExpiring(t, l, "session", at)
+	}
+
+	var wg sync.WaitGroup
+	removed := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := l.RemoveExpired(at)
+			require.NoError(t, err)
+			removed <- n
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		appendValue(t, l, "lasting")
+	}
+	wg.Wait()
+	close(removed)
+	var n int
+	for r := range removed {
+		n += r
+	}
+	require.Greater(t, n, 0)
+
+	// 有効期限の無いレコードは残る
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.LessOrEqual(t, lowest, uint64(20))
+	for off := uint64(20); off < 40; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "lasting", string(record.Value))
+	}
+	n, err = l.RemoveExpired(at)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+// 削除に失敗してもRunCleanupが止まらず、読み込めるようになったら削除し直すかテストする
+func TestRunCleanupRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "expiry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	errs := make(chan error, 10)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Cleanup.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 6; i++ {
+		appendExpiring(t, l, "session", time.Now().Add(-time.Second))
+	}
+	appendValue(t, l, "lasting")
+	require.NoError(t, l.Sync())
+
+	// 先頭のセグメントのレコードを壊して、有効期限を読み込めないようにする
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	original := make([]byte, 4)
+	_, err = f.ReadAt(original, 8)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 8)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- l.RunCleanup(ctx, 10*time.Millisecond)
+	}()
+	// 失敗した後も削除し直し続ける
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("cleanup did not retry")
+		}
+	}
+
+	_, err = f.WriteAt(original, 8)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		lowest, err := l.LowestOffset()
+		require.NoError(t, err)
+		return lowest > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+}
+
+func appendExpiring(t *testing.T, l *log.Log, value string, at time.Time) {
+	t.Helper()
+	_, err := l.Append(&api.Record{Value: []byte(value), ExpiresAt: at.UnixNano()})
+	require.NoError(t, err)
+}
@@ -6,6 +6,8 @@ const (
 )
 
 var (
+	ExportErrRelativeOffsetOverflow = errRelativeOffsetOverflow
+
 	ExportEnc        = enc
 	ExportNewStore   = newStore
 	ExportNewIndex   = newIndex
@@ -17,3 +19,15 @@ type ExportStore = store
 func (s *segment) ExportNextOffset() uint64 {
 	return s.nextOffset
 }
+
+func (s *store) ExportSeal() error {
+	return s.seal()
+}
+
+func (s *segment) ExportSeal() error {
+	return s.seal()
+}
+
+func (s *segment) ExportIndexSize() uint64 {
+	return s.index.size
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/tysonmote/gommap"
@@ -26,6 +27,8 @@ type index struct {
 	mmap gommap.MMap
 	// インデックスのサイズ
 	size uint64
+	// 封印されたインデックスは実際のサイズで読み取り専用でマップされる
+	sealed bool
 }
 
 // 指定されたファイルのインデックスを作成する
@@ -53,7 +56,87 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
+// 封印されたセグメントのインデックスを作成する
+// ファイルはすでに実際のサイズに切り詰められているので、成長させずに読み取り専用でマップする
+func newSealedIndex(f *os.File) (*index, error) {
+	idx := &index{
+		file:   f,
+		sealed: true,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	idx.size = uint64(fi.Size())
+	if err = idx.mapReadOnly(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// インデックスを封印する
+// ファイルを実際のサイズに切り詰めてから読み取り専用でマップし直すので
+// 最大インデックスサイズ分のメモリを保持し続けなくてよくなる
+func (i *index) seal() error {
+	if i.sealed {
+		return nil
+	}
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return fmt.Errorf("failed to sync mmap: %w", err)
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return fmt.Errorf("failed to unmap: %w", err)
+	}
+	i.mmap = nil
+	if err := i.file.Truncate(int64(i.size)); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if err := i.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := i.mapReadOnly(); err != nil {
+		return err
+	}
+	i.sealed = true
+	return nil
+}
+
+// 書き込んだエントリをストレージに同期する
+func (i *index) sync() error {
+	if i.sealed {
+		return nil
+	}
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return fmt.Errorf("failed to sync mmap: %w", err)
+	}
+	return nil
+}
+
+// インデックスファイルを実際のサイズで読み取り専用でマップする
+func (i *index) mapReadOnly() error {
+	// 空のファイルはマップできないので、マップしない
+	if i.size == 0 {
+		return nil
+	}
+	mmap, err := gommap.MapRegion(i.file.Fd(), 0, int64(i.size), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to get mmap: %w", err)
+	}
+	i.mmap = mmap
+	return nil
+}
+
 func (i *index) Close() error {
+	// 封印されたインデックスはすでに永続化されて切り詰められているので、マップを解除して閉じるだけでよい
+	if i.sealed {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return fmt.Errorf("failed to unmap: %w", err)
+			}
+			i.mmap = nil
+		}
+		return errors.WithMessage(i.file.Close(), "failed to close file")
+	}
 	// memory mapped fileがそのデータを永続化ファイルに同期したことを確認する
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return fmt.Errorf("failed to sync mmap: %w", err)
@@ -96,6 +179,21 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// 与えられた相対オフセット以下で最も大きな相対オフセットを持つエントリを二分探索して返す
+// エントリは相対オフセットの昇順に書き込まれるので、疎なインデックスでも探索できる
+func (i *index) Search(in uint32) (out uint32, pos uint64, err error) {
+	n := int(i.size / entWidth)
+	// inより大きな相対オフセットを持つ最初のエントリを探す
+	j := sort.Search(n, func(j int) bool {
+		p := uint64(j) * entWidth
+		return enc.Uint32(i.mmap[p:p+offWidth]) > in
+	})
+	if j == 0 {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(j - 1))
+}
+
 // 与えられたオフセットと位置をインデックスに追加する
 func (i *index) Write(off uint32, pos uint64) error {
 	// エントリを書き込むためのスペースがあるかチェックする
@@ -111,6 +209,13 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// 末尾のエントリを取り除く
+func (i *index) removeLast() {
+	if i.size >= entWidth {
+		i.size -= entWidth
+	}
+}
+
 // インデックスのファイルパスを返す
 func (i *index) Name() string {
 	return i.file.Name()
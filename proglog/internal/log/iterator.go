@@ -0,0 +1,285 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// イテレータがストアから先読みするバイト数
+const iteratorReadAheadBytes = 64 * 1024
+
+// ログのレコードをオフセットの順に読み込むイテレータ
+// Readを繰り返し呼び出す場合と違い、読み込んでいるセグメントのストアを先読みしながら順に読み進めるので
+// レコードごとにセグメントを探したり、ストアのバッファをフラッシュしたりしない
+// イテレータは並行して使うことはできない
+type Iterator struct {
+	l *Log
+	// 次に読み込むレコードのオフセット
+	off uint64
+	// 読み込んでいるセグメント
+	// 読み込んでいる間にTruncateで削除されても最後まで読めるように参照している
+	// オブジェクトストアにだけ存在するセグメントを読み込んでいる間はnilになる
+	seg *segment
+	// 次に読み込むレコードのストア内での位置と、先読みできるストアの末尾の位置
+	pos, limit uint64
+	r          *bufio.Reader
+	// レコードを読み込むためのバッファ
+	// Unmarshalはbytesフィールドをコピーするので、レコードごとに確保し直さずに使い回す
+	buf []byte
+	err error
+	// visibleより前の、ハイウォーターマークまでのレコードだけを読み込む
+	// ReadCommittedでは、完了していないトランザクションの最初のレコードより前までになる
+	isolation IsolationLevel
+	visible   uint64
+}
+
+// fromのオフセットから読み込むイテレータを返す
+// fromには、ログに含まれるオフセットか次に追加されるレコードのオフセットを指定できる
+// トランザクションのレコードも制御レコードもすべて返す
+func (l *Log) NewIterator(from uint64) (*Iterator, error) {
+	return l.newIterator(from, ReadUncommitted)
+}
+
+// fromのオフセットから、コミットされたトランザクションのレコードとトランザクションではないレコードだけを読み込むイテレータを返す
+// 完了していないトランザクションのレコードに達すると、トランザクションが完了するまでio.EOFを返す
+func (l *Log) NewReadCommittedIterator(from uint64) (*Iterator, error) {
+	return l.newIterator(from, ReadCommitted)
+}
+
+func (l *Log) newIterator(from uint64, isolation IsolationLevel) (*Iterator, error) {
+	it := &Iterator{
+		l:         l,
+		off:       from,
+		r:         bufio.NewReaderSize(nil, iteratorReadAheadBytes),
+		isolation: isolation,
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := it.seek(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// 次のレコードを返す
+// ログの末尾かハイウォーターマークに達したときはio.EOFを返す
+// その後にレコードが追加されれば、再び呼び出すことで続きから読み込める
+// 読み込むレコードがTruncateで削除されていた場合はErrOffsetOutOfRangeを返す
+// 遅延レコードは読み飛ばし、配信時刻になって末尾に追加されたレコードとして返す
+// 有効期限が切れたレコードも読み飛ばす
+func (it *Iterator) Next() (*api.Record, error) {
+	for {
+		record, err := it.nextVisible()
+		if err != nil {
+			return nil, err
+		}
+		if record.DeliverAt != 0 || expired(record, time.Now().UnixNano()) {
+			continue
+		}
+		return record, nil
+	}
+}
+
+// ハイウォーターマークと分離レベルに従って、読み込めるレコードを返す
+func (it *Iterator) nextVisible() (*api.Record, error) {
+	for {
+		// ハイウォーターマークと、完了していないトランザクションの最初のレコードより先は読み込まない
+		if it.off >= it.visible {
+			it.l.mu.RLock()
+			it.visible = it.l.visibleOffset(it.isolation)
+			it.l.mu.RUnlock()
+			if it.off >= it.visible {
+				return nil, io.EOF
+			}
+		}
+		record, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if it.isolation != ReadCommitted {
+			return record, nil
+		}
+		if record.Control != api.ControlType_CONTROL_TYPE_UNSPECIFIED {
+			continue
+		}
+		if record.TransactionId != "" {
+			it.l.mu.RLock()
+			aborted := it.l.isAborted(record)
+			it.l.mu.RUnlock()
+			if aborted {
+				continue
+			}
+		}
+		return record, nil
+	}
+}
+
+// 次のレコードをトランザクションに関わらず返す
+func (it *Iterator) next() (*api.Record, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.seg == nil {
+		return it.nextRemote()
+	}
+	// 先読みできる範囲を読み終えたら、追加されたレコードか次のセグメントに進む
+	if it.pos >= it.limit {
+		if err := it.advance(); err != nil {
+			return nil, err
+		}
+		if it.seg == nil {
+			return it.nextRemote()
+		}
+	}
+	var size [lenWidth]byte
+	if _, err := io.ReadFull(it.r, size[:]); err != nil {
+		return nil, it.fail(fmt.Errorf("failed to read record length: %w", err))
+	}
+	n := enc.Uint64(size[:])
+	if uint64(cap(it.buf)) < n {
+		it.buf = make([]byte, n)
+	}
+	p := it.buf[:n]
+	if _, err := io.ReadFull(it.r, p); err != nil {
+		return nil, it.fail(fmt.Errorf("failed to read record: %w", err))
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, it.fail(fmt.Errorf("failed to unmarshal record: %w", err))
+	}
+	it.pos += lenWidth + n
+	it.off++
+	return record, nil
+}
+
+// 次に読み込むレコードのオフセットを返す
+func (it *Iterator) Offset() uint64 {
+	return it.off
+}
+
+// イテレータを閉じ、参照しているセグメントを解放する
+func (it *Iterator) Close() error {
+	if it.err == errIteratorClosed {
+		return nil
+	}
+	it.err = errIteratorClosed
+	return it.releaseSegment()
+}
+
+// 閉じたイテレータから読み込もうとしたときに返すエラー
+var errIteratorClosed = errors.New("iterator is closed")
+
+// 読み込みに失敗したイテレータは、以降同じエラーを返す
+func (it *Iterator) fail(err error) error {
+	it.err = err
+	return err
+}
+
+// 先読みできる範囲を読み終えたときに、読み込めるレコードを探す
+func (it *Iterator) advance() error {
+	it.l.mu.RLock()
+	defer it.l.mu.RUnlock()
+	// 読み込んでいるセグメントに追加されたレコードがあれば、その範囲を先読みする
+	if it.off < it.seg.nextOffset {
+		it.reset(it.seg.end)
+		return nil
+	}
+	if err := it.seek(); err != nil {
+		return err
+	}
+	if it.seg != nil && it.pos >= it.limit {
+		return io.EOF
+	}
+	return nil
+}
+
+// it.offを含むセグメントを参照し、そのレコードの位置から読み込めるようにする
+// ログのロックを取得してから呼び出さなければならない
+func (it *Iterator) seek() error {
+	if err := it.releaseSegment(); err != nil {
+		return it.fail(err)
+	}
+	// ローカルのセグメントより古いオフセットは、オブジェクトストアから読み込む
+	if it.off < it.l.segments[0].baseOffset {
+		if it.l.tier != nil {
+			if _, ok := it.l.tier.find(it.off); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("offset: %d: %w", it.off, ErrOffsetOutOfRange)
+	}
+	var s *segment
+	for _, segment := range it.l.segments {
+		if segment.baseOffset <= it.off && it.off < segment.nextOffset {
+			s = segment
+			break
+		}
+	}
+	// 末尾のレコードの次のオフセットからは、アクティブなセグメントに追加されるのを待って読み込む
+	active := it.l.segments[len(it.l.segments)-1]
+	if s == nil && it.off == active.nextOffset {
+		s = active
+	}
+	if s == nil {
+		return fmt.Errorf("offset: %d: %w", it.off, ErrOffsetOutOfRange)
+	}
+	pos := s.end
+	if it.off < s.nextOffset {
+		var err error
+		if pos, err = s.position(it.off - s.baseOffset); err != nil {
+			return it.fail(err)
+		}
+	}
+	s.acquire()
+	it.seg = s
+	it.pos = pos
+	it.reset(s.end)
+	return nil
+}
+
+// ストアのit.posからlimitまでを先読みするようにリーダーを作り直す
+func (it *Iterator) reset(limit uint64) {
+	it.limit = limit
+	it.r.Reset(io.NewSectionReader(it.seg.store, int64(it.pos), int64(limit-it.pos)))
+}
+
+// オブジェクトストアにだけ存在するセグメントから次のレコードを読み込む
+// ローカルのセグメントに達したら、そこからは先読みしながら読み込む
+func (it *Iterator) nextRemote() (*api.Record, error) {
+	it.l.mu.RLock()
+	if it.off >= it.l.segments[0].baseOffset {
+		err := it.seek()
+		it.l.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		return it.next()
+	}
+	it.l.mu.RUnlock()
+	record, err := it.l.read(it.off)
+	if err != nil {
+		return nil, err
+	}
+	it.off++
+	return record, nil
+}
+
+// 参照しているセグメントを解放する
+func (it *Iterator) releaseSegment() error {
+	if it.seg == nil {
+		return nil
+	}
+	s := it.seg
+	it.seg = nil
+	it.r.Reset(nil)
+	if err := s.release(); err != nil {
+		return fmt.Errorf("failed to release segment: %w", err)
+	}
+	return nil
+}
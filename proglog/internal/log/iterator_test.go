@@ -0,0 +1,199 @@
+package log_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log){
+		"iterate across segments":          testIterateSegments,
+		"iterate from middle of segment":   testIterateFromMiddle,
+		"follow appended records":          testIterateFollow,
+		"out of range start":               testIterateOutOfRange,
+		"truncate while iterating":         testIterateTruncate,
+		"iterate with sparse index":        testIterateSparseIndex,
+		"iterate remote and local records": testIterateRemote,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+
+			fn(t, l)
+		})
+	}
+}
+
+// イテレータがセグメントの境界をまたいで、すべてのレコードを順に返すかテストする
+func testIterateSegments(t *testing.T, l *log.Log) {
+	appendRecords(t, l, 10)
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireIterate(t, it, 0, 10)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+// セグメントの途中のオフセットから読み始められるかテストする
+func testIterateFromMiddle(t *testing.T, l *log.Log) {
+	appendRecords(t, l, 10)
+	it, err := l.NewIterator(4)
+	require.NoError(t, err)
+	defer it.Close()
+	requireIterate(t, it, 4, 10)
+}
+
+// 末尾に達した後に追加されたレコードを、同じイテレータで続けて読めるかテストする
+func testIterateFollow(t *testing.T, l *log.Log) {
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	appendRecords(t, l, 2)
+	requireIterate(t, it, 0, 2)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// 次のセグメントに移った後に追加されたレコードも読める
+	appendRecords(t, l, 8)
+	requireIterate(t, it, 2, 10)
+	require.Equal(t, uint64(10), it.Offset())
+}
+
+// ログの範囲外のオフセットから読み始めようとするとエラーを返すかテストする
+func testIterateOutOfRange(t *testing.T, l *log.Log) {
+	appendRecords(t, l, 10)
+	_, err := l.NewIterator(11)
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+
+	require.NoError(t, l.Truncate(5))
+	_, err = l.NewIterator(0)
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+}
+
+// 読み込んでいるセグメントが削除されても最後まで読み、削除された次のセグメントに進もうとするとエラーを返すかテストする
+func testIterateTruncate(t *testing.T, l *log.Log) {
+	appendRecords(t, l, 10)
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireIterate(t, it, 0, 1)
+
+	require.NoError(t, l.Truncate(5))
+	_, err = os.Stat(filepath.Join(l.Dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+	requireIterate(t, it, 1, 3)
+	_, err = it.Next()
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+}
+
+// 疎なインデックスのセグメントでも途中のオフセットから読み始められるかテストする
+func testIterateSparseIndex(t *testing.T, l *log.Log) {
+	require.NoError(t, l.Close())
+	c := l.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.IndexIntervalBytes = 100
+	l, err := log.NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRecords(t, l, 20)
+
+	it, err := l.NewIterator(13)
+	require.NoError(t, err)
+	defer it.Close()
+	requireIterate(t, it, 13, 20)
+}
+
+// オブジェクトストアにだけ存在するセグメントから、ローカルのセグメントへ続けて読めるかテストする
+func testIterateRemote(t *testing.T, l *log.Log) {
+	require.NoError(t, l.Close())
+	objects, err := log.NewLocalObjectStore(filepath.Join(l.Dir, "objects"))
+	require.NoError(t, err)
+	c := l.Config
+	c.Tier.ObjectStore = objects
+	l, err = log.NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRecords(t, l, 10)
+	require.NoError(t, l.Offload())
+
+	it, err := l.NewIterator(1)
+	require.NoError(t, err)
+	defer it.Close()
+	requireIterate(t, it, 1, 10)
+}
+
+// イテレータからfromからtoの直前までのオフセットのレコードが順に得られることを確認する
+func requireIterate(t *testing.T, it *log.Iterator, from, to uint64) {
+	t.Helper()
+	for off := from; off < to; off++ {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
+
+func BenchmarkIterator(b *testing.B) {
+	dir, err := ioutil.TempDir("", "iterator-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := log.NewLog(dir, c)
+	require.NoError(b, err)
+	defer l.Close()
+	const n = 10000
+	value := make([]byte, 64)
+	for i := 0; i < n; i++ {
+		_, err = l.Append(&api.Record{Value: value})
+		require.NoError(b, err)
+	}
+
+	b.Run("Read", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for off := uint64(0); off < n; off++ {
+				if _, err := l.Read(off); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Iterator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			it, err := l.NewIterator(0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for {
+				if _, err = it.Next(); err != nil {
+					break
+				}
+			}
+			if err != io.EOF {
+				b.Fatal(err)
+			}
+			_ = it.Close()
+		}
+	})
+}
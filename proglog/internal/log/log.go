@@ -5,17 +5,13 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"google.golang.org/protobuf/proto"
 )
 
-var baseDecimal = 10
-
 type Log struct {
 	mu sync.RWMutex
 
@@ -24,6 +20,15 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	// オブジェクトストアが設定されている場合に、封印されたセグメントのアップロードとリモートのセグメントの読み込みを行う
+	tier *tier
+	// プロデューサーとトランザクションの状態
+	state *logState
+	// コンシューマーが読み込めるレコードの上限のオフセット
+	highWatermark uint64
+	// レコードが追加されたときやハイウォーターマークが進んだときに閉じるチャネル
+	// 閉じるたびに新しいチャネルに置き換える
+	appended chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -34,8 +39,15 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxIndexBytes = 1024
 	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
+	}
+	if c.Tier.ObjectStore != nil {
+		if c.Tier.CacheSegments == 0 {
+			l.Config.Tier.CacheSegments = 1
+		}
+		l.tier = newTier(dir, l.Config)
 	}
 	if err := l.setup(); err != nil {
 		return nil, fmt.Errorf("failed to setup log: %w", err)
@@ -45,33 +57,62 @@ func NewLog(dir string, c Config) (*Log, error) {
 
 func (l *Log) setup() error {
 	// ディスク上にすでに存在するセグメントに対して自分自身をセットアップする
-	files, err := os.ReadDir(l.Dir)
+	baseOffsets, err := l.discoverSegments()
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
-	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, baseDecimal, 0)
-		baseOffsets = append(baseOffsets, off)
-	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+		return fmt.Errorf("failed to discover segments: %w", err)
+	}
+	segments := make([]*segment, 0, len(baseOffsets))
+	for _, off := range baseOffsets {
+		s, err := newSegment(l.Dir, off, l.Config)
+		if err != nil {
+			closeSegments(segments)
 			return fmt.Errorf("failed to create new segment with base offset: %w", err)
 		}
-		i++
+		segments = append(segments, s)
+	}
+	// セグメントのオフセットの範囲に抜けや重なりがあるログは壊れているので起動しない
+	if err = checkSegmentRanges(segments); err != nil {
+		closeSegments(segments)
+		return err
+	}
+	if len(segments) > 0 {
+		l.segments = segments
+		l.activeSegment = segments[len(segments)-1]
+	}
+	if err = l.setupTier(); err != nil {
+		return fmt.Errorf("failed to setup tiered storage: %w", err)
 	}
 	// 既存のセグメントがない場合は最初のセグメントをブートストラップする
+	// リモートのセグメントがある場合はその続きから始める
 	if l.segments == nil {
-		err = l.newSegment(l.Config.Segment.InitialOffset)
+		initial := l.Config.Segment.InitialOffset
+		if l.tier != nil && len(l.tier.remote) > 0 {
+			initial = l.tier.remote[len(l.tier.remote)-1].NextOffset
+		}
+		err = l.newSegment(initial)
 		if err != nil {
 			return fmt.Errorf("failed to create new segment with initial offset: %w", err)
 		}
 	}
-	return nil
+	// 封印される前に閉じられたアクティブではないセグメントを封印する
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if err = s.seal(); err != nil {
+			return fmt.Errorf("failed to seal segment: %w", err)
+		}
+	}
+	// 最後のセグメントが封印されている場合は書き込めないので、その次のセグメントを作る
+	if l.activeSegment.sealed {
+		if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return fmt.Errorf("failed to create new segment after sealed segment: %w", err)
+		}
+	}
+	if err = l.loadState(); err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	if err = l.abortOpenTransactions(); err != nil {
+		return err
+	}
+	return l.loadHighWatermark()
 }
 
 // ログにレコードを追加する
@@ -81,21 +122,124 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	// よりパフォーマンスを求めるのであれば、セグメントごとにロックを作ることもできるが、ここではしていない
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// 制御レコードはトランザクションを完了するときにだけ書き込む
+	if record.Control != api.ControlType_CONTROL_TYPE_UNSPECIFIED {
+		return 0, ErrControlRecord
+	}
+	if record.TransactionId != "" {
+		if _, ok := l.state.Transactions[record.TransactionId]; !ok {
+			return 0, fmt.Errorf("transaction %s: %w", record.TransactionId, ErrTransactionNotFound)
+		}
+		if record.DeliverAt != 0 {
+			return 0, ErrDelayedTransaction
+		}
+	}
+	// 配信した遅延レコードを表すヘッダーはDeliverDueだけが付ける
+	// クライアントが付けたものを残すと、別の遅延レコードを配信済みとして取り除けてしまう
+	record.DelHeader(HeaderDelayedOffset)
+	// 配信時刻を過ぎているレコードは、遅らせずにすぐに読み込めるようにする
+	if record.DeliverAt != 0 && record.DeliverAt <= time.Now().UnixNano() {
+		record.DeliverAt = 0
+	}
+	return l.append(record)
+}
+
+// ログのロックを取得した状態でレコードを追加する
+func (l *Log) append(record *api.Record) (uint64, error) {
+	// リトライなどで同じプロデューサーが同じシーケンス番号のレコードを送ってきた場合は
+	// 追加せずに元のレコードのオフセットを返す
+	if record.ProducerId != "" {
+		off, dup, err := l.checkSequence(record)
+		if err != nil {
+			return 0, err
+		}
+		if dup {
+			return off, nil
+		}
+	}
 	// レコードはアクティブなセグメントに追加する
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, fmt.Errorf("failed to append to active segment: %w", err)
 	}
+	l.applyRecord(record)
+	// 複製を待たない場合は、追加したレコードをすぐに読み込めるようにして、追加を待っている読み込み側に知らせる
+	if !l.Config.Replication.Enabled {
+		l.highWatermark = off + 1
+		l.notifyAppended()
+	}
 	// 最大サイズになったら次のアクティブなセグメントを作る
+	// プロデューサーとトランザクションの状態もこのときに永続化して、再起動したときに読み込むレコードを減らす
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		if err = l.newSegment(off + 1); err != nil {
+			return off, err
+		}
+		if !l.state.empty() {
+			err = l.saveState()
+		}
 	}
 	return off, err
 }
 
+// 追加したレコードをストレージに同期する
+// 戻った後は、それまでに追加したレコードはOSがクラッシュしても失われない
+// 封印されたセグメントは封印するときに同期しているので、アクティブなセグメントだけを同期する
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.activeSegment.store.sync(); err != nil {
+		return fmt.Errorf("failed to sync store: %w", err)
+	}
+	if err := l.activeSegment.index.sync(); err != nil {
+		return fmt.Errorf("failed to sync index: %w", err)
+	}
+	return nil
+}
+
+// 呼び出した後に読み込めるレコードが追加されたときに閉じられるチャネルを返す
+// Config.Replication.Enabledの場合は、ハイウォーターマークが進んだときに閉じられる
+// 末尾まで読み込んだ後に追加を待つときは、読み込む前にこのチャネルを取得しておくことで
+// 読み込んでから待ち始めるまでの間に追加されたレコードを見逃さないようにする
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// 追加を待っている読み込み側に知らせる
+// ログのロックを取得してから呼び出さなければならない
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
 // 与えられたオフセットに格納されているレコードを読み取る
+// ハイウォーターマーク以降のレコードは、まだ複製されておらずリーダーが替わると失われることがあるので
+// ErrOffsetOutOfRangeを返す
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	// ハイウォーターマークは戻らないので、読み込む前に取得したもので判断してよい
+	l.mu.RLock()
+	hw := l.highWatermark
+	l.mu.RUnlock()
+	if off >= hw {
+		return nil, fmt.Errorf("offset: %d: not replicated: %w", off, ErrOffsetOutOfRange)
+	}
+	return l.read(off)
+}
+
+// ハイウォーターマークに関わらず、与えられたオフセットに格納されているレコードを読み取る
+func (l *Log) read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
+	// ローカルのセグメントより古いオフセットは、オブジェクトストアから読み込む
+	// ダウンロードしている間も追加できるように、ロックを解放してから読み込む
+	if l.tier != nil && off < l.segments[0].baseOffset {
+		rs, ok := l.tier.find(off)
+		l.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("offset: %d: %w", off, ErrOffsetOutOfRange)
+		}
+		return l.tier.read(rs, off)
+	}
 	defer l.mu.RUnlock()
 	// 与えられたオフセットのセグメントを探す
 	var s *segment
@@ -116,15 +260,123 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 
 var ErrOffsetOutOfRange = errors.New("offset out of range")
 
+// ReadRangeで読み込んだレコードのページ
+type Range struct {
+	Records []*api.Record
+	// 次のページを読み込むときに指定するオフセット
+	NextOffset uint64
+	// 読み込んだ時点のハイウォーターマーク
+	// NextOffsetとの差が、読み込めるのにまだ読み込んでいないレコードの数になる
+	HighWatermark uint64
+	// 読み込んだ時点でログに次に追加されるレコードのオフセット
+	// HighWatermarkとの差が、まだ複製されていないので読み込めないレコードの数になる
+	LogEndOffset uint64
+	// 読み飛ばしたレコードのオフセットの範囲
+	// 読み込んだレコードの間や末尾でオフセットが連続していない箇所を、オフセットの順に並べる
+	Gaps []Gap
+}
+
+// 読み飛ばしたレコードのオフセットの範囲
+// Fromから、Toを含まないToの手前までのオフセットになる
+type Gap struct {
+	From uint64
+	To   uint64
+}
+
+// ReadRangeで読み込むレコードの条件
+type ReadOptions struct {
+	// 読み込むレコードの最大数
+	// 0の場合は制限を設けない
+	MaxRecords int
+	// 読み込むレコードのバイト数の合計の上限
+	// バイト数はエンコードされたレコードの大きさで数える
+	// 0の場合は制限を設けない
+	MaxBytes  uint64
+	Isolation IsolationLevel
+	// falseを返したレコードを読み飛ばす
+	// nilの場合はすべてのレコードを読み込む
+	Filter func(*api.Record) bool
+	// Filterで読み飛ばすレコードも含めて、調べるレコードの最大数
+	// 条件に合うレコードがなかなか見つからなくても、この数を調べたところで読み込みを打ち切る
+	// 0の場合は制限を設けない
+	MaxScan int
+}
+
+// offから順に、optsの条件に合うレコードを読み込む
+// MaxBytesより大きなレコードでも読み進められるように、最初のレコードはMaxBytesを超えても返す
+// 読み飛ばしたレコードはGapsで報告し、ログの末尾やMaxScanに達したときは読み飛ばしたレコードの次のオフセットをNextOffsetにする
+// これにより、条件に合うレコードが無くても、コンシューマーは読み飛ばした先まで進捗を記録できる
+func (l *Log) ReadRange(off uint64, opts ReadOptions) (*Range, error) {
+	it, err := l.newIterator(off, opts.Isolation)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	r := &Range{NextOffset: off}
+	var bytes uint64
+	var scanned int
+	// 調べたレコードをすべて読み飛ばしたものとして、NextOffsetを進められるかどうか
+	exhausted := false
+	for opts.MaxRecords == 0 || len(r.Records) < opts.MaxRecords {
+		if opts.MaxScan != 0 && scanned >= opts.MaxScan {
+			exhausted = true
+			break
+		}
+		record, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			exhausted = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanned++
+		if opts.Filter != nil && !opts.Filter(record) {
+			continue
+		}
+		bytes += uint64(proto.Size(record))
+		if opts.MaxBytes != 0 && bytes > opts.MaxBytes && len(r.Records) > 0 {
+			break
+		}
+		if record.Offset > r.NextOffset {
+			r.Gaps = append(r.Gaps, Gap{From: r.NextOffset, To: record.Offset})
+		}
+		r.Records = append(r.Records, record)
+		r.NextOffset = it.Offset()
+	}
+	if exhausted && it.Offset() > r.NextOffset {
+		r.Gaps = append(r.Gaps, Gap{From: r.NextOffset, To: it.Offset()})
+		r.NextOffset = it.Offset()
+	}
+	l.mu.RLock()
+	r.HighWatermark = l.highWatermark
+	r.LogEndOffset = l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	return r, nil
+}
+
 // セグメントをすべて閉じる
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if !l.state.empty() {
+		if err := l.saveState(); err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+	}
+	if l.Config.Replication.Enabled {
+		if err := l.saveHighWatermark(); err != nil {
+			return fmt.Errorf("failed to save high watermark: %w", err)
+		}
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return fmt.Errorf("failed to close segment: %w", err)
 		}
 	}
+	if l.tier != nil {
+		return l.tier.close()
+	}
 	return nil
 }
 
@@ -150,6 +402,10 @@ func (l *Log) Reset() error {
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	// オブジェクトストアにだけ存在するセグメントも読み込めるので含める
+	if l.tier != nil && len(l.tier.remote) > 0 {
+		return l.tier.remote[0].BaseOffset, nil
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -165,9 +421,20 @@ func (l *Log) HighestOffset() (uint64, error) {
 
 // 一番大きなオフセットがlowestよりも小さいセグメントをすべて削除する
 // ディスクの容量は無限ではないので、定期的にTruncateして古いセグメントを削除する
+// オブジェクトストアにだけ存在するセグメントも削除する
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.truncate(lowest)
+}
+
+// ログのロックを取得した状態でセグメントを削除する
+func (l *Log) truncate(lowest uint64) error {
+	if l.tier != nil {
+		if err := l.tier.truncate(lowest); err != nil {
+			return fmt.Errorf("failed to truncate remote segments: %w", err)
+		}
+	}
 	var segments []*segment
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
@@ -179,39 +446,29 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
-	return nil
-}
-
-// ログ全体を読み込むためのio.Readerを返す
-// スナップショットやログの復元をサポートする必要があるときに必要になる
-func (l *Log) Reader() io.Reader {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
-	}
-	// セグメントのストアをoriginReaderでラップしてMultiReaderとする
-	// ストアファイルの全体を読み込むことを保証する
-	return io.MultiReader(readers...)
-}
-
-type originReader struct {
-	*store
-	off int64
-}
-
-// io.Readerインターフェースを満たす
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	if errors.Is(err, io.EOF) {
-		return n, io.EOF
+	// 残ったレコードより前にアボートされたトランザクションは読み込むときに調べる必要がなく、
+	// 残ったレコードより前の遅延レコードは配信できない
+	// 残ったレコードを追加していないプロデューサーの状態も、重複を検出するために覚えておく必要はない
+	if len(segments) > 0 {
+		low := segments[0].baseOffset
+		if l.tier != nil && len(l.tier.remote) > 0 {
+			low = l.tier.remote[0].BaseOffset
+		}
+		l.pruneAborted(low)
+		l.pruneDelayed(low)
+		l.pruneProducers(low)
 	}
-	return n, err
+	return nil
 }
 
 func (l *Log) newSegment(off uint64) error {
+	// アクティブではなくなるセグメントは以降読み込みしか行われないので封印する
+	// ストアとインデックスは読み取り専用でマップされ、書き込みのためのリソースは解放される
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return fmt.Errorf("failed to seal segment: %w", err)
+		}
+	}
 	// 新しいセグメントを作る
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
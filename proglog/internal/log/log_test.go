@@ -1,9 +1,14 @@
 package log_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 
 	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
@@ -19,6 +24,13 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"read from inactive segments":       testReadInactive,
+		"seal segments on roll":             testSealOnRoll,
+		"read range":                        testReadRange,
+		"read range with filter":            testReadRangeFilter,
+		"notify appended records":           testAppended,
+		"preserve record headers":           testHeaders,
+		"sync appended records":             testSync,
 	}
 
 	for scenario, fn := range testcases {
@@ -92,7 +104,7 @@ func testInitExisting(t *testing.T, o *log.Log) {
 	require.Equal(t, uint64(2), off)
 }
 
-// ログをスナップショットして復元できるように、ディスクに保存されている完全な生のログを読み取ることができるかテストする
+// ログをスナップショットして復元できるように、ディスクに保存されている完全なログを読み取ることができるかテストする
 func testReader(t *testing.T, l *log.Log) {
 	record := &api.Record{
 		Value: []byte("hello world"),
@@ -105,8 +117,15 @@ func testReader(t *testing.T, l *log.Log) {
 	b, err := io.ReadAll(reader)
 	require.NoError(t, err)
 
-	read := &api.Record{}
-	err = proto.Unmarshal(b[log.ExportLenWidth:], read)
+	// 読み込んだスナップショットから別のディレクトリにログを復元する
+	dir, err := ioutil.TempDir("", "reader-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	n, err := log.NewLog(dir, l.Config)
+	require.NoError(t, err)
+	require.NoError(t, n.Restore(bytes.NewReader(b)))
+
+	read, err := n.Read(off)
 	require.NoError(t, err)
 	require.Equal(t, record.Value, read.Value)
 }
@@ -127,3 +146,216 @@ func testTruncate(t *testing.T, l *log.Log) {
 	_, err = l.Read(0)
 	require.Error(t, err)
 }
+
+// アクティブではなくなったセグメントのレコードを、メモリにマップされたストアから読めるかテストする
+func testReadInactive(t *testing.T, l *log.Log) {
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("hello world %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		read, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+		require.Equal(t, uint64(i), read.Offset)
+	}
+}
+
+// アクティブなセグメントが最大サイズに達して次のセグメントに移るときに、以前のセグメントが封印されるかテストする
+func testSealOnRoll(t *testing.T, o *log.Log) {
+	record := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(record)
+		require.NoError(t, err)
+	}
+	// 最初のセグメントは2つのレコードで最大サイズに達して封印される
+	_, err := os.Stat(filepath.Join(o.Dir, "0.sealed"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(o.Dir, "2.sealed"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, o.Close())
+
+	// 封印されたセグメントを含むディレクトリから再起動しても追加を続けられる
+	n, err := log.NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	off, err := n.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i <= off; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+}
+
+// レコードの数とバイト数の上限に従って、まとめてレコードを読み込めるかテストする
+func testReadRange(t *testing.T, l *log.Log) {
+	appendRecords(t, l, 5)
+
+	r, err := l.ReadRange(1, log.ReadOptions{MaxRecords: 2})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+	require.Equal(t, uint64(1), r.Records[0].Offset)
+	require.Equal(t, uint64(3), r.NextOffset)
+	require.Equal(t, uint64(5), r.HighWatermark)
+	require.Equal(t, uint64(5), r.LogEndOffset)
+
+	// 上限が無ければ末尾まで読み込む
+	r, err = l.ReadRange(r.NextOffset, log.ReadOptions{})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+	require.Equal(t, uint64(5), r.NextOffset)
+
+	// 末尾からは空のページを返す
+	r, err = l.ReadRange(r.NextOffset, log.ReadOptions{})
+	require.NoError(t, err)
+	require.Empty(t, r.Records)
+	require.Equal(t, uint64(5), r.NextOffset)
+
+	// バイト数の上限を超えても、最初のレコードは返す
+	r, err = l.ReadRange(0, log.ReadOptions{MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 1)
+	require.Equal(t, uint64(1), r.NextOffset)
+	size := uint64(proto.Size(r.Records[0]))
+	r, err = l.ReadRange(1, log.ReadOptions{MaxBytes: 3 * size})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+
+	_, err = l.ReadRange(6, log.ReadOptions{})
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+}
+
+// 条件に合わないレコードを読み飛ばし、その範囲をGapsで返すかテストする
+func testReadRangeFilter(t *testing.T, l *log.Log) {
+	for i := 0; i < 6; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("%d", i))})
+		require.NoError(t, err)
+	}
+	// 1と4だけを読み込む
+	filter := func(record *api.Record) bool {
+		return record.Offset%3 == 1
+	}
+
+	r, err := l.ReadRange(0, log.ReadOptions{Filter: filter})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+	require.Equal(t, uint64(4), r.Records[1].Offset)
+	require.Equal(t, []log.Gap{{From: 0, To: 1}, {From: 2, To: 4}, {From: 5, To: 6}}, r.Gaps)
+	require.Equal(t, uint64(6), r.NextOffset)
+
+	// 上限に達して打ち切った場合は、次のレコードまでを読み飛ばしたとは報告しない
+	r, err = l.ReadRange(0, log.ReadOptions{Filter: filter, MaxRecords: 1})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 1)
+	require.Equal(t, []log.Gap{{From: 0, To: 1}}, r.Gaps)
+	require.Equal(t, uint64(2), r.NextOffset)
+
+	// 調べるレコードの数の上限に達したら、そこまでを読み飛ばしたものとして返す
+	r, err = l.ReadRange(2, log.ReadOptions{Filter: filter, MaxScan: 2})
+	require.NoError(t, err)
+	require.Empty(t, r.Records)
+	require.Equal(t, []log.Gap{{From: 2, To: 4}}, r.Gaps)
+	require.Equal(t, uint64(4), r.NextOffset)
+}
+
+// レコードが追加されたときにチャネルが閉じられるかテストする
+func testAppended(t *testing.T, l *log.Log) {
+	ch := l.Appended()
+	select {
+	case <-ch:
+		t.Fatal("channel closed before append")
+	default:
+	}
+	appendRecords(t, l, 1)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("channel not closed after append")
+	}
+	// 追加の後に取得したチャネルは、次の追加まで閉じられない
+	select {
+	case <-l.Appended():
+		t.Fatal("new channel closed before append")
+	default:
+	}
+}
+
+// ヘッダーがセグメントへの追加と読み込みを通して保たれるかテストする
+func testHeaders(t *testing.T, l *log.Log) {
+	record := &api.Record{Value: []byte("hello")}
+	record.AddHeader("trace-id", []byte("abc"))
+	record.AddHeader("trace-id", []byte("def"))
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Len(t, read.Headers, 2)
+	v, ok := read.Header("trace-id")
+	require.True(t, ok)
+	require.Equal(t, []byte("def"), v)
+
+	// 封印されたセグメントからイテレータで読み込んでも保たれる
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	for i := 0; i < 3; i++ {
+		read, err = it.Next()
+		require.NoError(t, err)
+		require.True(t, proto.Equal(record.Headers[0], read.Headers[0]))
+		require.True(t, proto.Equal(record.Headers[1], read.Headers[1]))
+	}
+}
+
+// アクティブなセグメントの相対オフセットがuint32の境界に達したときに、次のセグメントに移って追加を続けられるかテストする
+func TestLogRollBeforeRelativeOffsetOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-overflow-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	writeFakeSegment(t, dir, 0, math.MaxUint32-1, c)
+
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+	off, err := l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint32), off)
+
+	// uint32の境界を越えるオフセットは新しいセグメントに追加される
+	off, err = l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint32)+1, off)
+
+	read, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, off, read.Offset)
+	require.Equal(t, record.Value, read.Value)
+	_, err = os.Stat(filepath.Join(dir, "0.sealed"))
+	require.NoError(t, err)
+}
+
+// 同期すると、バッファされていたレコードがストアのファイルに書き込まれるかテストする
+func testSync(t *testing.T, l *log.Log) {
+	_, err := l.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	fi, err := os.Stat(filepath.Join(l.Dir, "0.store"))
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+
+	require.NoError(t, l.Sync())
+	fi, err = os.Stat(filepath.Join(l.Dir, "0.store"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Size())
+}
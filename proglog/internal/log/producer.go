@@ -0,0 +1,83 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// プロデューサーごとに覚えておく、最近追加したレコードの数
+// リトライされたリクエストがこの数より古いと、元のオフセットを返せない
+const producerWindow = 5
+
+var (
+	// プロデューサーのシーケンス番号が、最後に追加したレコードの次の番号より大きいときに返すエラー
+	// 間のレコードの追加に失敗しているので、プロデューサーはそこから送り直さなければならない
+	ErrOutOfOrderSequence = errors.New("out of order sequence")
+	// プロデューサーのシーケンス番号が、元のオフセットを覚えていないほど古いときに返すエラー
+	ErrDuplicateSequence = errors.New("duplicate sequence")
+)
+
+// プロデューサーが追加したレコードのシーケンス番号とオフセット
+type producerEntry struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   uint64 `json:"offset"`
+}
+
+// プロデューサーが最近追加したレコード
+type producerState struct {
+	Entries []producerEntry `json:"entries"`
+}
+
+// レコードがプロデューサーの追加したレコードの重複かどうかを調べる
+// 重複している場合は、元のレコードのオフセットとtrueを返す
+func (l *Log) checkSequence(record *api.Record) (uint64, bool, error) {
+	st, ok := l.state.Producers[record.ProducerId]
+	if !ok || len(st.Entries) == 0 {
+		// 初めてのプロデューサーはどのシーケンス番号からでも始められる
+		return 0, false, nil
+	}
+	last := st.Entries[len(st.Entries)-1]
+	if record.Sequence == last.Sequence+1 {
+		return 0, false, nil
+	}
+	if record.Sequence > last.Sequence+1 {
+		return 0, false, fmt.Errorf("producer %s: sequence %d after %d: %w",
+			record.ProducerId, record.Sequence, last.Sequence, ErrOutOfOrderSequence)
+	}
+	for _, e := range st.Entries {
+		if e.Sequence == record.Sequence {
+			return e.Offset, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("producer %s: sequence %d: %w", record.ProducerId, record.Sequence, ErrDuplicateSequence)
+}
+
+// プロデューサーがレコードを追加したことを記録する
+func (l *Log) recordSequence(record *api.Record) {
+	if record.ProducerId == "" {
+		return
+	}
+	st, ok := l.state.Producers[record.ProducerId]
+	if !ok {
+		st = &producerState{}
+		l.state.Producers[record.ProducerId] = st
+	}
+	st.Entries = append(st.Entries, producerEntry{Sequence: record.Sequence, Offset: record.Offset})
+	if len(st.Entries) > producerWindow {
+		st.Entries = st.Entries[len(st.Entries)-producerWindow:]
+	}
+}
+
+// 最後に追加したレコードがlowestより前のプロデューサーを取り除く
+// 残ったレコードを追加していないプロデューサーの状態は、レコードから作り直すこともできないので
+// 覚えておくと、使われなくなったプロデューサーの状態が増え続けてしまう
+// 取り除いたプロデューサーは、次に追加するときに初めてのプロデューサーとして扱われる
+func (l *Log) pruneProducers(lowest uint64) {
+	for id, st := range l.state.Producers {
+		if len(st.Entries) == 0 || st.Entries[len(st.Entries)-1].Offset < lowest {
+			delete(l.state.Producers, id)
+		}
+	}
+}
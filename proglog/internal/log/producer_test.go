@@ -0,0 +1,151 @@
+package log_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentProducer(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log){
+		"duplicate returns original offset": testProducerDuplicate,
+		"out of order sequence":             testProducerOutOfOrder,
+		"rebuild state from records":        testProducerRebuild,
+		"resume from persisted state":       testProducerPersisted,
+		"prune truncated producers":         testProducerPrune,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "producer-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, l)
+		})
+	}
+}
+
+// 同じシーケンス番号のレコードを追加しようとすると、追加せずに元のオフセットを返すかテストする
+func testProducerDuplicate(t *testing.T, l *log.Log) {
+	defer l.Close()
+	for seq := uint64(0); seq < 3; seq++ {
+		off := produce(t, l, "a", seq)
+		require.Equal(t, seq, off)
+	}
+	// 別のプロデューサーのシーケンス番号とは区別する
+	require.Equal(t, uint64(3), produce(t, l, "b", 0))
+
+	require.Equal(t, uint64(1), produce(t, l, "a", 1))
+	require.Equal(t, uint64(2), produce(t, l, "a", 2))
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// プロデューサーIDの無いレコードは重複を検出しない
+	for i := 0; i < 2; i++ {
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(4+i), off)
+	}
+}
+
+// シーケンス番号が飛んでいたり、覚えていないほど古かったりするとエラーを返すかテストする
+func testProducerOutOfOrder(t *testing.T, l *log.Log) {
+	defer l.Close()
+	for seq := uint64(10); seq < 20; seq++ {
+		produce(t, l, "a", seq)
+	}
+	_, err := l.Append(&api.Record{Value: []byte("hello world"), ProducerId: "a", Sequence: 21})
+	require.True(t, errors.Is(err, log.ErrOutOfOrderSequence), err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), ProducerId: "a", Sequence: 10})
+	require.True(t, errors.Is(err, log.ErrDuplicateSequence), err)
+	require.Equal(t, uint64(10), produce(t, l, "a", 20))
+}
+
+// 永続化した状態が無くても、再起動後にレコードから状態を作り直すかテストする
+func testProducerRebuild(t *testing.T, l *log.Log) {
+	for seq := uint64(0); seq < 5; seq++ {
+		produce(t, l, "a", seq)
+	}
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(filepath.Join(l.Dir, "state.json")))
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(4), produce(t, n, "a", 4))
+	require.Equal(t, uint64(5), produce(t, n, "a", 5))
+}
+
+// 永続化した状態を読み込み、その後に追加されたレコードだけを反映するかテストする
+func testProducerPersisted(t *testing.T, l *log.Log) {
+	for seq := uint64(0); seq < 5; seq++ {
+		produce(t, l, "a", seq)
+	}
+	require.NoError(t, l.Close())
+	// オフセット3より前のレコードを反映していない状態にして、そこからレコードを読み込ませる
+	state := []byte(`{"next_offset":3,"producers":{}}`)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(l.Dir, "state.json"), state, 0o644))
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(3), produce(t, n, "a", 3))
+	_, err = n.Append(&api.Record{Value: []byte("hello world"), ProducerId: "a", Sequence: 1})
+	require.True(t, errors.Is(err, log.ErrDuplicateSequence), err)
+}
+
+// 残ったレコードを追加していないプロデューサーの状態を、切り詰めたときに取り除くかテストする
+func testProducerPrune(t *testing.T, l *log.Log) {
+	produce(t, l, "a", 0)
+	produce(t, l, "a", 1)
+	for seq := uint64(0); seq < 6; seq++ {
+		produce(t, l, "b", seq)
+	}
+	require.NoError(t, l.Truncate(2))
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(1))
+	require.NoError(t, l.Close())
+
+	// 取り除いた状態は永続化され、再起動しても戻らない
+	p, err := ioutil.ReadFile(filepath.Join(l.Dir, "state.json"))
+	require.NoError(t, err)
+	var state struct {
+		Producers map[string]json.RawMessage `json:"producers"`
+	}
+	require.NoError(t, json.Unmarshal(p, &state))
+	require.NotContains(t, state.Producers, "a")
+	require.Contains(t, state.Producers, "b")
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	// 取り除いたプロデューサーは、初めてのプロデューサーとしてどのシーケンス番号からでも始められる
+	require.Equal(t, uint64(8), produce(t, n, "a", 10))
+	// 残ったプロデューサーは、引き続き重複を検出する
+	require.Equal(t, uint64(7), produce(t, n, "b", 5))
+}
+
+func produce(t *testing.T, l *log.Log, producerID string, seq uint64) uint64 {
+	t.Helper()
+	off, err := l.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: producerID,
+		Sequence:   seq,
+	})
+	require.NoError(t, err)
+	return off
+}
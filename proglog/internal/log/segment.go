@@ -1,9 +1,14 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	stdlog "log"
+	"math"
 	"os"
 	"path"
+	"sync"
 
 	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
 	"google.golang.org/protobuf/proto"
@@ -15,22 +20,72 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	// 最後にインデックスエントリを書き込んだレコード以降にストアに追加したバイト数
+	// 疎なインデックスでは、この値が間隔に達したときだけエントリを書き込む
+	bytesSinceIndex uint64
+	// nextOffsetの直前のレコードまでが占めるストアのバイト数
+	// スナップショットはこの位置までを読み込むので、追加が完了していないレコードを含まない
+	end uint64
+
+	// スナップショットなどからの参照の数
+	// 参照されている間に削除されたセグメントは、参照が無くなってから閉じる
+	refMu        sync.Mutex
+	refs         int
+	closePending bool
+	// 封印されたセグメントは読み込み専用になる
+	sealed bool
+	// 封印されたセグメントのすべてのレコードの有効期限が切れる時刻と、すべてのレコードに有効期限があるかどうか
+	// 必要になったときにストアを読み込んで求める
+	// ログの読み込みロックだけを取得して求めるので、expiryMuで保護する
+	expiryMu      sync.Mutex
+	expiresAt     int64
+	expires       bool
+	expiryScanned bool
 }
 
 const (
-	storeFilePerm = 0o644
-	indexFilePerm = 0o644
+	storeFilePerm  = 0o644
+	indexFilePerm  = 0o644
+	sealedFilePerm = 0o644
+)
+
+// セグメントを構成するファイルの拡張子
+const (
+	storeFileExt = ".store"
+	indexFileExt = ".index"
+	// セグメントが封印されていることを示すマーカーファイル
+	sealedFileExt = ".sealed"
 )
 
+// インデックスエントリには相対オフセットをuint32で格納するので
+// セグメントに含めることのできるレコードの相対オフセットはこの値までになる
+const maxRelativeOffset = math.MaxUint32
+
+// 相対オフセットがインデックスエントリで表現できなくなるときに返すエラー
+var errRelativeOffsetOverflow = errors.New("relative offset overflows index entry")
+
+// セグメントを構成するファイルのパスを返す
+func segmentFilePath(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
 // アクティブなセグメントが最大サイズに達したときなど、新しいセグメントを追加する必要があるときに呼び出す
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
 	}
+	// マーカーファイルがあれば、以前のインスタンスによって封印されたセグメント
+	_, err := os.Stat(segmentFilePath(dir, baseOffset, sealedFileExt))
+	if err == nil {
+		return openSealedSegment(dir, s)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to get sealed marker info: %w", err)
+	}
 	// ストアファイルが無かったら作る
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		segmentFilePath(dir, baseOffset, storeFileExt),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		storeFilePerm,
 	)
@@ -43,7 +98,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	}
 	// インデックスファイルが無かったら作る
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		segmentFilePath(dir, baseOffset, indexFileExt),
 		os.O_RDWR|os.O_CREATE,
 		indexFilePerm,
 	)
@@ -54,16 +109,106 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create index file: %w", err)
 	}
+	if err = s.setNextOffset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 封印されたセグメントを読み込み専用で開く
+func openSealedSegment(dir string, s *segment) (*segment, error) {
+	storeFile, err := os.Open(segmentFilePath(dir, s.baseOffset, storeFileExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store file: %w", err)
+	}
+	s.store, err = newStore(storeFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new store: %w", err)
+	}
+	if err = s.store.seal(); err != nil {
+		return nil, fmt.Errorf("failed to seal store: %w", err)
+	}
+	indexFile, err := os.Open(segmentFilePath(dir, s.baseOffset, indexFileExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file: %w", err)
+	}
+	s.index, err = newSealedIndex(indexFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index file: %w", err)
+	}
+	s.sealed = true
+	if err = s.setNextOffset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// インデックスの末尾のエントリから次に書き込むレコードのオフセットを求める
+func (s *segment) setNextOffset() error {
 	// インデックスに一つでもエントリがあれば、次に書き込むレコードのオフセットは
 	// セグメントの末尾のオフセットになる
-	off, _, err := s.index.Read(-1)
+	off, pos, err := s.index.Read(-1)
 	if err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		// セグメントの末尾のオフセットはベースオフセット+相対オフセット+1したもの
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = s.baseOffset
+		// インデックスの無いストアのデータは、どのレコードからも参照されない書きかけのレコードなので取り除く
+		if s.store.size > 0 {
+			stdlog.Printf("truncating partial record at 0 in %s (%d bytes)", s.store.Name(), s.store.size)
+			return s.store.truncate(0)
+		}
+		return nil
 	}
-	return s, nil
+	// 疎なインデックスでは末尾のエントリの後ろにもレコードがあるので、ストアの末尾まで数える
+	n, end, err := s.skip(pos, math.MaxUint64)
+	if n == 0 && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		// インデックスはメモリマップで書き込まれるので、バッファされたストアより先に永続化されることがある
+		// 末尾のエントリのレコードがストアに無ければ、そのエントリを取り除いてやり直す
+		s.index.removeLast()
+		return s.setNextOffset()
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// 追加の途中でクラッシュすると、ストアの末尾に途中までしか書き込まれていないレコードが残る
+		// そのレコードは追加されなかったものとして、完全に書き込まれたレコードの後ろで切り詰める
+		stdlog.Printf("truncating partial record at %d in %s (%d bytes)", end, s.store.Name(), s.store.size-end)
+		if err = s.store.truncate(end); err != nil {
+			return err
+		}
+		err = nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to scan store: %w", err)
+	}
+	if end != s.store.size {
+		return fmt.Errorf("record at %d in %s: %w", end, s.store.Name(), io.ErrUnexpectedEOF)
+	}
+	// セグメントの末尾のオフセットはベースオフセット+相対オフセット+末尾のエントリ以降のレコード数
+	s.nextOffset = s.baseOffset + uint64(off) + n
+	s.bytesSinceIndex = s.store.size - pos
+	s.end = s.store.size
+	return nil
+}
+
+// ストアのposの位置からn個のレコードを読み飛ばし、読み飛ばしたレコードの数と次のレコードの位置を返す
+// ストアの末尾に達したときはio.EOFを、末尾のレコードが途中までしか無いときはそのレコードの位置とio.ErrUnexpectedEOFを返す
+func (s *segment) skip(pos, n uint64) (skipped, next uint64, err error) {
+	size := make([]byte, lenWidth)
+	for skipped < n {
+		if pos >= s.store.size {
+			return skipped, pos, io.EOF
+		}
+		if pos+lenWidth > s.store.size {
+			return skipped, pos, io.ErrUnexpectedEOF
+		}
+		if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+			return skipped, pos, fmt.Errorf("failed to read record length: %w", err)
+		}
+		next := pos + lenWidth + enc.Uint64(size)
+		if next > s.store.size {
+			return skipped, pos, io.ErrUnexpectedEOF
+		}
+		pos = next
+		skipped++
+	}
+	return skipped, pos, nil
 }
 
 // セグメントにレコードを書き込み、新しく追加されたレコードのオフセットを返す
@@ -74,33 +219,55 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal record: %w", err)
 	}
+	if err = s.append(p); err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+// エンコードされたレコードをストアに追加してインデックスエントリを書き込む
+// pはオフセットとしてs.nextOffsetを持つレコードでなければならない
+func (s *segment) append(p []byte) error {
+	// 相対オフセットが桁あふれすると、別のレコードのオフセットとして記録されてしまう
+	if s.nextOffset-s.baseOffset > maxRelativeOffset {
+		return fmt.Errorf("offset %d in segment %d: %w", s.nextOffset, s.baseOffset, errRelativeOffsetOverflow)
+	}
 	// データをストアに追加する
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, fmt.Errorf("failed to append to store: %w", err)
+		return fmt.Errorf("failed to append to store: %w", err)
 	}
 	// インデックスエントリを追加する
-	err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos)
-	if err != nil {
-		return 0, fmt.Errorf("failed to write index: %w", err)
+	// 疎なインデックスでは、前のエントリから間隔分のバイトを追加したレコードにだけエントリを書き込む
+	interval := s.config.Segment.IndexIntervalBytes
+	if interval == 0 || s.nextOffset == s.baseOffset || s.bytesSinceIndex >= interval {
+		err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos)
+		if err != nil {
+			return fmt.Errorf("failed to write index: %w", err)
+		}
+		s.bytesSinceIndex = 0
 	}
+	s.bytesSinceIndex += n
+	s.end = pos + n
 	// 次の呼び出しのためにインクリメントする
 	s.nextOffset += 1
-	return cur, nil
+	return nil
 }
 
 // 与えられたオフセットのレコードを返す
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	// 絶対インデックスを相対オフセットに変換し、関連するインデックスエントリを取得する
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	pos, err := s.position(off - s.baseOffset)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read index: %w", err)
+		return nil, err
 	}
 	// ストア内のそのレコードの位置に移動して必要なデータを読み込む
 	p, err := s.store.Read(pos)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read store: %w", err)
 	}
+	// pはマップされたストアの領域を指していることがあるが
+	// Unmarshalはbytesフィールドをコピーするので、レコードがその領域を参照し続けることはない
 	record := &api.Record{}
 	if err = proto.Unmarshal(p, record); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal record: %w", err)
@@ -108,25 +275,160 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, nil
 }
 
+// セグメントのレコードを先頭から順に読み込んでfnに渡す
+// インデックスを使わずにストアを読み進めるので、疎なインデックスでも読み込むレコードの数に比例した時間で済む
+func (s *segment) scan(fn func(record *api.Record) error) error {
+	for pos := uint64(0); pos < s.end; {
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return fmt.Errorf("failed to read store: %w", err)
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return fmt.Errorf("failed to unmarshal record: %w", err)
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+		pos += lenWidth + uint64(len(p))
+	}
+	return nil
+}
+
+// 相対オフセットのレコードのストア内での位置を返す
+func (s *segment) position(rel uint64) (uint64, error) {
+	if rel > maxRelativeOffset {
+		return 0, fmt.Errorf("relative offset %d: %w", rel, io.EOF)
+	}
+	// 密なインデックスではエントリの位置が相対オフセットと一致するので、そのまま読む
+	out, pos, err := s.index.Read(int64(rel))
+	if err == nil && uint64(out) == rel {
+		return pos, nil
+	}
+	// 疎なインデックスでは相対オフセット以下で最も近いエントリを探し、そこからストアを読み進める
+	out, pos, err = s.index.Search(uint32(rel))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read index: %w", err)
+	}
+	_, pos, err = s.skip(pos, rel-uint64(out))
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan store: %w", err)
+	}
+	return pos, nil
+}
+
 // セグメントが最大サイズに達したかどうかを返す
+// 封印されたセグメントにはもう書き込めないので、常に最大サイズに達しているとみなす
 func (s *segment) IsMaxed() bool {
+	if s.sealed {
+		return true
+	}
+	// 次のレコードの相対オフセットがuint32で表現できなくなる前に次のセグメントに移る
+	if s.nextOffset-s.baseOffset > maxRelativeOffset {
+		return true
+	}
 	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
 }
 
 // セグメントを閉じ、インデックスファイルとストアファイルを削除する
+// 参照されているセグメントはファイルの削除だけを行い、参照が無くなったときに閉じる
+// 削除したファイルも、開いているファイルディスクリプタやマップされた領域からは読み込むことができる
 func (s *segment) Remove() error {
+	if err := s.closeWhenReleased(); err != nil {
+		return err
+	}
+	return s.removeFiles()
+}
+
+// 参照されていないセグメントはすぐに閉じ、参照されているセグメントは参照が無くなったときに閉じる
+// ファイルは削除しない
+func (s *segment) closeWhenReleased() error {
+	s.refMu.Lock()
+	if s.refs > 0 {
+		s.closePending = true
+		s.refMu.Unlock()
+		return nil
+	}
+	s.refMu.Unlock()
 	if err := s.Close(); err != nil {
 		return fmt.Errorf("failed to close segment: %w", err)
 	}
+	return nil
+}
+
+// インデックスファイルとストアファイルを削除する
+func (s *segment) removeFiles() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return fmt.Errorf("failed to remove index: %w", err)
 	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return fmt.Errorf("failed to remove store: %w", err)
 	}
+	if s.sealed {
+		if err := os.Remove(s.sealedFilePath()); err != nil {
+			return fmt.Errorf("failed to remove sealed marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// セグメントへの参照を追加する
+// 参照している間はセグメントが削除されてもファイルは閉じられない
+func (s *segment) acquire() {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	s.refs++
+}
+
+// セグメントへの参照を解放する
+// 参照している間に削除されていた場合は、最後の参照が解放されたときに閉じる
+func (s *segment) release() error {
+	s.refMu.Lock()
+	s.refs--
+	if s.refs > 0 || !s.closePending {
+		s.refMu.Unlock()
+		return nil
+	}
+	s.closePending = false
+	s.refMu.Unlock()
+	return s.Close()
+}
+
+// セグメントを封印する
+// ストアとインデックスを永続化して読み込み専用にし、書き込みのために確保していたリソースを解放する
+// 最後にマーカーファイルを作って、再起動後も封印されたセグメントとして開けるようにする
+func (s *segment) seal() error {
+	if s.sealed {
+		return nil
+	}
+	if err := s.store.seal(); err != nil {
+		return fmt.Errorf("failed to seal store: %w", err)
+	}
+	if err := s.index.seal(); err != nil {
+		return fmt.Errorf("failed to seal index: %w", err)
+	}
+	// ストアとインデックスがストレージに同期された後にマーカーファイルを作る
+	// こうすることで、マーカーファイルがあるセグメントは完全に永続化されていることが保証される
+	f, err := os.OpenFile(s.sealedFilePath(), os.O_WRONLY|os.O_CREATE, sealedFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create sealed marker: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync sealed marker: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close sealed marker: %w", err)
+	}
+	s.sealed = true
 	return nil
 }
 
+// マーカーファイルのパスを返す
+func (s *segment) sealedFilePath() string {
+	return segmentFilePath(path.Dir(s.store.Name()), s.baseOffset, sealedFileExt)
+}
+
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return fmt.Errorf("failed to close index: %w", err)
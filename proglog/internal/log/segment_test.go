@@ -2,14 +2,18 @@ package log_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 
 	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
 	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -64,3 +68,273 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentSeal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-seal-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := log.ExportNewSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.ExportSeal())
+
+	// 封印されたセグメントは最大サイズに達しているとみなされ、追加できない
+	require.True(t, s.IsMaxed())
+	_, err = s.Append(want)
+	require.Error(t, err)
+
+	// インデックスファイルは実際のサイズに切り詰められている
+	fi, err := os.Stat(filepath.Join(dir, "16.index"))
+	require.NoError(t, err)
+	require.Equal(t, int64(log.ExportEntWidth*3), fi.Size())
+	_, err = os.Stat(filepath.Join(dir, "16.sealed"))
+	require.NoError(t, err)
+
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(16 + i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	require.NoError(t, s.Close())
+
+	// マーカーファイルから封印されたセグメントとして開き直せることを確認する
+	s, err = log.ExportNewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.True(t, s.IsMaxed())
+	require.Equal(t, uint64(19), s.ExportNextOffset())
+	got, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	_, err = s.Append(want)
+	require.Error(t, err)
+
+	// 削除するとマーカーファイルも削除される
+	require.NoError(t, s.Remove())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// 相対オフセットがuint32の境界を越える前にセグメントが最大サイズに達するかテストする
+// 2^32個のレコードを実際に書き込むことはできないので、末尾のエントリが境界の直前を指す偽のインデックスを使う
+func TestSegmentRelativeOffsetOverflow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-overflow-test")
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	writeFakeSegment(t, dir, 16, math.MaxUint32-1, c)
+
+	s, err := log.ExportNewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16+math.MaxUint32), s.ExportNextOffset())
+	require.False(t, s.IsMaxed())
+
+	// 相対オフセットがuint32の最大値になるレコードは追加できる
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(16+math.MaxUint32), off)
+
+	// それ以上は桁あふれするので、最大サイズに達したとみなして追加を拒否する
+	require.True(t, s.IsMaxed())
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.True(t, errors.Is(err, log.ExportErrRelativeOffsetOverflow))
+}
+
+// 末尾のエントリの相対オフセットがlastRelOffである偽のセグメントのファイルを書き込む
+func writeFakeSegment(t *testing.T, dir string, baseOffset uint64, lastRelOff uint32, c log.Config) {
+	t.Helper()
+	name := filepath.Join(dir, fmt.Sprintf("%d", baseOffset))
+
+	f, err := os.OpenFile(name+".store", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	st, err := log.ExportNewStore(f)
+	require.NoError(t, err)
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: baseOffset + uint64(lastRelOff)})
+	require.NoError(t, err)
+	_, pos, err := st.Append(p)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	f, err = os.OpenFile(name+".index", os.O_RDWR|os.O_CREATE, 0o644)
+	require.NoError(t, err)
+	idx, err := log.ExportNewIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(lastRelOff, pos))
+	require.NoError(t, idx.Close())
+}
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-sparse-test")
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 64
+
+	s, err := log.ExportNewSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 20; i++ {
+		off, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %02d", i))})
+		require.NoError(t, err)
+		require.Equal(t, 16+i, off)
+	}
+	// すべてのレコードにエントリを書き込む場合よりもインデックスが小さくなる
+	require.Less(t, s.ExportIndexSize(), uint64(20*log.ExportEntWidth))
+
+	// エントリの無いレコードも、最も近いエントリからストアを読み進めて読める
+	testSegmentReadAll(t, s, 16, 20)
+	require.NoError(t, s.Close())
+
+	// 末尾のエントリ以降のレコードも数えて、次のオフセットを復元できることを確認する
+	s, err = log.ExportNewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(36), s.ExportNextOffset())
+	off, err := s.Append(&api.Record{Value: []byte("hello world 20")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(36), off)
+	testSegmentReadAll(t, s, 16, 21)
+
+	// 封印した後も同じように読める
+	require.NoError(t, s.ExportSeal())
+	testSegmentReadAll(t, s, 16, 21)
+	_, err = s.Read(37)
+	require.Error(t, err)
+}
+
+// 途中までしか書き込まれていないレコードがストアの末尾に残っていても、切り詰めて追加を続けられるかテストする
+func TestSegmentPartialRecord(t *testing.T) {
+	testcases := map[string]struct {
+		interval uint64
+		// ストアを壊し、壊した後に残る完全なレコードの数を返す
+		corrupt func(t *testing.T, name string) uint64
+	}{
+		"partial body with dense index":   {interval: 0, corrupt: truncateStore},
+		"partial body with sparse index":  {interval: 64, corrupt: truncateStore},
+		"partial length with dense index": {interval: 0, corrupt: appendPartialLength},
+		"empty index":                     {interval: 0, corrupt: truncateAll},
+	}
+
+	for scenario, tc := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "segment-partial-test")
+			defer os.RemoveAll(dir)
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 4096
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.IndexIntervalBytes = tc.interval
+
+			s, err := log.ExportNewSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := uint64(0); i < 5; i++ {
+				_, err = s.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %02d", i))})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+			n := tc.corrupt(t, filepath.Join(dir, "16.store"))
+
+			s, err = log.ExportNewSegment(dir, 16, c)
+			require.NoError(t, err)
+			require.Equal(t, 16+n, s.ExportNextOffset())
+			testSegmentReadAll(t, s, 16, n)
+
+			off, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %02d", n))})
+			require.NoError(t, err)
+			require.Equal(t, 16+n, off)
+			testSegmentReadAll(t, s, 16, n+1)
+			require.NoError(t, s.Close())
+
+			// 切り詰めた後のストアは、再び開いても同じ状態になる
+			s, err = log.ExportNewSegment(dir, 16, c)
+			require.NoError(t, err)
+			require.Equal(t, 16+n+1, s.ExportNextOffset())
+			testSegmentReadAll(t, s, 16, n+1)
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+// 末尾のレコードの途中でストアを切り、インデックスのエントリだけが残った状態にする
+func truncateStore(t *testing.T, name string) uint64 {
+	t.Helper()
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, fi.Size()-3))
+	return 4
+}
+
+// 完全なレコードの後ろに、長さの途中までしか書き込まれていないレコードを残す
+func appendPartialLength(t *testing.T, name string) uint64 {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return 5
+}
+
+// 先頭のレコードの途中でストアを切り、すべてのエントリがストアの外を指す状態にする
+func truncateAll(t *testing.T, name string) uint64 {
+	t.Helper()
+	require.NoError(t, os.Truncate(name, 5))
+	return 0
+}
+
+func testSegmentReadAll(t *testing.T, s interface {
+	Read(uint64) (*api.Record, error)
+}, baseOffset, n uint64) {
+	t.Helper()
+	for i := uint64(0); i < n; i++ {
+		got, err := s.Read(baseOffset + i)
+		require.NoError(t, err)
+		require.Equal(t, baseOffset+i, got.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %02d", i)), got.Value)
+	}
+}
+
+// 密なインデックスと疎なインデックスでインデックスのサイズと読み込みのレイテンシを比較する
+func BenchmarkSegmentRead(b *testing.B) {
+	const n = 10000
+	for _, interval := range []uint64{0, 256, 4096} {
+		b.Run(fmt.Sprintf("interval=%d", interval), func(b *testing.B) {
+			dir, _ := ioutil.TempDir("", "segment-bench")
+			defer os.RemoveAll(dir)
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 1 << 30
+			c.Segment.MaxIndexBytes = n * log.ExportEntWidth
+			c.Segment.IndexIntervalBytes = interval
+
+			s, err := log.ExportNewSegment(dir, 0, c)
+			require.NoError(b, err)
+			defer s.Close()
+			value := make([]byte, 64)
+			for i := 0; i < n; i++ {
+				_, err = s.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+			require.NoError(b, s.ExportSeal())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = s.Read(uint64(i*7919) % n); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(s.ExportIndexSize()), "index-bytes")
+		})
+	}
+}
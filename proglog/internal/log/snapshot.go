@@ -0,0 +1,508 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// スナップショットは次のフォーマットで書き出す
+//
+//	ヘッダー
+//	  magic      [4]byte  "PLSN"
+//	  version    uint32
+//	  records    uint64   スナップショットに含まれるレコードの総数
+//	  segments   uint32   セグメントの数
+//	  セグメントの数だけ繰り返す
+//	    baseOffset uint64
+//	    records    uint64 セグメントに含まれるレコードの数
+//	    size       uint64 セグメントのストアのバイト数
+//	本体
+//	  各セグメントのストアの内容(長さ付きのレコード)をヘッダーの順に連結したもの
+//	トレーラー
+//	  checksum   uint32   ヘッダーと本体のCRC-32C
+const (
+	snapshotVersion uint32 = 1
+	// セグメントごとのヘッダーのバイト数
+	snapshotSegmentWidth = 8 + 8 + 8
+)
+
+var snapshotMagic = [4]byte{'P', 'L', 'S', 'N'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// スナップショットとして解釈できないデータを復元しようとしたときに返すエラー
+	ErrSnapshotFormat = errors.New("invalid snapshot format")
+	// 対応していないバージョンのスナップショットを復元しようとしたときに返すエラー
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+	// スナップショットのチェックサムが一致しないときに返すエラー
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// スナップショットに含まれるセグメントの情報
+type snapshotSegment struct {
+	baseOffset uint64
+	records    uint64
+	size       uint64
+}
+
+// ログ全体を読み込むためのio.Readerを返す
+// スナップショットやログの復元をサポートする必要があるときに必要になる
+// 読み込んだデータはRestoreで別のディレクトリのログに復元することができる
+func (l *Log) Reader() io.Reader {
+	return l.Snapshot()
+}
+
+// ある時点のログの内容を読み込むためのio.ReadCloser
+// 作成した時点のオフセットの範囲だけを含むので、その後にレコードが追加されても内容は変わらない
+// 最後まで読み込むか閉じるまでの間、含まれるセグメントは切り詰められても読み込むことができる
+// オブジェクトストアにだけ存在するセグメントも含むので、LowestOffsetはLog.LowestOffsetと一致する
+type Snapshot struct {
+	// スナップショットに含まれる最小のオフセット
+	LowestOffset uint64
+	// スナップショットの次のオフセット
+	// スナップショットはこのオフセットより前のレコードをすべて含む
+	NextOffset uint64
+
+	r        io.Reader
+	segments []*segment
+	once     sync.Once
+	err      error
+}
+
+// ログの現在の状態のスナップショットを作る
+// 呼び出し側は最後まで読み込むか、Closeを呼び出さなければならない
+// オブジェクトストアにだけ存在するセグメントはダウンロードして含め、ダウンロードに失敗した場合は読み込むときにエラーを返す
+func (l *Log) Snapshot() *Snapshot {
+	remote, local, localHeaders := l.captureSnapshot()
+	// ダウンロードしている間も追加できるように、ロックを解放してからダウンロードする
+	segments, err := l.tier.openAll(remote)
+	if err != nil {
+		for _, s := range local {
+			_ = s.release()
+		}
+		return &Snapshot{r: &errorReader{err: err}}
+	}
+	// リモートのセグメントはローカルのセグメントより古いので、前に並べる
+	headers := make([]snapshotSegment, 0, len(segments)+len(local))
+	for _, s := range segments {
+		// リモートのセグメントは封印されているので、ロックを保持せずに範囲を決めてよい
+		headers = append(headers, snapshotSegment{
+			baseOffset: s.baseOffset,
+			records:    s.nextOffset - s.baseOffset,
+			size:       s.end,
+		})
+	}
+	headers = append(headers, localHeaders...)
+	segments = append(segments, local...)
+	readers := make([]io.Reader, 0, len(segments)+1)
+	readers = append(readers, bytes.NewReader(encodeSnapshotHeader(headers)))
+	for i, s := range segments {
+		readers = append(readers, io.NewSectionReader(s.store, 0, int64(headers[i].size)))
+	}
+	// ヘッダーと本体を読み込みながらチェックサムを計算し、最後にトレーラーとして書き出す
+	h := crc32.New(crcTable)
+	snapshot := &Snapshot{
+		LowestOffset: headers[0].baseOffset,
+		NextOffset:   headers[len(headers)-1].baseOffset + headers[len(headers)-1].records,
+		r: io.MultiReader(
+			io.TeeReader(io.MultiReader(readers...), h),
+			&checksumReader{hash: h},
+		),
+		segments: segments,
+	}
+	return snapshot
+}
+
+// ロックを保持している間に、スナップショットに含めるリモートのセグメントとローカルのセグメントの範囲を決め、
+// ローカルのセグメントを参照する
+func (l *Log) captureSnapshot() ([]remoteSegment, []*segment, []snapshotSegment) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var remote []remoteSegment
+	if l.tier != nil {
+		remote = append(remote, l.tier.remote...)
+	}
+	headers := make([]snapshotSegment, len(l.segments))
+	for i, s := range l.segments {
+		// 追加を行うときは書き込みロックを取るので、追加が完了したレコードの位置だけが見える
+		headers[i] = snapshotSegment{
+			baseOffset: s.baseOffset,
+			records:    s.nextOffset - s.baseOffset,
+			size:       s.end,
+		}
+		// 読み込みが終わるまでにセグメントが削除されても閉じられないようにする
+		s.acquire()
+	}
+	return remote, append([]*segment(nil), l.segments...), headers
+}
+
+// io.Readerインターフェースを満たす
+// 最後まで読み込んだときにセグメントへの参照を解放する
+func (s *Snapshot) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		if cerr := s.Close(); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+// セグメントへの参照を解放する
+// 何度呼び出してもよい
+func (s *Snapshot) Close() error {
+	s.once.Do(func() {
+		for _, seg := range s.segments {
+			if err := seg.release(); err != nil && s.err == nil {
+				s.err = fmt.Errorf("failed to release segment: %w", err)
+			}
+		}
+		s.segments = nil
+	})
+	return s.err
+}
+
+// 常にerrを返すio.Reader
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// スナップショットのヘッダーをエンコードする
+func encodeSnapshotHeader(segments []snapshotSegment) []byte {
+	var records uint64
+	for _, s := range segments {
+		records += s.records
+	}
+	b := make([]byte, len(snapshotMagic)+4+8+4, len(snapshotMagic)+4+8+4+len(segments)*snapshotSegmentWidth)
+	copy(b, snapshotMagic[:])
+	enc.PutUint32(b[4:8], snapshotVersion)
+	enc.PutUint64(b[8:16], records)
+	enc.PutUint32(b[16:20], uint32(len(segments)))
+	for _, s := range segments {
+		seg := make([]byte, snapshotSegmentWidth)
+		enc.PutUint64(seg[0:8], s.baseOffset)
+		enc.PutUint64(seg[8:16], s.records)
+		enc.PutUint64(seg[16:24], s.size)
+		b = append(b, seg...)
+	}
+	return b
+}
+
+// それまでに読み込まれたデータのチェックサムを返すio.Reader
+type checksumReader struct {
+	hash hash.Hash32
+	sum  []byte
+}
+
+// io.Readerインターフェースを満たす
+// 先行するReaderをすべて読み終わってから呼び出されるので、最初の呼び出しでチェックサムを確定する
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.sum == nil {
+		c.sum = make([]byte, 4)
+		enc.PutUint32(c.sum, c.hash.Sum32())
+	}
+	if len(c.sum) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.sum)
+	c.sum = c.sum[n:]
+	return n, nil
+}
+
+// Readerで読み込んだスナップショットからログを復元する
+// 既存のセグメントは復元したセグメントで置き換えられる
+// スナップショットが壊れている場合や、復元したログを開けなかった場合はエラーを返し、ログは変更されない
+func (l *Log) Restore(r io.Reader) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 復元するセグメントはいったん一時ディレクトリに作り、チェックサムを検証してから置き換える
+	// 一時ディレクトリはログのディレクトリの中に作るので、ファイルの移動はリネームで済む
+	tmp, err := os.MkdirTemp(l.Dir, ".restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	segments, err := l.restoreSegments(tmp, r)
+	if err != nil {
+		return err
+	}
+	// 既存のファイルは削除せずに別のディレクトリに退避し、置き換えに失敗したときは元に戻す
+	// 退避したファイルも開いているファイルディスクリプタからは読み込めるので、参照されているセグメントはそのまま使える
+	old, err := os.MkdirTemp(l.Dir, ".restore-old-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(old)
+	point, err := l.stash(old)
+	if err != nil {
+		return err
+	}
+	if err = l.replace(segments); err != nil {
+		if rerr := l.rollback(point); rerr != nil {
+			return fmt.Errorf("failed to roll back restore: %v: %w", rerr, err)
+		}
+		return err
+	}
+	// 置き換えたセグメントは、参照が無くなったら閉じる
+	for _, s := range point.segments {
+		if err = s.closeWhenReleased(); err != nil {
+			return fmt.Errorf("failed to close replaced segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Restoreに失敗したときに戻す、置き換える前のログの状態
+type restorePoint struct {
+	segments      []*segment
+	activeSegment *segment
+	remote        []remoteSegment
+	state         *logState
+	highWatermark uint64
+	// 退避したファイルの元のパスと、退避先のパス
+	moved map[string]string
+}
+
+// ログのファイルをdirに退避し、置き換える前のログの状態を返す
+// 退避に失敗した場合は、退避したファイルを元に戻す
+func (l *Log) stash(dir string) (*restorePoint, error) {
+	point := &restorePoint{
+		segments:      l.segments,
+		activeSegment: l.activeSegment,
+		state:         l.state,
+		highWatermark: l.highWatermark,
+		moved:         make(map[string]string),
+	}
+	if l.tier != nil {
+		point.remote = l.tier.remote
+	}
+	// プロデューサーとトランザクションの状態は復元したレコードから作り直す
+	// 復元したレコードがレプリカに複製されているかはわからないので、ハイウォーターマークも引き継がない
+	names := []string{path.Join(l.Dir, stateFile), path.Join(l.Dir, highWatermarkFile)}
+	for _, s := range l.segments {
+		names = append(names, s.store.Name(), s.index.Name())
+		if s.sealed {
+			names = append(names, s.sealedFilePath())
+		}
+	}
+	for _, name := range names {
+		dst := path.Join(dir, path.Base(name))
+		err := os.Rename(name, dst)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to stash %s: %w", path.Base(name), err)
+			if rerr := unstash(point.moved); rerr != nil {
+				return nil, fmt.Errorf("failed to unstash files: %v: %w", rerr, err)
+			}
+			return nil, err
+		}
+		point.moved[name] = dst
+	}
+	return point, nil
+}
+
+// 復元したセグメントのファイルをログのディレクトリに移動して、ログを開き直す
+func (l *Log) replace(segments []*segment) error {
+	for _, s := range segments {
+		names := []string{s.store.Name(), s.index.Name()}
+		if s.sealed {
+			names = append(names, s.sealedFilePath())
+		}
+		for _, name := range names {
+			if err := os.Rename(name, path.Join(l.Dir, path.Base(name))); err != nil {
+				return fmt.Errorf("failed to move restored file: %w", err)
+			}
+		}
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return l.setup()
+}
+
+// replaceで移動したり作ったりしたファイルを削除し、退避したファイルと状態を元に戻す
+func (l *Log) rollback(point *restorePoint) error {
+	// setupの途中で失敗していれば、開いたセグメントが残っている
+	if len(l.segments) > 0 && (len(point.segments) == 0 || l.segments[0] != point.segments[0]) {
+		closeSegments(l.segments)
+	}
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !(isSegmentFileName(file.Name()) || file.Name() == stateFile || file.Name() == highWatermarkFile) {
+			continue
+		}
+		if err = os.Remove(path.Join(l.Dir, file.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", file.Name(), err)
+		}
+	}
+	if err = unstash(point.moved); err != nil {
+		return err
+	}
+	l.segments = point.segments
+	l.activeSegment = point.activeSegment
+	if l.tier != nil {
+		l.tier.remote = point.remote
+	}
+	l.state = point.state
+	l.highWatermark = point.highWatermark
+	return nil
+}
+
+// 退避したファイルを元のパスに戻す
+func unstash(moved map[string]string) error {
+	for name, dst := range moved {
+		if err := os.Rename(dst, name); err != nil {
+			return fmt.Errorf("failed to unstash %s: %w", path.Base(name), err)
+		}
+	}
+	return nil
+}
+
+// スナップショットを読み込んでdirにセグメントを作り、閉じた状態で返す
+func (l *Log) restoreSegments(dir string, r io.Reader) ([]*segment, error) {
+	h := crc32.New(crcTable)
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, h)
+	headers, err := readSnapshotHeader(tr)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*segment, 0, len(headers))
+	defer func() {
+		closeSegments(segments)
+	}()
+	for i, hdr := range headers {
+		c := l.Config
+		// 現在の設定よりも多くのレコードを持つセグメントでもインデックスに収まるようにする
+		if need := hdr.records * entWidth; need > c.Segment.MaxIndexBytes {
+			c.Segment.MaxIndexBytes = need
+		}
+		s, err := newSegment(dir, hdr.baseOffset, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create segment: %w", err)
+		}
+		segments = append(segments, s)
+		if err = restoreRecords(s, tr, hdr); err != nil {
+			return nil, err
+		}
+		// 空の最後のセグメントはそのままアクティブなセグメントとして使い、それ以外は封印する
+		if i < len(headers)-1 || hdr.records > 0 {
+			if err = s.seal(); err != nil {
+				return nil, fmt.Errorf("failed to seal segment: %w", err)
+			}
+		}
+	}
+	sum := make([]byte, 4)
+	want := h.Sum32()
+	if _, err = io.ReadFull(br, sum); err != nil {
+		return nil, fmt.Errorf("failed to read checksum: %w", ErrSnapshotFormat)
+	}
+	if enc.Uint32(sum) != want {
+		return nil, ErrSnapshotChecksum
+	}
+	return segments, nil
+}
+
+// スナップショットのヘッダーを読み込んで検証する
+func readSnapshotHeader(r io.Reader) ([]snapshotSegment, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != snapshotMagic {
+		return nil, fmt.Errorf("bad magic: %w", ErrSnapshotFormat)
+	}
+	var fixed struct {
+		Version  uint32
+		Records  uint64
+		Segments uint32
+	}
+	if err := binary.Read(r, enc, &fixed); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", ErrSnapshotFormat)
+	}
+	if fixed.Version != snapshotVersion {
+		return nil, fmt.Errorf("version %d: %w", fixed.Version, ErrSnapshotVersion)
+	}
+	var segments []snapshotSegment
+	var records uint64
+	for i := uint32(0); i < fixed.Segments; i++ {
+		var s struct {
+			BaseOffset uint64
+			Records    uint64
+			Size       uint64
+		}
+		if err := binary.Read(r, enc, &s); err != nil {
+			return nil, fmt.Errorf("failed to read segment header: %w", ErrSnapshotFormat)
+		}
+		// セグメントは連続したオフセットの範囲を持っていなければならない
+		if i > 0 {
+			prev := segments[i-1]
+			if prev.baseOffset+prev.records != s.BaseOffset {
+				return nil, fmt.Errorf("segment %d does not follow %d: %w", s.BaseOffset, prev.baseOffset, ErrSnapshotFormat)
+			}
+		}
+		segments = append(segments, snapshotSegment{
+			baseOffset: s.BaseOffset,
+			records:    s.Records,
+			size:       s.Size,
+		})
+		records += s.Records
+	}
+	if records != fixed.Records {
+		return nil, fmt.Errorf("record count mismatch: %w", ErrSnapshotFormat)
+	}
+	return segments, nil
+}
+
+// ヘッダーで示された数のレコードをスナップショットから読み込んでセグメントに追加する
+// レコードのオフセットはセグメントのベースオフセットから連続していなければならない
+func restoreRecords(s *segment, r io.Reader, hdr snapshotSegment) error {
+	size := make([]byte, lenWidth)
+	var read uint64
+	for i := uint64(0); i < hdr.records; i++ {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return fmt.Errorf("failed to read record length: %w", ErrSnapshotFormat)
+		}
+		n := enc.Uint64(size)
+		read += lenWidth + n
+		if read > hdr.size {
+			return fmt.Errorf("segment %d exceeds its size: %w", hdr.baseOffset, ErrSnapshotFormat)
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return fmt.Errorf("failed to read record: %w", ErrSnapshotFormat)
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return fmt.Errorf("failed to unmarshal record: %v: %w", err, ErrSnapshotFormat)
+		}
+		if want := hdr.baseOffset + i; record.Offset != want {
+			return fmt.Errorf("record %d has offset %d: %w", want, record.Offset, ErrSnapshotFormat)
+		}
+		if err := s.append(p); err != nil {
+			return fmt.Errorf("failed to append record: %w", err)
+		}
+	}
+	if read != hdr.size {
+		return fmt.Errorf("segment %d size mismatch: %w", hdr.baseOffset, ErrSnapshotFormat)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package log_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshot(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log, snapshot []byte){
+		"restore into fresh directory": testRestoreRoundTrip,
+		"restore replaces segments":    testRestoreReplaces,
+		"restore rebuilds producers":   testRestoreProducers,
+		"reject corrupted snapshot":    testRestoreCorrupted,
+		"reject unsupported version":   testRestoreVersion,
+		"reject truncated snapshot":    testRestoreTruncated,
+		"reject offset gaps":           testRestoreOffsetGap,
+		"roll back failed restore":     testRestoreRollback,
+		"point in time":                testSnapshotPointInTime,
+		"survive truncate":             testSnapshotSurvivesTruncate,
+		"consistent under appends":     testSnapshotUnderAppends,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "snapshot-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Segment.InitialOffset = 10
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			// 複数のセグメントにまたがるようにレコードを追加してから、古いセグメントを切り詰める
+			for i := 0; i < 10; i++ {
+				_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %02d", i))})
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.Truncate(13))
+			off, err := l.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(13), off)
+
+			snapshot, err := io.ReadAll(l.Reader())
+			require.NoError(t, err)
+
+			fn(t, l, snapshot)
+		})
+	}
+}
+
+// スナップショットから新しいディレクトリにログを復元できるかテストする
+func testRestoreRoundTrip(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	require.NoError(t, n.Restore(bytes.NewReader(snapshot)))
+	requireSameLog(t, l, n)
+
+	// 復元したログに追加を続けられる
+	off, err := n.Append(&api.Record{Value: []byte("hello world 10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+
+	// 再起動しても復元した状態から起動できる
+	require.NoError(t, n.Close())
+	n, err = log.NewLog(n.Dir, n.Config)
+	require.NoError(t, err)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+}
+
+// 既存のレコードを持つログに復元すると、既存のセグメントが置き換えられるかテストする
+func testRestoreReplaces(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	for i := 0; i < 30; i++ {
+		_, err := n.Append(&api.Record{Value: []byte("existing")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, n.Restore(bytes.NewReader(snapshot)))
+	requireSameLog(t, l, n)
+}
+
+// 復元する前のプロデューサーの状態を使わずに、復元したレコードから作り直すかテストする
+func testRestoreProducers(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	for seq := uint64(0); seq < 5; seq++ {
+		_, err := n.Append(&api.Record{Value: []byte("existing"), ProducerId: "p", Sequence: seq})
+		require.NoError(t, err)
+	}
+	require.NoError(t, n.Restore(bytes.NewReader(snapshot)))
+	off, err := n.Append(&api.Record{Value: []byte("hello world 10"), ProducerId: "p", Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+}
+
+// チェックサムが一致しないスナップショットを拒否し、ログを変更しないかテストする
+func testRestoreCorrupted(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	off, err := n.Append(&api.Record{Value: []byte("existing")})
+	require.NoError(t, err)
+
+	corrupted := append([]byte(nil), snapshot...)
+	corrupted[len(corrupted)-10] ^= 0xff
+	err = n.Restore(bytes.NewReader(corrupted))
+	require.True(t, errors.Is(err, log.ErrSnapshotChecksum), err)
+
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("existing"), read.Value)
+}
+
+// 対応していないバージョンのスナップショットを拒否するかテストする
+func testRestoreVersion(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	unsupported := append([]byte(nil), snapshot...)
+	unsupported[7] = 99
+	err := n.Restore(bytes.NewReader(unsupported))
+	require.True(t, errors.Is(err, log.ErrSnapshotVersion), err)
+}
+
+// 途中で途切れたスナップショットを拒否するかテストする
+func testRestoreTruncated(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	err := n.Restore(bytes.NewReader(snapshot[:len(snapshot)/2]))
+	require.True(t, errors.Is(err, log.ErrSnapshotFormat), err)
+}
+
+// チェックサムが正しくても、レコードのオフセットが連続していないスナップショットを拒否するかテストする
+func testRestoreOffsetGap(t *testing.T, l *log.Log, _ []byte) {
+	n := newRestoreTarget(t, l.Config)
+	off, err := n.Append(&api.Record{Value: []byte("existing")})
+	require.NoError(t, err)
+
+	snapshot := encodeSnapshot(t, 5, &api.Record{Value: []byte("a"), Offset: 5}, &api.Record{Value: []byte("b"), Offset: 7})
+	err = n.Restore(bytes.NewReader(snapshot))
+	require.True(t, errors.Is(err, log.ErrSnapshotFormat), err)
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("existing"), read.Value)
+
+	snapshot = encodeSnapshot(t, 5, &api.Record{Value: []byte("a"), Offset: 5}, &api.Record{Value: []byte("b"), Offset: 6})
+	require.NoError(t, n.Restore(bytes.NewReader(snapshot)))
+	read, err = n.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), read.Value)
+}
+
+// 復元したセグメントに置き換えられなかったときに、元のセグメントに戻すかテストする
+func testRestoreRollback(t *testing.T, l *log.Log, snapshot []byte) {
+	n := newRestoreTarget(t, l.Config)
+	off, err := n.Append(&api.Record{Value: []byte("existing")})
+	require.NoError(t, err)
+
+	// 復元するセグメントのファイルと同じ名前のディレクトリを作って、移動できないようにする
+	blocker := filepath.Join(n.Dir, "13.store")
+	require.NoError(t, os.Mkdir(blocker, 0o755))
+	require.Error(t, n.Restore(bytes.NewReader(snapshot)))
+
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("existing"), read.Value)
+	next, err := n.Append(&api.Record{Value: []byte("appended")})
+	require.NoError(t, err)
+	require.Equal(t, off+1, next)
+
+	// 再起動しても元のセグメントから起動できる
+	require.NoError(t, os.Remove(blocker))
+	require.NoError(t, n.Close())
+	n, err = log.NewLog(n.Dir, n.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	for i, v := range []string{"existing", "appended"} {
+		read, err = n.Read(off + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(v), read.Value)
+	}
+}
+
+// baseから始まる1つのセグメントにrecordsを持つスナップショットを作る
+func encodeSnapshot(t *testing.T, base uint64, records ...*api.Record) []byte {
+	t.Helper()
+	var body bytes.Buffer
+	for _, record := range records {
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+		require.NoError(t, binary.Write(&body, binary.BigEndian, uint64(len(p))))
+		body.Write(p)
+	}
+	var b bytes.Buffer
+	b.WriteString("PLSN")
+	for _, v := range []interface{}{
+		uint32(1), uint64(len(records)), uint32(1),
+		base, uint64(len(records)), uint64(body.Len()),
+	} {
+		require.NoError(t, binary.Write(&b, binary.BigEndian, v))
+	}
+	b.Write(body.Bytes())
+	sum := crc32.Checksum(b.Bytes(), crc32.MakeTable(crc32.Castagnoli))
+	require.NoError(t, binary.Write(&b, binary.BigEndian, sum))
+	return b.Bytes()
+}
+
+func newRestoreTarget(t *testing.T, c log.Config) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "snapshot-restore-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c.Segment.InitialOffset = 0
+	n, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	return n
+}
+
+// 2つのログが同じオフセットの範囲に同じレコードを持っているか確認する
+func requireSameLog(t *testing.T, want, got *log.Log) {
+	t.Helper()
+	lowest, err := want.LowestOffset()
+	require.NoError(t, err)
+	highest, err := want.HighestOffset()
+	require.NoError(t, err)
+
+	off, err := got.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, off)
+	off, err = got.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest, off)
+
+	for off := lowest; off <= highest; off++ {
+		w, err := want.Read(off)
+		require.NoError(t, err)
+		g, err := got.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, w.Value, g.Value)
+		require.Equal(t, w.Offset, g.Offset)
+	}
+}
+
+// スナップショットを作った後に追加されたレコードが含まれないかテストする
+func testSnapshotPointInTime(t *testing.T, l *log.Log, _ []byte) {
+	snapshot := l.Snapshot()
+	require.Equal(t, uint64(13), snapshot.LowestOffset)
+	require.Equal(t, uint64(20), snapshot.NextOffset)
+
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("after snapshot")})
+		require.NoError(t, err)
+	}
+
+	n := newRestoreTarget(t, l.Config)
+	require.NoError(t, n.Restore(snapshot))
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, snapshot.NextOffset-1, off)
+}
+
+// スナップショットを読み込んでいる間にセグメントが切り詰められても、最後まで読み込めるかテストする
+func testSnapshotSurvivesTruncate(t *testing.T, l *log.Log, _ []byte) {
+	snapshot := l.Snapshot()
+	// ヘッダーだけ読み込んでからセグメントを切り詰める
+	head := make([]byte, 8)
+	_, err := io.ReadFull(snapshot, head)
+	require.NoError(t, err)
+	require.NoError(t, l.Truncate(snapshot.NextOffset-2))
+
+	rest, err := io.ReadAll(snapshot)
+	require.NoError(t, err)
+	require.NoError(t, snapshot.Close())
+
+	n := newRestoreTarget(t, l.Config)
+	require.NoError(t, n.Restore(bytes.NewReader(append(head, rest...))))
+	for off := snapshot.LowestOffset; off < snapshot.NextOffset; off++ {
+		read, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %02d", off-10)), read.Value)
+	}
+}
+
+// 追加を続けている間に作ったスナップショットが、それぞれ内部で一貫しているかテストする
+func testSnapshotUnderAppends(t *testing.T, l *log.Log, _ []byte) {
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if _, err := l.Append(&api.Record{Value: []byte("concurrent append")}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 10; i++ {
+		snapshot := l.Snapshot()
+		b, err := io.ReadAll(snapshot)
+		require.NoError(t, err)
+
+		n := newRestoreTarget(t, l.Config)
+		require.NoError(t, n.Restore(bytes.NewReader(b)))
+		off, err := n.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, snapshot.NextOffset-1, off)
+		require.NoError(t, n.Remove())
+	}
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// プロデューサー、トランザクション、遅延レコードの状態を永続化するファイル
+const stateFile = "state.json"
+
+// レコードから作るログの状態
+// 追加されたレコードを順に反映して作るので、永続化した状態が無くてもセグメントを読み込めば作り直せる
+type logState struct {
+	// この状態に反映した最後のレコードの次のオフセット
+	// 再起動したときは、このオフセットからのレコードを読み込んで状態を復元する
+	NextOffset uint64 `json:"next_offset"`
+	// 冪等なプロデューサーごとの最近追加したレコード
+	Producers map[string]*producerState `json:"producers"`
+	// コミットもアボートもされていないトランザクション
+	Transactions map[string]*transactionState `json:"transactions"`
+	// アボートされたトランザクションのレコードの範囲
+	Aborted map[string][]abortedTransaction `json:"aborted"`
+	// 配信を待っている遅延レコードを、配信時刻の順に並べたもの
+	Delayed []delayedRecord `json:"delayed"`
+}
+
+func newLogState() *logState {
+	return &logState{
+		Producers:    make(map[string]*producerState),
+		Transactions: make(map[string]*transactionState),
+		Aborted:      make(map[string][]abortedTransaction),
+	}
+}
+
+// 状態が空の場合はtrueを返す
+// 空の状態は永続化しなくても、次に起動したときに同じ状態になる
+func (s *logState) empty() bool {
+	return len(s.Producers) == 0 && len(s.Transactions) == 0 && len(s.Aborted) == 0 && len(s.Delayed) == 0
+}
+
+// 追加されたレコードを状態に反映する
+func (l *Log) applyRecord(record *api.Record) {
+	l.recordSequence(record)
+	l.recordTransaction(record)
+	l.recordDelayed(record)
+}
+
+// 永続化した状態を読み込み、その後に追加されたレコードを反映する
+// 永続化した状態が無い場合はローカルのセグメントのすべてのレコードから作る
+func (l *Log) loadState() error {
+	l.state = newLogState()
+	next := l.segments[len(l.segments)-1].nextOffset
+	from := l.segments[0].baseOffset
+	p, err := os.ReadFile(path.Join(l.Dir, stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+	if err == nil {
+		state := newLogState()
+		if err = json.Unmarshal(p, state); err != nil {
+			return fmt.Errorf("failed to decode state: %w", err)
+		}
+		// ログより先まで反映した状態は、別のログのものなので使わない
+		if state.NextOffset <= next {
+			l.state = state
+			if state.NextOffset > from {
+				from = state.NextOffset
+			}
+		}
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= from {
+			continue
+		}
+		err = s.scan(func(record *api.Record) error {
+			if record.Offset >= from {
+				l.applyRecord(record)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// 状態をファイルに永続化する
+// 書き込み中にクラッシュしても前の状態が残るように、一時ファイルに書き込んでからリネームする
+func (l *Log) saveState() error {
+	l.state.NextOffset = l.segments[len(l.segments)-1].nextOffset
+	p, err := json.Marshal(l.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	name := path.Join(l.Dir, stateFile)
+	if err = writeFile(name+".tmp", bytes.NewReader(p), uint64(len(p))); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("failed to rename state: %w", err)
+	}
+	return nil
+}
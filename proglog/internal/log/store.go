@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/tysonmote/gommap"
 )
 
 // レコードサイズとインデックスエントリを永続化するためのエンコーディングを定義する
@@ -22,8 +24,16 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// 封印されたストアは読み込み専用になり、書き込み用のバッファを持たない
+	sealed bool
+	// 読み取り専用でメモリにマップされたファイル
+	// 封印されたストアだけがマップされる
+	mmap gommap.MMap
 }
 
+// 封印されたストアに書き込もうとしたときに返すエラー
+var errStoreSealed = errors.New("store is sealed")
+
 func newStore(f *os.File) (*store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
@@ -43,6 +53,9 @@ func newStore(f *os.File) (*store, error) {
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.sealed {
+		return 0, 0, errStoreSealed
+	}
 	pos = s.size
 	// レコードの長さを書くことで、レコードを読むときに何バイト読めば良いのかわかるようにする
 	if err = binary.Write(s.buf, enc, uint64(len(p))); err != nil {
@@ -60,11 +73,16 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 }
 
 // 指定された位置に格納されているレコードを返す
+// マップされたストアの場合はコピーせずにマップされた領域のスライスを返すので
+// 呼び出し側はストアを閉じた後にそのスライスを参照してはいけない
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.mmap != nil {
+		return s.readMapped(pos)
+	}
 	// BufferがまだディスクにFlushしていないレコードを読もうとする場合に備えてまずFlushする
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return nil, fmt.Errorf("failed to flush: %w", err)
 	}
 	// レコード全体を読むために何バイト読まないといけないのかを調べる
@@ -80,24 +98,120 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	return b, nil
 }
 
+// マップされた領域から指定された位置に格納されているレコードを読み込む
+// システムコールもアロケーションも発生しない
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	if uint64(len(s.mmap)) < pos+lenWidth {
+		return nil, io.EOF
+	}
+	size := enc.Uint64(s.mmap[pos : pos+lenWidth])
+	end := pos + lenWidth + size
+	if uint64(len(s.mmap)) < end {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// キャパシティを切り詰めて、呼び出し側がappendしても隣のレコードを上書きしないようにする
+	return s.mmap[pos+lenWidth : end : end], nil
+}
+
 // ストアのファイルの中のoffから始まるpにlen(p)バイトを読み込む
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if s.mmap != nil {
+		if off >= int64(len(s.mmap)) {
+			return 0, io.EOF
+		}
+		n := copy(p, s.mmap[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if err := s.flush(); err != nil {
 		return 0, fmt.Errorf("failed to flush: %w", err)
 	}
 	n, err := s.File.ReadAt(p, off)
 	return n, errors.WithMessage(err, "failed to read file")
 }
 
+// ストアを封印する
+// バッファされたデータを永続化してストレージに同期してから、ストアファイルを読み取り専用でメモリにマップする
+// これ以降ストアには追加できなくなるので、書き込み用のバッファも解放する
+func (s *store) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealed {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	if err := s.File.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	// 空のファイルはマップできないので、マップせずに封印する
+	if s.size > 0 {
+		mmap, err := gommap.MapRegion(s.File.Fd(), 0, int64(s.size), gommap.PROT_READ, gommap.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("failed to get mmap: %w", err)
+		}
+		s.mmap = mmap
+	}
+	s.buf = nil
+	s.sealed = true
+	return nil
+}
+
+// バッファされたデータを書き出して、ストレージに同期する
+func (s *store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealed {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	return errors.WithMessage(s.File.Sync(), "failed to sync file")
+}
+
+// バッファされたデータをファイルに書き出す
+// 封印されたストアはバッファを持たないので何もしない
+func (s *store) flush() error {
+	if s.buf == nil {
+		return nil
+	}
+	return errors.WithMessage(s.buf.Flush(), "failed to flush buffer")
+}
+
+// ストアをsizeバイトに切り詰める
+// 書き込みの途中でクラッシュしたときに、末尾に残った不完全なレコードを取り除くために使う
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("failed to truncate store: %w", err)
+	}
+	s.size = size
+	return nil
+}
+
 // ファイルを閉じる前にバッファされたデータを永続化
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
 		return fmt.Errorf("failed to flush: %w", err)
 	}
+	if s.mmap != nil {
+		if err = s.mmap.UnsafeUnmap(); err != nil {
+			return fmt.Errorf("failed to unmap: %w", err)
+		}
+		s.mmap = nil
+	}
 	return errors.WithMessage(s.File.Close(), "failed to close file")
 }
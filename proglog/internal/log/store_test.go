@@ -107,3 +107,36 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := log.ExportNewStore(f)
+	require.NoError(t, err)
+
+	testAppend(t, s)
+	// バッファに残っているレコードも含めて永続化されてからマップされる
+	require.NoError(t, s.ExportSeal())
+
+	// マップされた領域から読み込めることを確認する
+	testRead(t, s)
+	testReadAt(t, s)
+
+	// 末尾を超えて読み込もうとするとエラーになる
+	_, err = s.Read(width * 3)
+	require.Error(t, err)
+
+	// 封印されたストアには追加できない
+	_, _, err = s.Append(write)
+	require.Error(t, err)
+
+	require.NoError(t, s.Close())
+
+	// 再びストアを作成して、マップ前と同じように読み込めることを確認する
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	s, err = log.ExportNewStore(f)
+	require.NoError(t, err)
+	testRead(t, s)
+}
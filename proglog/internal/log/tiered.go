@@ -0,0 +1,473 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// 封印されたセグメントをローカルのディスクの外に保存するためのオブジェクトストア
+// ディスクの容量を超えて古いレコードを保持したいときに使う
+type ObjectStore interface {
+	// rから読み込んだsizeバイトをkeyに保存する
+	Put(key string, r io.Reader, size int64) error
+	// keyに保存された内容を読み込む
+	// 存在しない場合はErrObjectNotFoundを返す
+	Get(key string) (io.ReadCloser, error)
+	// keyに保存された内容を削除する
+	Delete(key string) error
+	// 保存されているすべてのキーを返す
+	List() ([]string, error)
+}
+
+var (
+	// オブジェクトストアにキーが存在しないときに返すエラー
+	ErrObjectNotFound = errors.New("object not found")
+	// オブジェクトストアのキーとして使えない文字列を渡したときに返すエラー
+	ErrInvalidObjectKey = errors.New("invalid object key")
+)
+
+// オブジェクトストアに保存したセグメントの範囲を記録するオブジェクトの拡張子
+// ストアとインデックスをアップロードした後に保存するので、これがあるセグメントはアップロードが完了している
+const remoteSegmentExt = ".segment"
+
+// ダウンロードしたリモートのセグメントをキャッシュするディレクトリ
+const remoteCacheDir = "remote-cache"
+
+// オブジェクトストアにだけ存在するセグメント
+type remoteSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// 封印されたセグメントのオブジェクトストアへのアップロードと、リモートのセグメントの読み込みを管理する
+type tier struct {
+	store  ObjectStore
+	dir    string
+	config Config
+
+	// アップロードが完了したセグメントのベースオフセット
+	uploaded map[uint64]bool
+	// ローカルに存在せず、オブジェクトストアにだけ存在するセグメント
+	// ログのロックで保護する
+	remote []remoteSegment
+
+	// ダウンロードしたセグメントのキャッシュ
+	mu    sync.Mutex
+	cache map[uint64]*segment
+	// キャッシュしたセグメントのベースオフセットを最近使った順に並べたもの
+	lru []uint64
+}
+
+func newTier(dir string, c Config) *tier {
+	return &tier{
+		store:    c.Tier.ObjectStore,
+		dir:      path.Join(dir, remoteCacheDir),
+		config:   c,
+		uploaded: make(map[uint64]bool),
+		cache:    make(map[uint64]*segment),
+	}
+}
+
+// オブジェクトストアに保存されているセグメントを読み込み、ローカルのセグメントの前に並べる
+func (l *Log) setupTier() error {
+	if l.tier == nil {
+		return nil
+	}
+	keys, err := l.tier.store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	var remote []remoteSegment
+	for _, key := range keys {
+		if path.Ext(key) != remoteSegmentExt {
+			continue
+		}
+		r, err := l.tier.store.Get(key)
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %w", key, err)
+		}
+		var rs remoteSegment
+		err = json.NewDecoder(r).Decode(&rs)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", key, err)
+		}
+		l.tier.uploaded[rs.BaseOffset] = true
+		remote = append(remote, rs)
+	}
+	sort.Slice(remote, func(i, j int) bool {
+		return remote[i].BaseOffset < remote[j].BaseOffset
+	})
+	// ローカルにも存在するセグメントはローカルから読み込む
+	l.tier.remote = nil
+	for _, rs := range remote {
+		if len(l.segments) > 0 && rs.BaseOffset >= l.segments[0].baseOffset {
+			break
+		}
+		l.tier.remote = append(l.tier.remote, rs)
+	}
+	// リモートとローカルのセグメントを合わせて、オフセットの範囲が連続していなければならない
+	ranges := make([]remoteSegment, 0, len(l.tier.remote)+len(l.segments))
+	ranges = append(ranges, l.tier.remote...)
+	for _, s := range l.segments {
+		ranges = append(ranges, remoteSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+	}
+	for i := 1; i < len(ranges); i++ {
+		prev, cur := ranges[i-1], ranges[i]
+		if prev.NextOffset < cur.BaseOffset {
+			return fmt.Errorf("remote segment %d ends at %d but next segment starts at %d: %w",
+				prev.BaseOffset, prev.NextOffset, cur.BaseOffset, ErrSegmentGap)
+		}
+		if prev.NextOffset > cur.BaseOffset {
+			return fmt.Errorf("remote segment %d ends at %d but next segment starts at %d: %w",
+				prev.BaseOffset, prev.NextOffset, cur.BaseOffset, ErrSegmentOverlap)
+		}
+	}
+	return nil
+}
+
+// 封印されたセグメントをオブジェクトストアにアップロードし、ポリシーに従ってローカルから削除する
+// 新しく封印されたセグメントをアップロードするために、Truncateと同じように定期的に呼び出す
+func (l *Log) Offload() error {
+	if l.tier == nil {
+		return nil
+	}
+	// アップロードしている間も追加できるように、ロックを保持せずにセグメントを参照してアップロードする
+	l.mu.RLock()
+	var pending []*segment
+	for _, s := range l.segments {
+		if s.sealed && !l.tier.uploaded[s.baseOffset] {
+			s.acquire()
+			pending = append(pending, s)
+		}
+	}
+	l.mu.RUnlock()
+	uploaded := make([]uint64, 0, len(pending))
+	var err error
+	for _, s := range pending {
+		if err == nil {
+			if err = l.tier.upload(s); err == nil {
+				uploaded = append(uploaded, s.baseOffset)
+			}
+		}
+		if rerr := s.release(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, off := range uploaded {
+		l.tier.uploaded[off] = true
+	}
+	if err != nil {
+		return err
+	}
+	// アップロードが完了したセグメントを古い方から削除する
+	// オフセットの範囲が連続するように、ローカルに残すセグメントより新しいものは削除しない
+	keep := l.Config.Tier.LocalSegments
+	for len(l.segments) > keep+1 {
+		s := l.segments[0]
+		if !s.sealed || !l.tier.uploaded[s.baseOffset] {
+			break
+		}
+		if err = s.Remove(); err != nil {
+			return fmt.Errorf("failed to remove offloaded segment: %w", err)
+		}
+		l.tier.remote = append(l.tier.remote, remoteSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// セグメントのストアとインデックスをアップロードし、最後にセグメントの範囲を保存する
+func (t *tier) upload(s *segment) error {
+	store := io.NewSectionReader(s.store, 0, int64(s.end))
+	if err := t.store.Put(path.Base(s.store.Name()), store, int64(s.end)); err != nil {
+		return fmt.Errorf("failed to upload store: %w", err)
+	}
+	index := io.NewSectionReader(s.index.file, 0, int64(s.index.size))
+	if err := t.store.Put(path.Base(s.index.Name()), index, int64(s.index.size)); err != nil {
+		return fmt.Errorf("failed to upload index: %w", err)
+	}
+	b, err := json.Marshal(remoteSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+	if err != nil {
+		return fmt.Errorf("failed to marshal remote segment: %w", err)
+	}
+	key := fmt.Sprintf("%d%s", s.baseOffset, remoteSegmentExt)
+	if err = t.store.Put(key, bytes.NewReader(b), int64(len(b))); err != nil {
+		return fmt.Errorf("failed to upload remote segment: %w", err)
+	}
+	return nil
+}
+
+// オフセットを含むリモートのセグメントを探す
+// ログのロックを保持して呼び出す
+func (t *tier) find(off uint64) (remoteSegment, bool) {
+	i := sort.Search(len(t.remote), func(i int) bool {
+		return t.remote[i].NextOffset > off
+	})
+	if i == len(t.remote) || off < t.remote[i].BaseOffset {
+		return remoteSegment{}, false
+	}
+	return t.remote[i], true
+}
+
+// リモートのセグメントからレコードを読み込む
+// セグメントはダウンロードしてキャッシュしておくので、続けて同じセグメントを読み込むときはダウンロードしない
+func (t *tier) read(rs remoteSegment, off uint64) (record *api.Record, err error) {
+	s, err := t.open(rs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rerr := s.release(); rerr != nil && err == nil {
+			record, err = nil, fmt.Errorf("failed to release cached segment: %w", rerr)
+		}
+	}()
+	return s.Read(off)
+}
+
+// リモートのセグメントをすべて参照して、オフセットの順に返す
+// 途中で失敗した場合は、それまでに参照したセグメントを解放する
+// tがnilでもよく、その場合はremoteも空でなければならない
+func (t *tier) openAll(remote []remoteSegment) ([]*segment, error) {
+	segments := make([]*segment, 0, len(remote))
+	for _, rs := range remote {
+		s, err := t.open(rs)
+		if err != nil {
+			for _, s := range segments {
+				_ = s.release()
+			}
+			return nil, fmt.Errorf("failed to open remote segment %d: %w", rs.BaseOffset, err)
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// キャッシュからリモートのセグメントを参照して返す
+// キャッシュに無い場合はダウンロードして、最も長く使われていないセグメントをキャッシュから追い出す
+func (t *tier) open(rs remoteSegment) (*segment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.cache[rs.BaseOffset]
+	if !ok {
+		var err error
+		if s, err = t.download(rs); err != nil {
+			return nil, err
+		}
+		t.cache[rs.BaseOffset] = s
+	}
+	t.touch(rs.BaseOffset)
+	for len(t.lru) > t.config.Tier.CacheSegments {
+		evict := t.lru[0]
+		t.lru = t.lru[1:]
+		if err := t.cache[evict].Remove(); err != nil {
+			return nil, fmt.Errorf("failed to evict cached segment: %w", err)
+		}
+		delete(t.cache, evict)
+	}
+	s.acquire()
+	return s, nil
+}
+
+// キャッシュしたセグメントを最近使ったものとして並べ直す
+func (t *tier) touch(off uint64) {
+	for i, o := range t.lru {
+		if o == off {
+			t.lru = append(t.lru[:i], t.lru[i+1:]...)
+			break
+		}
+	}
+	t.lru = append(t.lru, off)
+}
+
+// リモートのセグメントをキャッシュディレクトリにダウンロードし、封印されたセグメントとして開く
+func (t *tier) download(rs remoteSegment) (*segment, error) {
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	for _, ext := range []string{storeFileExt, indexFileExt} {
+		key := fmt.Sprintf("%d%s", rs.BaseOffset, ext)
+		r, err := t.store.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", key, err)
+		}
+		f, err := os.OpenFile(path.Join(t.dir, key), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, storeFilePerm)
+		if err == nil {
+			_, err = io.Copy(f, r)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		_ = r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", key, err)
+		}
+	}
+	f, err := os.OpenFile(segmentFilePath(t.dir, rs.BaseOffset, sealedFileExt), os.O_WRONLY|os.O_CREATE, sealedFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sealed marker: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close sealed marker: %w", err)
+	}
+	s, err := newSegment(t.dir, rs.BaseOffset, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open downloaded segment: %w", err)
+	}
+	return s, nil
+}
+
+// lowest以下のオフセットだけを持つリモートのセグメントをオブジェクトストアとキャッシュから削除する
+// ログのロックを保持して呼び出す
+func (t *tier) truncate(lowest uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var remote []remoteSegment
+	for _, rs := range t.remote {
+		if rs.NextOffset > lowest+1 {
+			remote = append(remote, rs)
+			continue
+		}
+		// 範囲を記録したオブジェクトを最初に削除して、中途半端に残っても読み込まれないようにする
+		for _, ext := range []string{remoteSegmentExt, storeFileExt, indexFileExt} {
+			key := fmt.Sprintf("%d%s", rs.BaseOffset, ext)
+			if err := t.store.Delete(key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				return fmt.Errorf("failed to delete %s: %w", key, err)
+			}
+		}
+		delete(t.uploaded, rs.BaseOffset)
+		if s, ok := t.cache[rs.BaseOffset]; ok {
+			if err := s.Remove(); err != nil {
+				return fmt.Errorf("failed to remove cached segment: %w", err)
+			}
+			delete(t.cache, rs.BaseOffset)
+			for i, o := range t.lru {
+				if o == rs.BaseOffset {
+					t.lru = append(t.lru[:i], t.lru[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	t.remote = remote
+	return nil
+}
+
+// キャッシュしたセグメントをすべて閉じる
+func (t *tier) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for off, s := range t.cache {
+		if err := s.Close(); err != nil {
+			return fmt.Errorf("failed to close cached segment: %w", err)
+		}
+		delete(t.cache, off)
+	}
+	t.lru = nil
+	return nil
+}
+
+// ローカルのファイルシステムのディレクトリをオブジェクトストアとして使う
+// テストや、ネットワークファイルシステムにセグメントを退避したい場合に使う
+type LocalObjectStore struct {
+	Dir string
+}
+
+func NewLocalObjectStore(dir string) (*LocalObjectStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	return &LocalObjectStore{Dir: dir}, nil
+}
+
+// 一時ファイルに書き込んでからリネームするので、読み込み側から書き込み途中の内容が見えることはない
+func (o *LocalObjectStore) Put(key string, r io.Reader, size int64) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(o.Dir, ".put-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.CopyN(f, r, size); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync %s: %w", key, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", key, err)
+	}
+	if err = os.Rename(f.Name(), path.Join(o.Dir, key)); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", key, err)
+	}
+	return nil
+}
+
+func (o *LocalObjectStore) Get(key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path.Join(o.Dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func (o *LocalObjectStore) Delete(key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(path.Join(o.Dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", key, err)
+	}
+	return nil
+}
+
+func (o *LocalObjectStore) List() ([]string, error) {
+	files, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		keys = append(keys, file.Name())
+	}
+	return keys, nil
+}
+
+// ディレクトリの外を指すキーを受け付けない
+func checkObjectKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return fmt.Errorf("%s: %w", strconv.Quote(key), ErrInvalidObjectKey)
+	}
+	return nil
+}
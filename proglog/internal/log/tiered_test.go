@@ -0,0 +1,196 @@
+package log_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredStorage(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log, objects *log.LocalObjectStore){
+		"offload sealed segments":     testOffload,
+		"keep local segments":         testOffloadKeepLocal,
+		"read remote after restart":   testOffloadRestart,
+		"truncate remote segments":    testOffloadTruncate,
+		"evict cached remote segment": testOffloadEvict,
+		"back up remote segments":     testOffloadBackup,
+		"snapshot remote segments":    testOffloadSnapshot,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tiered-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			objects, err := log.NewLocalObjectStore(filepath.Join(dir, "objects"))
+			require.NoError(t, err)
+			require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0o755))
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Tier.ObjectStore = objects
+			l, err := log.NewLog(filepath.Join(dir, "log"), c)
+			require.NoError(t, err)
+			// オフセット0, 3, 6から始まる3つの封印されたセグメントと、9から始まるアクティブなセグメントを作る
+			appendRecords(t, l, 10)
+
+			fn(t, l, objects)
+		})
+	}
+}
+
+// 封印されたセグメントをアップロードしてローカルから削除し、削除したセグメントも読み込めるかテストする
+func testOffload(t *testing.T, l *log.Log, objects *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+
+	for _, name := range []string{"0.store", "0.index", "3.store", "6.store", "6.segment"} {
+		_, err := os.Stat(filepath.Join(objects.Dir, name))
+		require.NoError(t, err, name)
+	}
+	for _, name := range []string{"0.store", "3.store", "6.store"} {
+		_, err := os.Stat(filepath.Join(l.Dir, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+	// アクティブなセグメントはアップロードしない
+	_, err := os.Stat(filepath.Join(objects.Dir, "9.store"))
+	require.True(t, os.IsNotExist(err))
+
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	requireRecords(t, l, 0, 10)
+	_, err = l.Read(10)
+	require.Error(t, err)
+}
+
+// ポリシーで指定した数の封印されたセグメントをローカルに残すかテストする
+func testOffloadKeepLocal(t *testing.T, l *log.Log, objects *log.LocalObjectStore) {
+	require.NoError(t, l.Close())
+	c := l.Config
+	c.Tier.LocalSegments = 1
+	l, err := log.NewLog(l.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, l.Offload())
+
+	_, err = os.Stat(filepath.Join(l.Dir, "3.store"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(l.Dir, "6.store"))
+	require.NoError(t, err)
+	// ローカルに残したセグメントもアップロードはされている
+	_, err = os.Stat(filepath.Join(objects.Dir, "6.segment"))
+	require.NoError(t, err)
+	requireRecords(t, l, 0, 10)
+}
+
+// 再起動してもオブジェクトストアにだけ存在するセグメントを読み込めるかテストする
+func testOffloadRestart(t *testing.T, l *log.Log, _ *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+	require.NoError(t, l.Close())
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	off, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+	requireRecords(t, n, 0, 10)
+
+	// ローカルのセグメントをすべて失っても、リモートのセグメントの続きから追加できる
+	require.NoError(t, n.Close())
+	for _, name := range []string{"9.store", "9.index"} {
+		require.NoError(t, os.Remove(filepath.Join(l.Dir, name)))
+	}
+	n, err = log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	appendRecords(t, n, 1)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+	requireRecords(t, n, 0, 10)
+}
+
+// 切り詰めるとオブジェクトストアからもセグメントが削除されるかテストする
+func testOffloadTruncate(t *testing.T, l *log.Log, objects *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+	requireRecords(t, l, 0, 3)
+	require.NoError(t, l.Truncate(5))
+
+	for _, name := range []string{"0.store", "0.index", "0.segment", "3.store", "3.index", "3.segment"} {
+		_, err := os.Stat(filepath.Join(objects.Dir, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	_, err = l.Read(2)
+	require.Error(t, err)
+	requireRecords(t, l, 6, 10)
+}
+
+// キャッシュの上限を超えたリモートのセグメントを追い出しても、再びダウンロードして読み込めるかテストする
+func testOffloadEvict(t *testing.T, l *log.Log, _ *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+	for i := 0; i < 3; i++ {
+		requireRecords(t, l, 0, 1)
+		requireRecords(t, l, 3, 4)
+		requireRecords(t, l, 6, 7)
+	}
+	files, err := os.ReadDir(filepath.Join(l.Dir, "remote-cache"))
+	require.NoError(t, err)
+	// キャッシュするのは1つのセグメントのストア、インデックス、マーカーファイルだけ
+	require.Len(t, files, 3)
+}
+
+// オブジェクトストアにだけ存在するセグメントもバックアップに含め、差分バックアップではダウンロードし直さないかテストする
+func testOffloadBackup(t *testing.T, l *log.Log, _ *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+	full := filepath.Join(l.Dir, "..", "full")
+	m, err := l.Backup(full, nil)
+	require.NoError(t, err)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, m.LowestOffset)
+	require.Equal(t, uint64(0), m.Segments[0].BaseOffset)
+	require.True(t, m.Segments[0].Included)
+
+	appendRecords(t, l, 10)
+	require.NoError(t, l.Offload())
+	incr := filepath.Join(l.Dir, "..", "incr")
+	m, err = l.Backup(incr, m)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), m.LowestOffset)
+	require.False(t, m.Segments[0].Included)
+	_, err = os.Stat(filepath.Join(incr, "0.store"))
+	require.True(t, os.IsNotExist(err))
+
+	dst := filepath.Join(l.Dir, "..", "restored")
+	require.NoError(t, log.RestoreBackup(dst, full, incr))
+	n, err := log.NewLog(dst, log.Config{})
+	require.NoError(t, err)
+	defer n.Close()
+	requireSameLog(t, l, n)
+}
+
+// オブジェクトストアにだけ存在するセグメントもスナップショットに含めるかテストする
+func testOffloadSnapshot(t *testing.T, l *log.Log, _ *log.LocalObjectStore) {
+	require.NoError(t, l.Offload())
+	snapshot := l.Snapshot()
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, snapshot.LowestOffset)
+	require.Equal(t, uint64(10), snapshot.NextOffset)
+	b, err := io.ReadAll(snapshot)
+	require.NoError(t, err)
+
+	n := newRestoreTarget(t, log.Config{})
+	require.NoError(t, n.Restore(bytes.NewReader(b)))
+	requireSameLog(t, l, n)
+}
@@ -0,0 +1,190 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+var (
+	// 開始されていないか、すでにコミットかアボートされたトランザクションを使おうとしたときに返すエラー
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// 同じIDのトランザクションがすでに開始されているときに返すエラー
+	ErrTransactionOpen = errors.New("transaction already open")
+	// 制御レコードを直接追加しようとしたときに返すエラー
+	// 制御レコードはトランザクションのコミットとアボートでだけ書き込む
+	ErrControlRecord = errors.New("control records can only be written by transactions")
+)
+
+// 読み込むときに、トランザクションのレコードをどう扱うか
+type IsolationLevel int
+
+const (
+	// トランザクションのレコードも制御レコードもすべて読み込む
+	ReadUncommitted IsolationLevel = iota
+	// コミットされたトランザクションのレコードだけを読み込む
+	// 制御レコードと、アボートされたか完了していないトランザクションのレコードは読み込まない
+	ReadCommitted
+)
+
+// 開始されてから、コミットもアボートもされていないトランザクション
+type transactionState struct {
+	// トランザクションの最初のレコードのオフセット
+	// これ以降のレコードは、トランザクションが完了するまでReadCommittedで読み込めない
+	FirstOffset uint64 `json:"first_offset"`
+	Records     uint64 `json:"records"`
+}
+
+// アボートされたトランザクションのレコードの範囲
+type abortedTransaction struct {
+	FirstOffset uint64 `json:"first_offset"`
+	// アボートを表す制御レコードのオフセット
+	AbortOffset uint64 `json:"abort_offset"`
+}
+
+// 複数のレコードを、読み込む側からすべて見えるかまったく見えないように追加する
+// 追加したレコードはCommitするまでReadCommittedでは読み込めず、Abortするとそのまま読み込めなくなる
+type Transaction struct {
+	l  *Log
+	id string
+}
+
+// idのトランザクションを開始する
+// 同じIDのトランザクションは、前のトランザクションが完了するまで開始できない
+func (l *Log) BeginTransaction(id string) (*Transaction, error) {
+	if id == "" {
+		return nil, fmt.Errorf("transaction id is required")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.state.Transactions[id]; ok {
+		return nil, fmt.Errorf("transaction %s: %w", id, ErrTransactionOpen)
+	}
+	l.state.Transactions[id] = &transactionState{}
+	return &Transaction{l: l, id: id}, nil
+}
+
+func (tx *Transaction) ID() string {
+	return tx.id
+}
+
+// トランザクションのレコードとしてログに追加する
+func (tx *Transaction) Append(record *api.Record) (uint64, error) {
+	record.TransactionId = tx.id
+	return tx.l.Append(record)
+}
+
+// トランザクションをコミットし、コミットを表す制御レコードのオフセットを返す
+func (tx *Transaction) Commit() (uint64, error) {
+	return tx.l.endTransaction(tx.id, api.ControlType_CONTROL_TYPE_COMMIT)
+}
+
+// トランザクションをアボートし、アボートを表す制御レコードのオフセットを返す
+func (tx *Transaction) Abort() (uint64, error) {
+	return tx.l.endTransaction(tx.id, api.ControlType_CONTROL_TYPE_ABORT)
+}
+
+// トランザクションを完了する制御レコードを追加する
+func (l *Log) endTransaction(id string, control api.ControlType) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.state.Transactions[id]; !ok {
+		return 0, fmt.Errorf("transaction %s: %w", id, ErrTransactionNotFound)
+	}
+	return l.append(&api.Record{TransactionId: id, Control: control})
+}
+
+// トランザクションのレコードや制御レコードを状態に反映する
+func (l *Log) recordTransaction(record *api.Record) {
+	id := record.TransactionId
+	if id == "" {
+		return
+	}
+	switch record.Control {
+	case api.ControlType_CONTROL_TYPE_COMMIT:
+		delete(l.state.Transactions, id)
+	case api.ControlType_CONTROL_TYPE_ABORT:
+		if st, ok := l.state.Transactions[id]; ok && st.Records > 0 {
+			l.state.Aborted[id] = append(l.state.Aborted[id], abortedTransaction{
+				FirstOffset: st.FirstOffset,
+				AbortOffset: record.Offset,
+			})
+		}
+		delete(l.state.Transactions, id)
+	default:
+		// 開始は記録しないので、レコードを読み込んで状態を作るときは最初のレコードで開始したとみなす
+		st, ok := l.state.Transactions[id]
+		if !ok {
+			st = &transactionState{}
+			l.state.Transactions[id] = st
+		}
+		if st.Records == 0 {
+			st.FirstOffset = record.Offset
+		}
+		st.Records++
+	}
+}
+
+// ReadCommittedで読み込めるレコードの上限のオフセットを返す
+// 完了していないトランザクションのうち、最初のレコードが最も古いものの手前までになる
+// ログのロックを取得してから呼び出さなければならない
+func (l *Log) lastStableOffset() uint64 {
+	off := l.segments[len(l.segments)-1].nextOffset
+	for _, st := range l.state.Transactions {
+		if st.Records > 0 && st.FirstOffset < off {
+			off = st.FirstOffset
+		}
+	}
+	return off
+}
+
+// レコードがアボートされたトランザクションのものかどうかを返す
+// ログのロックを取得してから呼び出さなければならない
+func (l *Log) isAborted(record *api.Record) bool {
+	for _, a := range l.state.Aborted[record.TransactionId] {
+		if a.FirstOffset <= record.Offset && record.Offset < a.AbortOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// 再起動する前に完了しなかったトランザクションをアボートする
+// トランザクションを開始したクライアントはもういないので、コミットされることはない
+func (l *Log) abortOpenTransactions() error {
+	ids := make([]string, 0, len(l.state.Transactions))
+	for id := range l.state.Transactions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if l.state.Transactions[id].Records == 0 {
+			delete(l.state.Transactions, id)
+			continue
+		}
+		if _, err := l.append(&api.Record{TransactionId: id, Control: api.ControlType_CONTROL_TYPE_ABORT}); err != nil {
+			return fmt.Errorf("failed to abort transaction %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// lowestより前にアボートされたトランザクションの範囲を忘れる
+// ログを切り詰めた後は、その範囲のレコードを読み込むことはない
+func (l *Log) pruneAborted(lowest uint64) {
+	for id, aborted := range l.state.Aborted {
+		var kept []abortedTransaction
+		for _, a := range aborted {
+			if a.AbortOffset >= lowest {
+				kept = append(kept, a)
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.state.Aborted, id)
+			continue
+		}
+		l.state.Aborted[id] = kept
+	}
+}
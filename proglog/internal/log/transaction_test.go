@@ -0,0 +1,220 @@
+package log_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	testcases := map[string]func(t *testing.T, l *log.Log){
+		"commit makes records visible":   testTransactionCommit,
+		"abort hides records":            testTransactionAbort,
+		"read range skips control":       testTransactionReadRange,
+		"abort open transactions":        testTransactionRecovery,
+		"rebuild aborted transactions":   testTransactionRebuild,
+		"reject invalid transaction use": testTransactionErrors,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "transaction-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, l)
+		})
+	}
+}
+
+// コミットするまでトランザクションのレコードとその後のレコードが読み込めず、コミットすると読み込めるかテストする
+func testTransactionCommit(t *testing.T, l *log.Log) {
+	defer l.Close()
+	appendValue(t, l, "before")
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("tx 1")})
+	require.NoError(t, err)
+	appendValue(t, l, "between")
+	_, err = tx.Append(&api.Record{Value: []byte("tx 2")})
+	require.NoError(t, err)
+
+	it, err := l.NewReadCommittedIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "before")
+
+	off, err := tx.Commit()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	appendValue(t, l, "after")
+	requireValues(t, it, "tx 1", "between", "tx 2", "after")
+}
+
+// アボートしたトランザクションのレコードがReadCommittedでは読み込めず、ReadUncommittedでは読み込めるかテストする
+func testTransactionAbort(t *testing.T, l *log.Log) {
+	defer l.Close()
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("aborted")})
+	require.NoError(t, err)
+	appendValue(t, l, "plain")
+	_, err = tx.Abort()
+	require.NoError(t, err)
+
+	// 同じIDで新しいトランザクションを開始できる
+	tx, err = l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("committed")})
+	require.NoError(t, err)
+	_, err = tx.Commit()
+	require.NoError(t, err)
+
+	it, err := l.NewReadCommittedIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "plain", "committed")
+
+	all, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer all.Close()
+	var controls []api.ControlType
+	for {
+		record, err := all.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		controls = append(controls, record.Control)
+	}
+	require.Equal(t, []api.ControlType{
+		api.ControlType_CONTROL_TYPE_UNSPECIFIED,
+		api.ControlType_CONTROL_TYPE_UNSPECIFIED,
+		api.ControlType_CONTROL_TYPE_ABORT,
+		api.ControlType_CONTROL_TYPE_UNSPECIFIED,
+		api.ControlType_CONTROL_TYPE_COMMIT,
+	}, controls)
+}
+
+// ReadCommittedのReadRangeが、読み込めないレコードを読み飛ばした次のオフセットを返すかテストする
+func testTransactionReadRange(t *testing.T, l *log.Log) {
+	defer l.Close()
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("tx")})
+	require.NoError(t, err)
+
+	r, err := l.ReadRange(0, log.ReadOptions{Isolation: log.ReadCommitted})
+	require.NoError(t, err)
+	require.Empty(t, r.Records)
+	require.Equal(t, uint64(0), r.NextOffset)
+	require.Equal(t, uint64(1), r.HighWatermark)
+
+	_, err = tx.Commit()
+	require.NoError(t, err)
+	r, err = l.ReadRange(0, log.ReadOptions{Isolation: log.ReadCommitted})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 1)
+	require.Equal(t, uint64(2), r.NextOffset)
+	// コミットの制御レコードは読み飛ばした範囲として返す
+	require.Equal(t, []log.Gap{{From: 1, To: 2}}, r.Gaps)
+}
+
+// 再起動する前に完了しなかったトランザクションがアボートされるかテストする
+func testTransactionRecovery(t *testing.T, l *log.Log) {
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = tx.Append(&api.Record{Value: []byte("in flight")})
+	require.NoError(t, err)
+	// レコードを追加していないトランザクションは、制御レコードを書き込まずに捨てる
+	_, err = l.BeginTransaction("empty")
+	require.NoError(t, err)
+	appendValue(t, l, "plain")
+	require.NoError(t, l.Close())
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, api.ControlType_CONTROL_TYPE_ABORT, record.Control)
+
+	it, err := n.NewReadCommittedIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "plain")
+	_, err = n.BeginTransaction("empty")
+	require.NoError(t, err)
+}
+
+// 永続化した状態が無くても、アボートされたトランザクションのレコードを読み込まないかテストする
+func testTransactionRebuild(t *testing.T, l *log.Log) {
+	for i := 0; i < 3; i++ {
+		tx, err := l.BeginTransaction("tx")
+		require.NoError(t, err)
+		_, err = tx.Append(&api.Record{Value: []byte("aborted")})
+		require.NoError(t, err)
+		_, err = tx.Abort()
+		require.NoError(t, err)
+	}
+	appendValue(t, l, "plain")
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(filepath.Join(l.Dir, "state.json")))
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	it, err := n.NewReadCommittedIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it, "plain")
+}
+
+func testTransactionErrors(t *testing.T, l *log.Log) {
+	defer l.Close()
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+	_, err = l.BeginTransaction("tx")
+	require.True(t, errors.Is(err, log.ErrTransactionOpen), err)
+	_, err = tx.Commit()
+	require.NoError(t, err)
+	_, err = tx.Commit()
+	require.True(t, errors.Is(err, log.ErrTransactionNotFound), err)
+	_, err = tx.Append(&api.Record{Value: []byte("late")})
+	require.True(t, errors.Is(err, log.ErrTransactionNotFound), err)
+
+	_, err = l.Append(&api.Record{Control: api.ControlType_CONTROL_TYPE_COMMIT})
+	require.True(t, errors.Is(err, log.ErrControlRecord), err)
+}
+
+func appendValue(t *testing.T, l *log.Log, value string) {
+	t.Helper()
+	_, err := l.Append(&api.Record{Value: []byte(value)})
+	require.NoError(t, err)
+}
+
+// イテレータからvaluesの値のレコードが順に得られ、その後はio.EOFになることを確認する
+func requireValues(t *testing.T, it *log.Iterator, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, v, string(record.Value))
+	}
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Config.Replication.Enabledの場合に、ハイウォーターマークを永続化するファイル
+const highWatermarkFile = "high-watermark"
+
+// 追加されていないオフセットまでハイウォーターマークを進めようとしたときに返すエラー
+var ErrHighWatermarkOutOfRange = errors.New("high watermark out of range")
+
+// コンシューマーが読み込めるレコードの上限のオフセットを返す
+// このオフセットより前のレコードはレプリカに複製されていて、リーダーが替わっても失われない
+// Config.Replication.Enabledでなければ、次に追加されるレコードのオフセットと同じになる
+func (l *Log) HighWatermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.highWatermark
+}
+
+// 次に追加されるレコードのオフセットを返す
+// HighWatermarkとの差が、まだ複製されていないレコードの数になる
+func (l *Log) LogEndOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
+// ハイウォーターマークをoffまで進め、読み込めるようになったレコードを待っている読み込み側に知らせる
+// 過半数のレプリカに複製したレコードの次のオフセットを指定する
+// 今のハイウォーターマーク以下のオフセットを指定しても戻さない
+// 進めたハイウォーターマークは、再起動しても複製したレコードを読み込めるように永続化する
+// 永続化に失敗した場合もハイウォーターマークは進み、再起動すると前に永続化したものに戻る
+func (l *Log) SetHighWatermark(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if end := l.activeSegment.nextOffset; off > end {
+		return fmt.Errorf("offset %d beyond log end offset %d: %w", off, end, ErrHighWatermarkOutOfRange)
+	}
+	if off <= l.highWatermark {
+		return nil
+	}
+	l.highWatermark = off
+	l.notifyAppended()
+	if l.Config.Replication.Enabled {
+		if err := l.saveHighWatermark(); err != nil {
+			return fmt.Errorf("failed to save high watermark: %w", err)
+		}
+	}
+	return nil
+}
+
+// isolationで読み込めるレコードの上限のオフセットを返す
+// ログのロックを取得してから呼び出さなければならない
+func (l *Log) visibleOffset(isolation IsolationLevel) uint64 {
+	off := l.highWatermark
+	if isolation == ReadCommitted {
+		if stable := l.lastStableOffset(); stable < off {
+			off = stable
+		}
+	}
+	return off
+}
+
+// 永続化したハイウォーターマークを読み込む
+// 永続化したものが無ければ、複製されたことがわかっているレコードは無いものとしてローカルのセグメントの先頭にする
+// クラッシュして古いハイウォーターマークが残っていても、レプリカへの複製が確認されればSetHighWatermarkで再び進む
+func (l *Log) loadHighWatermark() error {
+	low := l.segments[0].baseOffset
+	end := l.activeSegment.nextOffset
+	if !l.Config.Replication.Enabled {
+		l.highWatermark = end
+		return nil
+	}
+	l.highWatermark = low
+	p, err := os.ReadFile(path.Join(l.Dir, highWatermarkFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read high watermark: %w", err)
+	}
+	off, err := strconv.ParseUint(strings.TrimSpace(string(p)), baseDecimal, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse high watermark: %w", err)
+	}
+	// 永続化した後に失われたレコードや、削除されたセグメントを指さないようにする
+	if off > end {
+		off = end
+	}
+	if off > low {
+		l.highWatermark = off
+	}
+	return nil
+}
+
+// ハイウォーターマークをファイルに永続化する
+func (l *Log) saveHighWatermark() error {
+	p := []byte(strconv.FormatUint(l.highWatermark, baseDecimal))
+	name := path.Join(l.Dir, highWatermarkFile)
+	if err := writeFile(name+".tmp", bytes.NewReader(p), uint64(len(p))); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("failed to rename high watermark: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package log_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// 複製する場合は、ハイウォーターマークまでのレコードだけを読み込めるかテストする
+func TestHighWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermark-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Replication.Enabled = true
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	appended := l.Appended()
+	for _, v := range []string{"a", "b", "c"} {
+		appendValue(t, l, v)
+	}
+	require.Equal(t, uint64(0), l.HighWatermark())
+	require.Equal(t, uint64(3), l.LogEndOffset())
+	it, err := l.NewIterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	requireValues(t, it)
+	r, err := l.ReadRange(0, log.ReadOptions{})
+	require.NoError(t, err)
+	require.Empty(t, r.Records)
+	require.Equal(t, uint64(0), r.HighWatermark)
+	require.Equal(t, uint64(3), r.LogEndOffset)
+
+	// ハイウォーターマークが進むと、待っている読み込み側に知らせる
+	select {
+	case <-appended:
+		t.Fatal("notified before high watermark advanced")
+	default:
+	}
+	require.NoError(t, l.SetHighWatermark(2))
+	<-appended
+	requireValues(t, it, "a", "b")
+	_, err = l.Read(1)
+	require.NoError(t, err)
+	_, err = l.Read(2)
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+
+	// 閉じる前にクラッシュしても失われないように、進めたときに永続化する
+	p, err := os.ReadFile(filepath.Join(dir, "high-watermark"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(p))
+
+	// 追加されていないオフセットまでは進めず、戻すこともない
+	err = l.SetHighWatermark(4)
+	require.True(t, errors.Is(err, log.ErrHighWatermarkOutOfRange))
+	require.NoError(t, l.SetHighWatermark(1))
+	require.Equal(t, uint64(2), l.HighWatermark())
+
+	// 再起動しても永続化したハイウォーターマークから読み込める
+	require.NoError(t, it.Close())
+	require.NoError(t, l.Close())
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(2), l.HighWatermark())
+	r, err = l.ReadRange(0, log.ReadOptions{})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+	require.Equal(t, uint64(2), r.NextOffset)
+}
@@ -0,0 +1,432 @@
+// queueパッケージは、ログのレコードをワークキューとして配る
+//
+// レコードはコンシューマーに可視性タイムアウトの間だけリースし、コンシューマーは処理したレコードを一つずつAckする
+// タイムアウトまでにAckされなかったレコードや、Nackされたレコードは再び配り、
+// 配った回数が上限に達したレコードはデッドレターログに移す
+// リースの状態はファイルに永続化するので、サーバーを再起動してもリースは失われない
+// デッドレターログに移すレコードも先に永続化し、冪等なプロデューサーとして追加するので、途中でクラッシュしても重複しない
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+)
+
+// リースの状態を永続化するファイル
+const stateFile = "queue.json"
+
+// VisibilityTimeoutを指定しなかったときの可視性タイムアウト
+const defaultVisibilityTimeout = 30 * time.Second
+
+// 一度のReceiveで、まだ配っていないレコードを読み込む数の上限
+// フィルターで配らないレコードが続いても、ロックを長く保持しないようにする
+const maxReceiveScan = 1000
+
+// Ackしようとしたレコードのリースが無いときに返すエラー
+// タイムアウトして別のコンシューマーにリースされたレコードは、前のリースではAckできない
+var ErrLeaseNotFound = errors.New("lease not found")
+
+type Config struct {
+	// リースしたレコードを、Ackされなければ再び配るまでの時間
+	// 0の場合は30秒にする
+	VisibilityTimeout time.Duration
+	// レコードを配る回数の上限
+	// この回数配ってもAckされなかったレコードは、DeadLetterに移して以降は配らない
+	// 0の場合は上限を設けない
+	MaxAttempts int
+	// 配る回数の上限に達したレコードを移すログ
+	// nilの場合はレコードを移さずに捨てる
+	DeadLetter *log.Log
+	// デッドレターログのレコードに、元のログの名前として記録する
+	Topic string
+}
+
+// コンシューマーにリースしたレコード
+type Delivery struct {
+	Record *api.Record
+	// AckやNackで指定するリースのID
+	LeaseID string
+	// このリースを含めて、レコードを配った回数
+	Attempts int
+	// Ackされなければ、この時刻を過ぎると再び配る
+	Deadline time.Time
+}
+
+// 配ったがまだAckされていないレコード
+type pending struct {
+	Attempts int    `json:"attempts"`
+	LeaseID  string `json:"lease_id,omitempty"`
+	Consumer string `json:"consumer,omitempty"`
+	// リースの期限(Unix時間のナノ秒)
+	// 0の場合はリースされておらず、再び配るのを待っている
+	Deadline int64 `json:"deadline"`
+}
+
+// デッドレターログに移すのを待っているレコード
+type deadLetter struct {
+	Offset uint64 `json:"offset"`
+	Reason string `json:"reason"`
+	// デッドレターログに追加するときのシーケンス番号
+	Sequence uint64 `json:"sequence"`
+}
+
+// 永続化するキューの状態
+type state struct {
+	// 次に初めて配るレコードのオフセット
+	// これより前のレコードは、PendingとDeadLettersにあるもの以外はすべてAckされている
+	Next    uint64              `json:"next"`
+	Pending map[uint64]*pending `json:"pending"`
+	// デッドレターログに移すのを待っているレコード
+	// 移す前に永続化しておき、移し終えたら取り除く
+	DeadLetters []deadLetter `json:"dead_letters,omitempty"`
+	// デッドレターログに追加するときのプロデューサーIDと、次に使うシーケンス番号
+	// 移し直したレコードは、デッドレターログで重複として追加されない
+	ProducerID string `json:"producer_id"`
+	Sequence   uint64 `json:"sequence"`
+}
+
+// 変更しても元の状態に影響しないコピーを返す
+func (s *state) clone() *state {
+	c := *s
+	c.Pending = make(map[uint64]*pending, len(s.Pending))
+	for off, p := range s.Pending {
+		cp := *p
+		c.Pending[off] = &cp
+	}
+	c.DeadLetters = append([]deadLetter(nil), s.DeadLetters...)
+	return &c
+}
+
+// ログのレコードを配るワークキュー
+type Queue struct {
+	mu     sync.Mutex
+	dir    string
+	log    *log.Log
+	config Config
+	state  *state
+}
+
+// lのレコードを配るキューを返す
+// dirにリースの状態を永続化し、すでに状態があればその続きから配る
+func New(dir string, l *log.Log, c Config) (*Queue, error) {
+	if c.VisibilityTimeout == 0 {
+		c.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	q := &Queue{
+		dir:    dir,
+		log:    l,
+		config: c,
+		state:  &state{Pending: make(map[uint64]*pending)},
+	}
+	p, err := os.ReadFile(path.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if q.state.Next, err = l.LowestOffset(); err != nil {
+			return nil, err
+		}
+		q.state.ProducerID = newID()
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue state: %w", err)
+	}
+	if err = json.Unmarshal(p, q.state); err != nil {
+		return nil, fmt.Errorf("failed to decode queue state: %w", err)
+	}
+	if q.state.Pending == nil {
+		q.state.Pending = make(map[uint64]*pending)
+	}
+	if q.state.ProducerID == "" {
+		q.state.ProducerID = newID()
+	}
+	// 前回移し終える前に止まったレコードを移す
+	if err = q.flushDeadLetters(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// 状態のコピーに対してfnを呼び出し、永続化できたときだけ反映する
+// fnや永続化に失敗した場合は、状態を変更しない
+// fnが状態を変更しなかった場合は永続化しない
+func (q *Queue) update(fn func() error) error {
+	if err := q.flushDeadLetters(); err != nil {
+		return err
+	}
+	prev := q.state
+	q.state = prev.clone()
+	if err := fn(); err != nil {
+		q.state = prev
+		return err
+	}
+	if reflect.DeepEqual(prev, q.state) {
+		q.state = prev
+		return nil
+	}
+	if err := q.save(); err != nil {
+		q.state = prev
+		return err
+	}
+	// 移すレコードは永続化してあるので、ここで失敗しても次の操作で移し直す
+	_ = q.flushDeadLetters()
+	return nil
+}
+
+// consumerに最大max個のレコードをリースする
+// タイムアウトしたりNackされたりしたレコードを先に、その後にまだ配っていないレコードをオフセットの順に配る
+// acceptがnilでなければ、acceptがtrueを返したレコードだけを配る
+// まだ配っていないレコードでacceptがfalseを返したものは、キューのレコードではないものとして読み飛ばし、どのコンシューマーにも配らない
+// 一度配ったレコードでacceptがfalseを返したものは、リースせずに他のコンシューマーに配るのを待つ
+// 配るレコードが無い場合は空のスライスを返す
+func (q *Queue) Receive(consumer string, max int, accept func(*api.Record) bool) ([]*Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if accept == nil {
+		accept = func(*api.Record) bool { return true }
+	}
+	var deliveries []*Delivery
+	err := q.update(func() error {
+		now := time.Now()
+		q.expire(now)
+		for _, off := range q.redeliverable() {
+			if len(deliveries) == max {
+				break
+			}
+			record, err := q.log.Read(off)
+			if errors.Is(err, log.ErrOffsetOutOfRange) {
+				// Truncateで削除されたレコードは配れない
+				delete(q.state.Pending, off)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if accept(record) {
+				deliveries = append(deliveries, q.lease(record, consumer, now))
+			}
+		}
+		if len(deliveries) < max {
+			fresh, err := q.receiveNew(consumer, max-len(deliveries), now, accept)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, fresh...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// まだ配っていないレコードを、最大max個リースする
+func (q *Queue) receiveNew(consumer string, max int, now time.Time, accept func(*api.Record) bool) ([]*Delivery, error) {
+	// コミットされていないトランザクションのレコードは配らない
+	it, err := q.log.NewReadCommittedIterator(q.state.Next)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		// Truncateで削除されたレコードは飛ばして、残っている最も古いレコードから配る
+		if q.state.Next, err = q.log.LowestOffset(); err != nil {
+			return nil, err
+		}
+		it, err = q.log.NewReadCommittedIterator(q.state.Next)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var deliveries []*Delivery
+	for scanned := 0; len(deliveries) < max && scanned < maxReceiveScan; scanned++ {
+		record, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 読み飛ばしたレコードまで状態に残すと、状態が大きくなり続けるので記録しない
+		if !accept(record) {
+			continue
+		}
+		deliveries = append(deliveries, q.lease(record, consumer, now))
+	}
+	q.state.Next = it.Offset()
+	return deliveries, nil
+}
+
+// レコードをリースする
+func (q *Queue) lease(record *api.Record, consumer string, now time.Time) *Delivery {
+	p, ok := q.state.Pending[record.Offset]
+	if !ok {
+		p = &pending{}
+		q.state.Pending[record.Offset] = p
+	}
+	deadline := now.Add(q.config.VisibilityTimeout)
+	p.Attempts++
+	p.LeaseID = newID()
+	p.Consumer = consumer
+	p.Deadline = deadline.UnixNano()
+	return &Delivery{
+		Record:   record,
+		LeaseID:  p.LeaseID,
+		Attempts: p.Attempts,
+		Deadline: deadline,
+	}
+}
+
+// 再び配るのを待っているレコードのオフセットを、オフセットの順に返す
+func (q *Queue) redeliverable() []uint64 {
+	var offs []uint64
+	for off, p := range q.state.Pending {
+		if p.Deadline == 0 {
+			offs = append(offs, off)
+		}
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs
+}
+
+// リースの期限が切れたレコードを、再び配るか、配る回数の上限に達していればデッドレターログに移す
+func (q *Queue) expire(now time.Time) {
+	for off, p := range q.state.Pending {
+		if p.Deadline == 0 || p.Deadline > now.UnixNano() {
+			continue
+		}
+		q.release(off, p, "visibility timeout expired")
+	}
+}
+
+// リースを解除して再び配るのを待つ
+// 配る回数の上限に達していれば、reasonを理由としてデッドレターログに移すレコードに加える
+func (q *Queue) release(off uint64, p *pending, reason string) {
+	if q.config.MaxAttempts == 0 || p.Attempts < q.config.MaxAttempts {
+		p.LeaseID, p.Consumer, p.Deadline = "", "", 0
+		return
+	}
+	if q.config.DeadLetter != nil {
+		q.state.DeadLetters = append(q.state.DeadLetters, deadLetter{
+			Offset:   off,
+			Reason:   fmt.Sprintf("%s after %d attempts", reason, p.Attempts),
+			Sequence: q.state.Sequence,
+		})
+		q.state.Sequence++
+	}
+	delete(q.state.Pending, off)
+}
+
+// 永続化した、デッドレターログに移すのを待っているレコードを順に移す
+// 移し直したレコードはシーケンス番号が同じなので、デッドレターログには重複して追加されない
+func (q *Queue) flushDeadLetters() error {
+	if len(q.state.DeadLetters) == 0 {
+		return nil
+	}
+	for len(q.state.DeadLetters) > 0 {
+		d := q.state.DeadLetters[0]
+		record, err := q.log.Read(d.Offset)
+		if err != nil && !errors.Is(err, log.ErrOffsetOutOfRange) {
+			return err
+		}
+		// Truncateで削除されたレコードは移せない
+		if err == nil {
+			dl := deadletter.Record(record, q.config.Topic, d.Reason)
+			dl.ProducerId, dl.Sequence = q.state.ProducerID, d.Sequence
+			// 重複を検出できる範囲より前のシーケンス番号は、すでに追加したもの
+			_, err = q.config.DeadLetter.Append(dl)
+			if err != nil && !errors.Is(err, log.ErrDuplicateSequence) {
+				return fmt.Errorf("failed to move record %d to dead-letter log: %w", d.Offset, err)
+			}
+		}
+		q.state.DeadLetters = q.state.DeadLetters[1:]
+	}
+	return q.save()
+}
+
+// リースしたレコードの処理が完了したことを記録する
+// 以降そのレコードは配らない
+func (q *Queue) Ack(off uint64, leaseID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.update(func() error {
+		if _, err := q.leased(off, leaseID); err != nil {
+			return err
+		}
+		delete(q.state.Pending, off)
+		return nil
+	})
+}
+
+// リースしたレコードを処理できなかったことを記録する
+// タイムアウトを待たずに再び配るか、配る回数の上限に達していればデッドレターログに移す
+func (q *Queue) Nack(off uint64, leaseID, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if reason == "" {
+		reason = "rejected by consumer"
+	}
+	return q.update(func() error {
+		p, err := q.leased(off, leaseID)
+		if err != nil {
+			return err
+		}
+		q.release(off, p, reason)
+		return nil
+	})
+}
+
+// offのレコードがleaseIDでリースされていれば、その状態を返す
+// 期限が切れていても、別のコンシューマーにリースされるまではAckできる
+func (q *Queue) leased(off uint64, leaseID string) (*pending, error) {
+	p, ok := q.state.Pending[off]
+	if !ok || p.LeaseID == "" || p.LeaseID != leaseID {
+		return nil, fmt.Errorf("offset %d: %w", off, ErrLeaseNotFound)
+	}
+	return p, nil
+}
+
+// 状態をファイルに永続化する
+// 書き込み中にクラッシュしても前の状態が残るように、一時ファイルに書き込んでからリネームする
+func (q *Queue) save() error {
+	p, err := json.Marshal(q.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue state: %w", err)
+	}
+	name := path.Join(q.dir, stateFile)
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create queue state: %w", err)
+	}
+	if _, err = f.Write(p); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write queue state: %w", err)
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("failed to rename queue state: %w", err)
+	}
+	return nil
+}
+
+// リースのIDやプロデューサーIDに使う、ランダムなIDを返す
+func newID() string {
+	b := make([]byte, 16)
+	// crypto/randの読み込みは失敗しない
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
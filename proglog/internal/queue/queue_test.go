@@ -0,0 +1,270 @@
+package queue_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/queue"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	testcases := map[string]func(t *testing.T, dir string, l *log.Log){
+		"lease and ack":               testQueueAck,
+		"redeliver after timeout":     testQueueRedeliver,
+		"dead-letter after max tries": testQueueMaxAttempts,
+		"resume leases after restart": testQueueRestart,
+		"skip rejected records":       testQueueAccept,
+		"skip saving unchanged state": testQueueUnchanged,
+		"keep state on failed save":   testQueueSaveFailure,
+		"dead-letter once on restart": testQueueDeadLetterRestart,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "queue-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0o755))
+			l, err := log.NewLog(filepath.Join(dir, "log"), log.Config{})
+			require.NoError(t, err)
+			defer l.Close()
+			for i := 0; i < 3; i++ {
+				_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("job %d", i))})
+				require.NoError(t, err)
+			}
+
+			fn(t, dir, l)
+		})
+	}
+}
+
+// レコードをオフセットの順にリースし、Ackしたレコードは配らないかテストする
+func testQueueAck(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+
+	ds, err := q.Receive("c", 2, nil)
+	require.NoError(t, err)
+	require.Len(t, ds, 2)
+	require.Equal(t, "job 0", string(ds[0].Record.Value))
+	require.Equal(t, 1, ds[0].Attempts)
+	require.True(t, ds[0].Deadline.After(time.Now()))
+
+	more, err := q.Receive("c", 10, nil)
+	require.NoError(t, err)
+	require.Len(t, more, 1)
+	require.Equal(t, uint64(2), more[0].Record.Offset)
+	none, err := q.Receive("c", 10, nil)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	require.NoError(t, q.Ack(0, ds[0].LeaseID))
+	require.True(t, errors.Is(q.Ack(0, ds[0].LeaseID), queue.ErrLeaseNotFound))
+	require.True(t, errors.Is(q.Ack(1, "other"), queue.ErrLeaseNotFound))
+}
+
+// タイムアウトしたレコードやNackしたレコードを再び配るかテストする
+func testQueueRedeliver(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{VisibilityTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	first, err := q.Receive("a", 1, nil)
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	// タイムアウトしたレコードは、まだ配っていないレコードより先に配る
+	second, err := q.Receive("b", 2, nil)
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	require.Equal(t, uint64(0), second[0].Record.Offset)
+	require.Equal(t, 2, second[0].Attempts)
+	require.Equal(t, uint64(1), second[1].Record.Offset)
+	require.True(t, errors.Is(q.Ack(0, first[0].LeaseID), queue.ErrLeaseNotFound))
+
+	require.NoError(t, q.Nack(1, second[1].LeaseID, ""))
+	third, err := q.Receive("b", 1, nil)
+	require.NoError(t, err)
+	require.Len(t, third, 1)
+	require.Equal(t, uint64(1), third[0].Record.Offset)
+	require.Equal(t, 2, third[0].Attempts)
+}
+
+// 配る回数の上限に達したレコードを、デッドレターログに移すかテストする
+func testQueueMaxAttempts(t *testing.T, dir string, l *log.Log) {
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dead-letter"), 0o755))
+	dl, err := log.NewLog(filepath.Join(dir, "dead-letter"), log.Config{})
+	require.NoError(t, err)
+	defer dl.Close()
+	q, err := queue.New(dir, l, queue.Config{MaxAttempts: 2, DeadLetter: dl, Topic: "jobs"})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		ds, err := q.Receive("c", 1, nil)
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+		require.Equal(t, uint64(0), ds[0].Record.Offset)
+		require.NoError(t, q.Nack(0, ds[0].LeaseID, "cannot parse"))
+	}
+	ds, err := q.Receive("c", 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), ds[0].Record.Offset)
+
+	record, err := dl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "job 0", string(record.Value))
+	reason, _ := record.Header(deadletter.HeaderReason)
+	require.Equal(t, "cannot parse after 2 attempts", string(reason))
+	topic, _ := record.Header(deadletter.HeaderOriginalTopic)
+	require.Equal(t, "jobs", string(topic))
+}
+
+// 再起動しても、リースとAckしたレコードを覚えているかテストする
+func testQueueRestart(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+	ds, err := q.Receive("c", 2, nil)
+	require.NoError(t, err)
+	require.NoError(t, q.Ack(0, ds[0].LeaseID))
+
+	q, err = queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+	require.NoError(t, q.Ack(1, ds[1].LeaseID))
+	more, err := q.Receive("c", 10, nil)
+	require.NoError(t, err)
+	require.Len(t, more, 1)
+	require.Equal(t, uint64(2), more[0].Record.Offset)
+}
+
+// acceptがfalseを返した配っていないレコードは、状態に残さずに読み飛ばすかテストする
+// 一度配ったレコードは、acceptがfalseを返しても他のコンシューマーに配る
+func testQueueAccept(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+	rejectJob1 := func(record *api.Record) bool {
+		return string(record.Value) != "job 1"
+	}
+
+	ds, err := q.Receive("a", 3, rejectJob1)
+	require.NoError(t, err)
+	require.Len(t, ds, 2)
+	require.Equal(t, uint64(0), ds[0].Record.Offset)
+	require.Equal(t, uint64(2), ds[1].Record.Offset)
+
+	p, err := os.ReadFile(filepath.Join(dir, "queue.json"))
+	require.NoError(t, err)
+	var st struct {
+		Next    uint64                     `json:"next"`
+		Pending map[string]json.RawMessage `json:"pending"`
+	}
+	require.NoError(t, json.Unmarshal(p, &st))
+	require.Equal(t, uint64(3), st.Next)
+	require.Len(t, st.Pending, 2)
+	require.NotContains(t, st.Pending, "1")
+
+	other, err := q.Receive("b", 3, nil)
+	require.NoError(t, err)
+	require.Empty(t, other)
+
+	// Nackしたレコードは、acceptがfalseを返したコンシューマーには配らずに残す
+	require.NoError(t, q.Nack(0, ds[0].LeaseID, ""))
+	none, err := q.Receive("a", 3, func(*api.Record) bool { return false })
+	require.NoError(t, err)
+	require.Empty(t, none)
+	other, err = q.Receive("b", 3, nil)
+	require.NoError(t, err)
+	require.Len(t, other, 1)
+	require.Equal(t, uint64(0), other[0].Record.Offset)
+	require.Equal(t, 2, other[0].Attempts)
+}
+
+// 配るレコードが無く状態が変わらないReceiveでは、状態を永続化しないかテストする
+func testQueueUnchanged(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+	ds, err := q.Receive("c", 3, nil)
+	require.NoError(t, err)
+	require.Len(t, ds, 3)
+
+	// 一時ファイルの場所をディレクトリにして、永続化しようとすると失敗するようにする
+	tmp := filepath.Join(dir, "queue.json.tmp")
+	require.NoError(t, os.Mkdir(tmp, 0o755))
+	defer os.Remove(tmp)
+	ds, err = q.Receive("c", 3, nil)
+	require.NoError(t, err)
+	require.Empty(t, ds)
+}
+
+// 状態を永続化できなかったときは、リースしなかったことになるかテストする
+func testQueueSaveFailure(t *testing.T, dir string, l *log.Log) {
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+
+	// 一時ファイルの場所をディレクトリにして、書き込めないようにする
+	tmp := filepath.Join(dir, "queue.json.tmp")
+	require.NoError(t, os.Mkdir(tmp, 0o755))
+	_, err = q.Receive("c", 2, nil)
+	require.Error(t, err)
+	require.NoError(t, os.Remove(tmp))
+
+	ds, err := q.Receive("c", 2, nil)
+	require.NoError(t, err)
+	require.Len(t, ds, 2)
+	require.Equal(t, uint64(0), ds[0].Record.Offset)
+	require.Equal(t, 1, ds[0].Attempts)
+
+	require.NoError(t, os.Mkdir(tmp, 0o755))
+	require.Error(t, q.Ack(0, ds[0].LeaseID))
+	require.NoError(t, os.Remove(tmp))
+	require.NoError(t, q.Ack(0, ds[0].LeaseID))
+}
+
+// デッドレターログに移した後、それを記録する前に止まっても、再起動後に重複して移さないかテストする
+func testQueueDeadLetterRestart(t *testing.T, dir string, l *log.Log) {
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dead-letter"), 0o755))
+	dl, err := log.NewLog(filepath.Join(dir, "dead-letter"), log.Config{})
+	require.NoError(t, err)
+	defer dl.Close()
+	c := queue.Config{MaxAttempts: 1, DeadLetter: dl, Topic: "jobs"}
+	q, err := queue.New(dir, l, c)
+	require.NoError(t, err)
+	ds, err := q.Receive("c", 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, q.Nack(0, ds[0].LeaseID, "cannot parse"))
+	_, err = dl.Read(0)
+	require.NoError(t, err)
+
+	// 移すレコードを記録した状態に戻して、移し終えたことを記録する前に止まった状態にする
+	name := filepath.Join(dir, "queue.json")
+	p, err := os.ReadFile(name)
+	require.NoError(t, err)
+	var st map[string]interface{}
+	require.NoError(t, json.Unmarshal(p, &st))
+	st["dead_letters"] = []map[string]interface{}{{"offset": 0, "reason": "cannot parse after 1 attempts", "sequence": 0}}
+	p, err = json.Marshal(st)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(name, p, 0o644))
+
+	q, err = queue.New(dir, l, c)
+	require.NoError(t, err)
+	_, err = dl.Read(1)
+	require.True(t, errors.Is(err, log.ErrOffsetOutOfRange))
+
+	// 次にデッドレターログに移すレコードは重複として扱われない
+	ds, err = q.Receive("c", 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, q.Nack(1, ds[0].LeaseID, "cannot parse"))
+	record, err := dl.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "job 1", string(record.Value))
+}
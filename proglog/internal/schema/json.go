@@ -0,0 +1,252 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// JSON Schemaのうち、レジストリが扱うキーワード
+// type、properties、required、additionalProperties(真偽値のみ)、items、enumだけを解釈し、それ以外のキーワードは無視する
+type jsonSchema struct {
+	Type                 jsonTypes              `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+}
+
+// typeキーワードの値
+// 文字列でも文字列の配列でも指定できる
+type jsonTypes []string
+
+func (t *jsonTypes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = jsonTypes{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*t = ss
+	return nil
+}
+
+// typeに指定できる型
+var jsonTypeNames = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+func parseJSONSchema(def []byte) (*jsonSchema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(def, &s); err != nil {
+		return nil, err
+	}
+	if err := s.check("$"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// 扱えない型が指定されていないかを調べる
+func (s *jsonSchema) check(path string) error {
+	for _, t := range s.Type {
+		if !jsonTypeNames[t] {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s.%s: property schema must be an object", path, name)
+		}
+		if err := p.check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+func (s *jsonSchema) validate(value []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return fmt.Errorf("value is not JSON: %v", err)
+	}
+	return s.validateValue(v, "$")
+}
+
+func (s *jsonSchema) validateValue(v interface{}, path string) error {
+	if len(s.Type) > 0 && !s.Type.accepts(jsonTypeOf(v)) {
+		return fmt.Errorf("%s: expected %v but got %s", path, []string(s.Type), jsonTypeOf(v))
+	}
+	if s.Enum != nil && !containsJSON(s.Enum, v) {
+		return fmt.Errorf("%s: value is not one of %v", path, s.Enum)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		// エラーになるプロパティが毎回同じになるように、名前の順に調べる
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: additional property %q is not allowed", path, name)
+				}
+				continue
+			}
+			if err := p.validateValue(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range v {
+			if err := s.Items.validateValue(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) accepts(writer definition) error {
+	w, ok := writer.(*jsonSchema)
+	if !ok {
+		return errors.New("schema type mismatch")
+	}
+	return s.acceptsSchema(w, "$")
+}
+
+// writerに合う値をすべてsが受け入れるかを調べる
+// どちらのスキーマでも定義していないプロパティは任意の値になりうるが、
+// 省略できるプロパティを追加するたびに互換性が無くならないように、readerだけが定義するプロパティは受け入れられるものとみなす
+func (s *jsonSchema) acceptsSchema(writer *jsonSchema, path string) error {
+	if len(s.Type) > 0 {
+		if len(writer.Type) == 0 {
+			return fmt.Errorf("%s: type restricted to %v", path, []string(s.Type))
+		}
+		for _, t := range writer.Type {
+			if !s.Type.accepts(t) {
+				return fmt.Errorf("%s: type %s is no longer accepted", path, t)
+			}
+		}
+	}
+	if s.Enum != nil {
+		if writer.Enum == nil {
+			return fmt.Errorf("%s: values restricted to %v", path, s.Enum)
+		}
+		for _, v := range writer.Enum {
+			if !containsJSON(s.Enum, v) {
+				return fmt.Errorf("%s: value %v is no longer accepted", path, v)
+			}
+		}
+	}
+	for _, name := range s.Required {
+		if !containsString(writer.Required, name) {
+			return fmt.Errorf("%s: property %q became required", path, name)
+		}
+	}
+	writerClosed := writer.AdditionalProperties != nil && !*writer.AdditionalProperties
+	for name, p := range s.Properties {
+		wp, ok := writer.Properties[name]
+		if !ok {
+			continue
+		}
+		if err := p.acceptsSchema(wp, path+"."+name); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+		if !writerClosed {
+			return fmt.Errorf("%s: additional properties are no longer allowed", path)
+		}
+		for name := range writer.Properties {
+			if _, ok := s.Properties[name]; !ok {
+				return fmt.Errorf("%s: property %q is no longer allowed", path, name)
+			}
+		}
+	}
+	if s.Items != nil {
+		if writer.Items == nil {
+			return fmt.Errorf("%s[]: items restricted", path)
+		}
+		if err := s.Items.acceptsSchema(writer.Items, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typの値をすべて受け入れるかを返す
+// integerはnumberに含まれる
+func (t jsonTypes) accepts(typ string) bool {
+	for _, want := range t {
+		if want == typ || (want == "number" && typ == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func containsJSON(values []interface{}, v interface{}) bool {
+	for _, want := range values {
+		if reflect.DeepEqual(want, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, want := range values {
+		if want == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufのメッセージのスキーマ
+type protobufSchema struct {
+	desc protoreflect.MessageDescriptor
+}
+
+// シリアライズしたFileDescriptorSetから、messageの完全修飾名のメッセージを探す
+// FileDescriptorSetには、メッセージを定義したファイルが依存するファイルもすべて含めなければならない
+func parseProtobufSchema(def []byte, message string) (*protobufSchema, error) {
+	if message == "" {
+		return nil, errors.New("message name is required")
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(def, &set); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file descriptor set: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("message %s: %v", message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", message)
+	}
+	return &protobufSchema{desc: md}, nil
+}
+
+func (s *protobufSchema) validate(value []byte) error {
+	if err := proto.Unmarshal(value, dynamicpb.NewMessage(s.desc)); err != nil {
+		return fmt.Errorf("value is not %s: %v", s.desc.FullName(), err)
+	}
+	return nil
+}
+
+func (s *protobufSchema) accepts(writer definition) error {
+	w, ok := writer.(*protobufSchema)
+	if !ok {
+		return errors.New("schema type mismatch")
+	}
+	return acceptsMessage(s.desc, w.desc, make(map[[2]protoreflect.FullName]bool))
+}
+
+// writerでエンコードしたメッセージをreaderでデコードできるかを調べる
+// フィールドはフィールド番号で対応付け、片方にしか無いフィールドは未知のフィールドとして読み飛ばせるので互換とみなす
+// ただし、readerにしか無いrequiredのフィールドはデコードに失敗するので互換ではない
+func acceptsMessage(reader, writer protoreflect.MessageDescriptor, visited map[[2]protoreflect.FullName]bool) error {
+	// 再帰的なメッセージで無限に調べ続けないように、調べている組み合わせは互換とみなす
+	key := [2]protoreflect.FullName{reader.FullName(), writer.FullName()}
+	if visited[key] {
+		return nil
+	}
+	visited[key] = true
+	fields := reader.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		rf := fields.Get(i)
+		wf := writer.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Errorf("%s: required field %d was added", reader.FullName(), rf.Number())
+			}
+			continue
+		}
+		if rf.IsList() != wf.IsList() || rf.IsMap() != wf.IsMap() {
+			return fmt.Errorf("%s: cardinality of field %d changed", reader.FullName(), rf.Number())
+		}
+		if wireGroup(rf.Kind()) != wireGroup(wf.Kind()) {
+			return fmt.Errorf("%s: type of field %d changed from %s to %s", reader.FullName(), rf.Number(), wf.Kind(), rf.Kind())
+		}
+		if rf.Message() != nil && wf.Message() != nil {
+			if err := acceptsMessage(rf.Message(), wf.Message(), visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 同じ値を互いにデコードできる型の組を返す
+// 型を変えても、同じ組の型であればエンコードされたバイト列を読み込める
+func wireGroup(k protoreflect.Kind) string {
+	switch k {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Uint32Kind, protoreflect.Uint64Kind,
+		protoreflect.BoolKind, protoreflect.EnumKind:
+		return "varint"
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return "zigzag"
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return "fixed32"
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return "fixed64"
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return "bytes"
+	default:
+		return k.String()
+	}
+}
@@ -0,0 +1,375 @@
+// schemaパッケージは、レコードの値のスキーマを管理するスキーマレジストリを提供する
+//
+// スキーマはサブジェクトごとにバージョンを付けて登録し、登録した内容はレジストリ専用のログに追記する
+// 新しいバージョンを登録するときは、サブジェクトの互換性の設定に従って最新のバージョンとの互換性を調べる
+// レコードはHeaderSchemaIDのヘッダーでスキーマのIDを参照し、Validateでそのスキーマに合うかを調べられる
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+)
+
+// レコードが従うスキーマのIDを指定するヘッダー
+const HeaderSchemaID = "schema-id"
+
+var (
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrSubjectNotFound    = errors.New("subject not found")
+	ErrInvalidSchema      = errors.New("invalid schema")
+	ErrIncompatibleSchema = errors.New("incompatible schema")
+	ErrInvalidRecord      = errors.New("record does not conform to schema")
+)
+
+// スキーマの種類
+type Type string
+
+const (
+	// JSON Schemaの文書
+	TypeJSON Type = "JSON"
+	// シリアライズしたFileDescriptorSetと、その中のメッセージの完全修飾名
+	TypeProtobuf Type = "PROTOBUF"
+)
+
+// 新しいバージョンを登録するときに、最新のバージョンとの間で求める互換性
+type Compatibility string
+
+const (
+	// 互換性を調べない
+	CompatibilityNone Compatibility = "NONE"
+	// 新しいスキーマで、最新のバージョンのスキーマに合うレコードを読み込める
+	CompatibilityBackward Compatibility = "BACKWARD"
+	// 最新のバージョンのスキーマで、新しいスキーマに合うレコードを読み込める
+	CompatibilityForward Compatibility = "FORWARD"
+	// BACKWARDとFORWARDの両方
+	CompatibilityFull Compatibility = "FULL"
+)
+
+// 互換性が設定されていないサブジェクトで使う互換性
+const DefaultCompatibility = CompatibilityBackward
+
+func (c Compatibility) valid() bool {
+	switch c {
+	case CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull:
+		return true
+	}
+	return false
+}
+
+// 登録したスキーマ
+type Schema struct {
+	// レジストリ全体で一意なID
+	// 同じ定義のスキーマは、別のサブジェクトに登録しても同じIDになる
+	ID      uint64 `json:"id"`
+	Subject string `json:"subject"`
+	// サブジェクトの中で1から順に付けるバージョン
+	Version    int    `json:"version"`
+	Type       Type   `json:"type"`
+	Definition []byte `json:"definition"`
+	// TypeProtobufで、レコードの値として使うメッセージの完全修飾名
+	Message string `json:"message,omitempty"`
+
+	parsed definition
+}
+
+// 解析したスキーマの定義
+type definition interface {
+	// レコードの値がスキーマに合うかを調べる
+	validate(value []byte) error
+	// writerに合うレコードを、このスキーマで読み込めるかを調べる
+	// writerは同じ種類のスキーマでなければならない
+	accepts(writer definition) error
+}
+
+func parseDefinition(typ Type, def []byte, message string) (definition, error) {
+	var (
+		d   definition
+		err error
+	)
+	switch typ {
+	case TypeJSON:
+		d, err = parseJSONSchema(def)
+	case TypeProtobuf:
+		d, err = parseProtobufSchema(def, message)
+	default:
+		return nil, fmt.Errorf("unknown schema type %q: %w", typ, ErrInvalidSchema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrInvalidSchema)
+	}
+	return d, nil
+}
+
+// レジストリのログに追記するエントリ
+// スキーマの登録か、サブジェクトの互換性の設定のどちらかになる
+type entry struct {
+	Schema        *Schema       `json:"schema,omitempty"`
+	Subject       string        `json:"subject,omitempty"`
+	Compatibility Compatibility `json:"compatibility,omitempty"`
+}
+
+// スキーマレジストリ
+// 登録したスキーマをメモリに保持し、変更はログに追記してから反映する
+type Registry struct {
+	mu  sync.RWMutex
+	log *log.Log
+	// IDごとのスキーマ
+	// 別のサブジェクトに登録した同じ定義のスキーマは、最初に登録したものを指す
+	ids map[uint64]*Schema
+	// サブジェクトごとの、バージョンの順に並べたスキーマ
+	subjects      map[string][]*Schema
+	compatibility map[string]Compatibility
+	nextID        uint64
+}
+
+// ログに記録されたスキーマを読み込み、そのログにスキーマを記録するレジストリを返す
+// ログはレジストリ専用のものでなければならない
+func NewRegistry(l *log.Log) (*Registry, error) {
+	r := &Registry{
+		log:           l,
+		ids:           make(map[uint64]*Schema),
+		subjects:      make(map[string][]*Schema),
+		compatibility: make(map[string]Compatibility),
+		nextID:        1,
+	}
+	off, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	it, err := l.NewIterator(off)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema log: %w", err)
+	}
+	defer it.Close()
+	for {
+		record, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			return r, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema log: %w", err)
+		}
+		var e entry
+		if err = json.Unmarshal(record.Value, &e); err != nil {
+			return nil, fmt.Errorf("failed to decode schema log entry at %d: %w", record.Offset, err)
+		}
+		if e.Schema != nil {
+			if e.Schema.parsed, err = parseDefinition(e.Schema.Type, e.Schema.Definition, e.Schema.Message); err != nil {
+				return nil, fmt.Errorf("failed to parse schema %d: %w", e.Schema.ID, err)
+			}
+		}
+		r.apply(&e)
+	}
+}
+
+// エントリをメモリ上のレジストリに反映する
+func (r *Registry) apply(e *entry) {
+	if e.Schema == nil {
+		r.compatibility[e.Subject] = e.Compatibility
+		return
+	}
+	s := e.Schema
+	if _, ok := r.ids[s.ID]; !ok {
+		r.ids[s.ID] = s
+	}
+	r.subjects[s.Subject] = append(r.subjects[s.Subject], s)
+	if s.ID >= r.nextID {
+		r.nextID = s.ID + 1
+	}
+}
+
+// エントリをログに追記してから反映する
+func (r *Registry) write(e *entry) error {
+	p, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = r.log.Append(&api.Record{Value: p}); err != nil {
+		return fmt.Errorf("failed to append to schema log: %w", err)
+	}
+	r.apply(e)
+	return nil
+}
+
+// スキーマをsubjectの新しいバージョンとして登録する
+// subjectにすでに同じ定義のスキーマがあれば、新しいバージョンは作らずにそのスキーマを返す
+// subjectの互換性の設定に従って、最新のバージョンと互換性が無い場合はErrIncompatibleSchemaを返す
+func (r *Registry) Register(subject string, typ Type, def []byte, message string) (*Schema, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("subject is required: %w", ErrInvalidSchema)
+	}
+	parsed, err := parseDefinition(typ, def, message)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := r.subjects[subject]
+	for _, s := range versions {
+		if s.same(typ, def, message) {
+			return s, nil
+		}
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if err = checkCompatibility(r.compatibilityLocked(subject), latest, typ, parsed); err != nil {
+			return nil, fmt.Errorf("subject %s version %d: %w", subject, latest.Version, err)
+		}
+	}
+	s := &Schema{
+		ID:         r.nextID,
+		Subject:    subject,
+		Version:    len(versions) + 1,
+		Type:       typ,
+		Definition: def,
+		Message:    message,
+		parsed:     parsed,
+	}
+	// 別のサブジェクトに同じ定義のスキーマがあれば、そのIDを使う
+	for _, other := range r.ids {
+		if other.same(typ, def, message) {
+			s.ID = other.ID
+			break
+		}
+	}
+	if err = r.write(&entry{Schema: s}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) same(typ Type, def []byte, message string) bool {
+	return s.Type == typ && s.Message == message && bytes.Equal(s.Definition, def)
+}
+
+// 互換性の設定に従って、latestの次のバージョンとしてparsedを登録できるかを調べる
+func checkCompatibility(c Compatibility, latest *Schema, typ Type, parsed definition) error {
+	if c == CompatibilityNone {
+		return nil
+	}
+	if latest.Type != typ {
+		return fmt.Errorf("schema type changed from %s to %s: %w", latest.Type, typ, ErrIncompatibleSchema)
+	}
+	if c == CompatibilityBackward || c == CompatibilityFull {
+		if err := parsed.accepts(latest.parsed); err != nil {
+			return fmt.Errorf("backward: %v: %w", err, ErrIncompatibleSchema)
+		}
+	}
+	if c == CompatibilityForward || c == CompatibilityFull {
+		if err := latest.parsed.accepts(parsed); err != nil {
+			return fmt.Errorf("forward: %v: %w", err, ErrIncompatibleSchema)
+		}
+	}
+	return nil
+}
+
+// IDのスキーマを返す
+func (r *Registry) Schema(id uint64) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.ids[id]
+	if !ok {
+		return nil, fmt.Errorf("id %d: %w", id, ErrSchemaNotFound)
+	}
+	return s, nil
+}
+
+// subjectのバージョンのスキーマを返す
+// versionが0の場合は最新のバージョンを返す
+func (r *Registry) Version(subject string, version int) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions, ok := r.subjects[subject]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", subject, ErrSubjectNotFound)
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	if version < 0 || version > len(versions) {
+		return nil, fmt.Errorf("subject %s version %d: %w", subject, version, ErrSchemaNotFound)
+	}
+	return versions[version-1], nil
+}
+
+// subjectに登録したバージョンを古い順に返す
+func (r *Registry) Versions(subject string) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemas, ok := r.subjects[subject]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", subject, ErrSubjectNotFound)
+	}
+	versions := make([]int, len(schemas))
+	for i, s := range schemas {
+		versions[i] = s.Version
+	}
+	return versions, nil
+}
+
+// スキーマを登録したサブジェクトを名前の順に返す
+func (r *Registry) Subjects() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subjects := make([]string, 0, len(r.subjects))
+	for subject := range r.subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// subjectの互換性の設定を返す
+func (r *Registry) Compatibility(subject string) Compatibility {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.compatibilityLocked(subject)
+}
+
+func (r *Registry) compatibilityLocked(subject string) Compatibility {
+	if c, ok := r.compatibility[subject]; ok {
+		return c
+	}
+	return DefaultCompatibility
+}
+
+// subjectの互換性を設定する
+// 設定は以降に登録するバージョンにだけ適用し、登録済みのバージョンは調べ直さない
+func (r *Registry) SetCompatibility(subject string, c Compatibility) error {
+	if !c.valid() {
+		return fmt.Errorf("unknown compatibility %q: %w", c, ErrInvalidSchema)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.write(&entry{Subject: subject, Compatibility: c})
+}
+
+// レコードのHeaderSchemaIDのヘッダーが指すスキーマに、レコードの値が合うかを調べる
+// ヘッダーが無いレコードは調べない
+func (r *Registry) Validate(record *api.Record) error {
+	v, ok := record.Header(HeaderSchemaID)
+	if !ok {
+		return nil
+	}
+	id, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header %q: %w", HeaderSchemaID, v, ErrInvalidRecord)
+	}
+	s, err := r.Schema(id)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, ErrInvalidRecord)
+	}
+	if err = s.parsed.validate(record.Value); err != nil {
+		return fmt.Errorf("schema %d: %v: %w", id, err, ErrInvalidRecord)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package schema_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/schema"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "string"},
+		"amount": {"type": "integer"},
+		"status": {"enum": ["paid", "due"]}
+	},
+	"required": ["id"]
+}`
+
+func TestRegistry(t *testing.T) {
+	testcases := map[string]func(t *testing.T, r *schema.Registry){
+		"register versions":        testRegisterVersions,
+		"reject incompatible":      testRejectIncompatible,
+		"validate records":         testValidateRecords,
+		"validate protobuf":        testValidateProtobuf,
+		"reject invalid schema":    testRejectInvalidSchema,
+		"share id across subjects": testShareSchemaID,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "schema-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			l, err := log.NewLog(dir, log.Config{})
+			require.NoError(t, err)
+			r, err := schema.NewRegistry(l)
+			require.NoError(t, err)
+
+			fn(t, r)
+			require.NoError(t, l.Close())
+		})
+	}
+}
+
+// 同じ定義は新しいバージョンにならず、互換性のある定義は新しいバージョンになるかテストする
+func testRegisterVersions(t *testing.T, r *schema.Registry) {
+	s1, err := r.Register("orders", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), s1.ID)
+	require.Equal(t, 1, s1.Version)
+
+	s, err := r.Register("orders", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	require.Equal(t, s1.ID, s.ID)
+
+	// 省略できるプロパティの追加と、列挙する値の追加は後方互換
+	s2, err := r.Register("orders", schema.TypeJSON, []byte(`{
+		"type": "object",
+		"properties": {
+			"id": {"type": "string"},
+			"amount": {"type": "number"},
+			"status": {"enum": ["paid", "due", "refunded"]},
+			"note": {"type": "string"}
+		},
+		"required": ["id"]
+	}`), "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), s2.ID)
+	require.Equal(t, 2, s2.Version)
+
+	versions, err := r.Versions("orders")
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, versions)
+	latest, err := r.Version("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, s2.ID, latest.ID)
+	require.Equal(t, []string{"orders"}, r.Subjects())
+
+	_, err = r.Version("users", 0)
+	require.True(t, errors.Is(err, schema.ErrSubjectNotFound))
+	_, err = r.Version("orders", 3)
+	require.True(t, errors.Is(err, schema.ErrSchemaNotFound))
+}
+
+// 互換性の設定に従って、互換性の無いバージョンを拒否するかテストする
+func testRejectIncompatible(t *testing.T, r *schema.Registry) {
+	_, err := r.Register("orders", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+
+	for name, def := range map[string]string{
+		"new required property": `{"type": "object", "properties": {"id": {"type": "string"}, "amount": {"type": "integer"}}, "required": ["id", "amount"]}`,
+		"narrowed type":         `{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`,
+		"removed enum value":    `{"type": "object", "properties": {"id": {"type": "string"}, "status": {"enum": ["paid"]}}, "required": ["id"]}`,
+		"closed content model":  `{"type": "object", "properties": {"id": {"type": "string"}}, "required": ["id"], "additionalProperties": false}`,
+	} {
+		_, err = r.Register("orders", schema.TypeJSON, []byte(def), "")
+		require.True(t, errors.Is(err, schema.ErrIncompatibleSchema), "%s: %v", name, err)
+	}
+
+	// 前方互換では、新しいスキーマで必須にしたプロパティを古いスキーマでも読み込める
+	require.NoError(t, r.SetCompatibility("orders", schema.CompatibilityForward))
+	require.Equal(t, schema.CompatibilityForward, r.Compatibility("orders"))
+	_, err = r.Register("orders", schema.TypeJSON, []byte(`{"type": "object", "properties": {"id": {"type": "string"}, "amount": {"type": "integer"}}, "required": ["id", "amount"]}`), "")
+	require.NoError(t, err)
+
+	require.NoError(t, r.SetCompatibility("orders", schema.CompatibilityNone))
+	_, err = r.Register("orders", schema.TypeJSON, []byte(`{"type": "string"}`), "")
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(r.SetCompatibility("orders", "SIDEWAYS"), schema.ErrInvalidSchema))
+}
+
+// ヘッダーで指定したスキーマに合わないレコードを拒否するかテストする
+func testValidateRecords(t *testing.T, r *schema.Registry) {
+	s, err := r.Register("orders", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	id := []byte("1")
+	require.Equal(t, uint64(1), s.ID)
+
+	for value, valid := range map[string]bool{
+		`{"id": "a", "amount": 3, "status": "paid"}`: true,
+		`{"id": "a", "extra": true}`:                 true,
+		`{"amount": 3}`:                              false,
+		`{"id": "a", "amount": 1.5}`:                 false,
+		`{"id": "a", "status": "lost"}`:              false,
+		`not json`:                                   false,
+	} {
+		record := &api.Record{Value: []byte(value)}
+		record.SetHeader(schema.HeaderSchemaID, id)
+		err = r.Validate(record)
+		if valid {
+			require.NoError(t, err, value)
+		} else {
+			require.True(t, errors.Is(err, schema.ErrInvalidRecord), "%s: %v", value, err)
+		}
+	}
+
+	// ヘッダーが無いレコードは調べない
+	require.NoError(t, r.Validate(&api.Record{Value: []byte("not json")}))
+
+	record := &api.Record{Value: []byte(`{"id": "a"}`)}
+	record.SetHeader(schema.HeaderSchemaID, []byte("2"))
+	require.True(t, errors.Is(r.Validate(record), schema.ErrInvalidRecord))
+}
+
+// protobufのメッセージのスキーマでレコードを調べ、フィールドの型の変更を拒否するかテストする
+func testValidateProtobuf(t *testing.T, r *schema.Registry) {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(api.File_api_log_v1_log_proto)},
+	}
+	def, err := proto.Marshal(set)
+	require.NoError(t, err)
+	s, err := r.Register("records", schema.TypeProtobuf, def, "api.log.v1.Record")
+	require.NoError(t, err)
+
+	value, err := proto.Marshal(&api.Record{Value: []byte("hello"), Offset: 1})
+	require.NoError(t, err)
+	record := &api.Record{Value: value}
+	record.SetHeader(schema.HeaderSchemaID, []byte("1"))
+	require.NoError(t, r.Validate(record))
+	// valueフィールドの長さが足りない
+	record.Value = []byte{0x0a, 0x05, 'h'}
+	require.True(t, errors.Is(r.Validate(record), schema.ErrInvalidRecord))
+
+	// offsetをstringに変えると、古いレコードを読み込めない
+	fd := protodesc.ToFileDescriptorProto(api.File_api_log_v1_log_proto)
+	for _, m := range fd.MessageType {
+		if m.GetName() != "Record" {
+			continue
+		}
+		for _, f := range m.Field {
+			if f.GetName() == "offset" {
+				f.Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+			}
+		}
+	}
+	changed, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	require.NoError(t, err)
+	_, err = r.Register("records", schema.TypeProtobuf, changed, "api.log.v1.Record")
+	require.True(t, errors.Is(err, schema.ErrIncompatibleSchema), "%v", err)
+
+	_, err = r.Register("records", schema.TypeProtobuf, def, "api.log.v1.Missing")
+	require.True(t, errors.Is(err, schema.ErrInvalidSchema))
+	require.Equal(t, uint64(1), s.ID)
+}
+
+// ログからレジストリを読み込み直せるかテストする
+func TestRegistryRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	r, err := schema.NewRegistry(l)
+	require.NoError(t, err)
+	_, err = r.Register("orders", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	require.NoError(t, r.SetCompatibility("orders", schema.CompatibilityFull))
+	_, err = r.Register("users", schema.TypeJSON, []byte(`{"type": "object"}`), "")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l, err = log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	r, err = schema.NewRegistry(l)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "users"}, r.Subjects())
+	require.Equal(t, schema.CompatibilityFull, r.Compatibility("orders"))
+	s, err := r.Schema(2)
+	require.NoError(t, err)
+	require.Equal(t, "users", s.Subject)
+
+	// 読み込み直したスキーマでも調べられ、IDは続きから付く
+	record := &api.Record{Value: []byte(`{}`)}
+	record.SetHeader(schema.HeaderSchemaID, []byte("1"))
+	require.True(t, errors.Is(r.Validate(record), schema.ErrInvalidRecord))
+	s, err = r.Register("events", schema.TypeJSON, []byte(`{"type": "array"}`), "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.ID)
+}
+
+// 解析できないスキーマを拒否するかテストする
+func testRejectInvalidSchema(t *testing.T, r *schema.Registry) {
+	for _, def := range []string{`not json`, `{"type": "decimal"}`, `{"type": 1}`, `{"additionalProperties": {}}`} {
+		_, err := r.Register("orders", schema.TypeJSON, []byte(def), "")
+		require.True(t, errors.Is(err, schema.ErrInvalidSchema), "%s: %v", def, err)
+	}
+	_, err := r.Register("orders", "AVRO", []byte(`{}`), "")
+	require.True(t, errors.Is(err, schema.ErrInvalidSchema))
+	_, err = r.Register("orders", schema.TypeProtobuf, []byte("junk"), "")
+	require.True(t, errors.Is(err, schema.ErrInvalidSchema))
+	require.Empty(t, r.Subjects())
+}
+
+// 同じ定義を別のサブジェクトに登録すると、同じIDになるかテストする
+func testShareSchemaID(t *testing.T, r *schema.Registry) {
+	a, err := r.Register("a", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	b, err := r.Register("b", schema.TypeJSON, []byte(orderSchema), "")
+	require.NoError(t, err)
+	require.Equal(t, a.ID, b.ID)
+	require.Equal(t, "b", b.Subject)
+	s, err := r.Schema(a.ID)
+	require.NoError(t, err)
+	require.Equal(t, "a", s.Subject)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+)
+
+// レコードを追加したことをプロデューサーに応答するまでに、どこまで永続化するか
+type AckLevel string
+
+const (
+	// 追加を待たずに応答する
+	// 追加に失敗してもプロデューサーには伝わらない
+	AckNone AckLevel = "none"
+	// リーダーのログに追加したら応答する
+	// 追加したレコードはOSのバッファにあるので、リーダーのOSがクラッシュすると失われることがある
+	AckLeaderLocal AckLevel = "leader-local"
+	// リーダーのストレージに同期してから応答する
+	AckLeaderFsync AckLevel = "leader-fsync"
+	// リーダーのストレージに同期し、過半数のレプリカに複製されてから応答する
+	AckQuorum AckLevel = "quorum"
+)
+
+// AckTimeoutを指定しなかったときに、複製を待つ時間
+const defaultAckTimeout = 10 * time.Second
+
+// 過半数のレプリカに複製できないときに返すエラー
+var ErrNotEnoughReplicas = errors.New("not enough replicas")
+
+// Replicatorを指定していないサーバーにacks=quorumで追加しようとしたときに返すエラー
+var errReplicationDisabled = errors.New("replication is not configured")
+
+// リーダーに追加したレコードをレプリカに複製する
+// 過半数のレプリカに複製したレコードは、Log.SetHighWatermarkでコンシューマーが読み込めるようにする
+// acks=quorumで追加したレコードは、WaitForQuorumが戻った後にサーバーがQuorumOffsetまでハイウォーターマークを進める
+type Replicator interface {
+	// offまでのレコードを過半数のレプリカが永続化するまで待つ
+	// 同期しているレプリカが過半数に満たない場合は、待たずにErrNotEnoughReplicasを返す
+	WaitForQuorum(ctx context.Context, off uint64) error
+	// 同期しているレプリカが永続化したレコードの次のオフセットのうち、最小のものを返す
+	// このオフセットより前のレコードは、すべて過半数のレプリカに複製されている
+	QuorumOffset() uint64
+}
+
+// acksの値をAckLevelに変換する
+// 空の場合はAckLeaderLocalを返す
+// Replicatorを指定していない場合、レコードを追加してから失敗しないように、acks=quorumはここで拒否する
+func (s *httpServer) parseAckLevel(v string) (AckLevel, error) {
+	switch level := AckLevel(v); level {
+	case "":
+		return AckLeaderLocal, nil
+	case AckNone, AckLeaderLocal, AckLeaderFsync:
+		return level, nil
+	case AckQuorum:
+		if s.Config.Replicator == nil {
+			return "", fmt.Errorf("acks=%s: %w", v, errReplicationDisabled)
+		}
+		return level, nil
+	default:
+		return "", fmt.Errorf("invalid acks: %s", v)
+	}
+}
+
+// レコードを追加し、levelに従って永続化されるのを待つ
+// 待っている間にエラーになった場合でも、レコードはリーダーのログに追加されている
+// levelはparseAckLevelで変換したものでなければならない
+func (s *httpServer) produce(ctx context.Context, record *api.Record, level AckLevel) (uint64, error) {
+	off, err := s.Log.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	if level == AckNone || level == AckLeaderLocal {
+		return off, nil
+	}
+	if err = s.Log.Sync(); err != nil {
+		return off, fmt.Errorf("record %d appended but not synced: %w", off, err)
+	}
+	if level == AckLeaderFsync {
+		return off, nil
+	}
+	timeout := s.Config.AckTimeout
+	if timeout == 0 {
+		timeout = defaultAckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err = s.Config.Replicator.WaitForQuorum(ctx, off); err != nil {
+		return off, fmt.Errorf("record %d appended but not replicated: %w", off, err)
+	}
+	// 過半数に複製したレコードは、リーダーが替わっても失われないのでコンシューマーが読み込めるようにする
+	// 複製の確認は順番どおりに届くとは限らないので、off+1ではなく、前のレコードもすべて複製されたオフセットまで進める
+	// 複製していないログはハイウォーターマークが常に末尾にあるので、進める必要はない
+	if !s.Log.Config.Replication.Enabled {
+		return off, nil
+	}
+	if err = s.Log.SetHighWatermark(s.Config.Replicator.QuorumOffset()); err != nil {
+		return off, fmt.Errorf("record %d replicated but high watermark not advanced: %w", off, err)
+	}
+	return off, nil
+}
+
+// 追加したレコードを要求どおりに永続化できなかったときのステータスコードを返す
+// 複製が間に合わなかったときはプロデューサーがリトライできるように、サーバーのエラーと区別する
+func ackErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotEnoughReplicas):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return produceErrorStatus(err)
+	}
+}
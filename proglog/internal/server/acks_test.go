@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"context"
+	stdlog "log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// レプリカへの複製を、WaitForQuorumを呼び出したときの関数で置き換える
+type replicatorFunc func(ctx context.Context, off uint64) error
+
+func (f replicatorFunc) WaitForQuorum(ctx context.Context, off uint64) error {
+	return f(ctx, off)
+}
+
+// ハイウォーターマークは進めない
+func (f replicatorFunc) QuorumOffset() uint64 {
+	return 0
+}
+
+// 要求した永続化のレベルに従って応答し、満たせないときはエラーになるかテストする
+func TestAckLevels(t *testing.T) {
+	replicated := replicatorFunc(func(ctx context.Context, off uint64) error { return nil })
+	lagging := replicatorFunc(func(ctx context.Context, off uint64) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	unavailable := replicatorFunc(func(ctx context.Context, off uint64) error { return server.ErrNotEnoughReplicas })
+
+	testcases := map[string]struct {
+		replicator server.Replicator
+		acks       string
+		status     int
+	}{
+		"default":                      {acks: "", status: http.StatusCreated},
+		"none":                         {acks: "none", status: http.StatusAccepted},
+		"leader-local":                 {acks: "leader-local", status: http.StatusCreated},
+		"leader-fsync":                 {acks: "leader-fsync", status: http.StatusCreated},
+		"quorum":                       {replicator: replicated, acks: "quorum", status: http.StatusCreated},
+		"quorum without replicator":    {acks: "quorum", status: http.StatusBadRequest},
+		"quorum with too few replicas": {replicator: unavailable, acks: "quorum", status: http.StatusServiceUnavailable},
+		"quorum timeout":               {replicator: lagging, acks: "quorum", status: http.StatusGatewayTimeout},
+		"invalid":                      {acks: "all", status: http.StatusBadRequest},
+	}
+
+	for scenario, tc := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			url := newTestServer(t, server.Config{Replicator: tc.replicator, AckTimeout: 50 * time.Millisecond})
+			res := do(t, http.MethodPost, url+"/records?acks="+tc.acks, "application/json", `{"value":"aGVsbG8="}`, "")
+			require.Equal(t, tc.status, res.StatusCode)
+			// 拒否したリクエストのレコードは追加しない
+			if tc.status == http.StatusBadRequest {
+				res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+				require.Equal(t, http.StatusNotFound, res.StatusCode)
+				return
+			}
+
+			// 永続化を待てなかった場合も、レコードはリーダーのログに追加されている
+			// acks=noneでは応答の後に追加されるので、追加されるまで待つ
+			require.Eventually(t, func() bool {
+				res := do(t, http.MethodGet, url+"/records/0", "", "", "")
+				return res.StatusCode == http.StatusOK
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// ログに書き込まれた行を送るio.Writer
+type logWriter chan string
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// acks=noneで応答した後に追加に失敗すると、ErrorLogに記録するかテストする
+func TestAckNoneError(t *testing.T) {
+	logs := make(logWriter, 1)
+	url := newTestServer(t, server.Config{ErrorLog: stdlog.New(logs, "", 0)})
+
+	res := do(t, http.MethodPost, url+"/records?acks=none", "application/json", `{"value":"aGVsbG8=","producer_id":"p"}`, "")
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	// シーケンス番号が飛んでいるので、応答した後の追加は失敗する
+	res = do(t, http.MethodPost, url+"/records?acks=none", "application/json", `{"value":"aGVsbG8=","producer_id":"p","sequence":2}`, "")
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	select {
+	case line := <-logs:
+		require.Contains(t, line, "out of order sequence")
+	case <-time.After(5 * time.Second):
+		t.Fatal("produce error was not logged")
+	}
+}
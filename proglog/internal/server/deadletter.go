@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+
+	"github.com/gorilla/mux"
+)
+
+// デッドレターログのAPIのルートを登録する
+func (s *httpServer) registerDeadLetterRoutes(r *mux.Router) {
+	r.HandleFunc("/records/{offset:[0-9]+}/dead-letter", s.handleDeadLetter).Methods(http.MethodPost)
+	r.HandleFunc("/dead-letter/records", s.handleConsumeDeadLetters).Methods(http.MethodGet)
+}
+
+type DeadLetterRequest struct {
+	// レコードを処理できなかった理由
+	Reason string `json:"reason"`
+}
+
+type DeadLetterResponse struct {
+	// デッドレターログに追加したレコードのオフセット
+	Offset uint64 `json:"offset"`
+}
+
+// ログのレコードを、元のオフセット、ログの名前、理由をヘッダーに加えてデッドレターログに追加する
+// 元のログのレコードはそのまま残るので、コンシューマーはこのレコードの次から読み進めればよい
+func (s *httpServer) handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	off, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %w", err))
+		return
+	}
+	var req DeadLetterRequest
+	if err = json.NewDecoder(limitBody(w, r)).Decode(&req); err != nil {
+		writeError(w, bodyErrorStatus(err), fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, errors.New("reason is required"))
+		return
+	}
+	record, err := s.Log.Read(off)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	dlOff, err := s.Config.DeadLetter.Append(deadletter.Record(record, s.Config.Topic, req.Reason))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, DeadLetterResponse{Offset: dlOff})
+}
+
+// デッドレターログのレコードを、GET /recordsと同じパラメーターでまとめて返す
+func (s *httpServer) handleConsumeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	s.consumeRecords(w, r, s.Config.DeadLetter)
+}
@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/deadletter"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// 処理できなかったレコードが、元のオフセットと理由とともにデッドレターログに追加されるかテストする
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letter-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dl, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer dl.Close()
+	url := newTestServer(t, server.Config{DeadLetter: dl, Topic: "orders"})
+
+	for i := 0; i < 2; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8=","headers":[{"key":"trace-id","value":"YQ=="}]}`, "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	res := do(t, http.MethodPost, url+"/records/1/dead-letter", "application/json", `{"reason":"bad payload"}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var moved server.DeadLetterResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&moved))
+	require.Equal(t, uint64(0), moved.Offset)
+
+	res = do(t, http.MethodGet, url+"/dead-letter/records", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var page server.ConsumeRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	require.Len(t, page.Records, 1)
+	require.Equal(t, []byte("hello"), page.Records[0].Value)
+	require.Equal(t, []server.Header{
+		{Key: "trace-id", Value: []byte("a")},
+		{Key: deadletter.HeaderOriginalOffset, Value: []byte("1")},
+		{Key: deadletter.HeaderOriginalTopic, Value: []byte("orders")},
+		{Key: deadletter.HeaderReason, Value: []byte("bad payload")},
+	}, page.Records[0].Headers)
+
+	res = do(t, http.MethodPost, url+"/records/2/dead-letter", "application/json", `{"reason":"bad payload"}`, "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(t, http.MethodPost, url+"/records/0/dead-letter", "application/json", `{}`, "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// deliver_atを指定したレコードが、その時刻になるまで読み込めないかテストする
+func TestDelayedDelivery(t *testing.T) {
+	l := newTestLog(t, log.Config{})
+	url := newTestServerWithLog(t, l, server.Config{})
+
+	at := time.Now().Add(200 * time.Millisecond).UTC()
+	body, err := json.Marshal(server.Record{Value: []byte("hello"), DeliverAt: &at})
+	require.NoError(t, err)
+	res := do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	// クライアントが付けたヘッダーでは配信を取り消せない
+	body, err = json.Marshal(server.Record{
+		Value:   []byte("forged"),
+		Headers: []server.Header{{Key: log.HeaderDelayedOffset, Value: []byte("0")}},
+	})
+	require.NoError(t, err)
+	res = do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	page := consumeRecords(t, url+"/records")
+	require.Len(t, page.Records, 1)
+	require.Equal(t, []byte("forged"), page.Records[0].Value)
+	require.Empty(t, page.Records[0].Headers)
+	require.Equal(t, []server.Gap{{From: 0, To: 1}}, page.Gaps)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.RunScheduler(ctx)
+	require.Eventually(t, func() bool {
+		return len(consumeRecords(t, url+"/records?offset=2").Records) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	require.False(t, time.Now().Before(at))
+	record := consumeRecords(t, url+"/records?offset=2").Records[0]
+	require.Equal(t, []byte("hello"), record.Value)
+	require.Nil(t, record.DeliverAt)
+	require.Equal(t, []server.Header{{Key: log.HeaderDelayedOffset, Value: []byte("0")}}, record.Headers)
+}
+
+func consumeRecords(t *testing.T, url string) *server.ConsumeRecordsResponse {
+	t.Helper()
+	res := do(t, http.MethodGet, url, "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var page server.ConsumeRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	return &page
+}
@@ -0,0 +1,10 @@
+package server
+
+import "time"
+
+// Server-Sent Eventsのキープアライブの間隔をdにし、元に戻す関数を返す
+func ExportSetStreamKeepAliveInterval(d time.Duration) func() {
+	prev := streamKeepAliveInterval
+	streamKeepAliveInterval = d
+	return func() { streamKeepAliveInterval = prev }
+}
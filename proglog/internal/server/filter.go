@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/filter"
+)
+
+// レコードを読み込むときに、フィルターで調べるレコードの数の上限
+// 条件に合うレコードが少なくても、一度のリクエストで読み込む時間が長くなりすぎないようにする
+const maxConsumeScan = 100000
+
+// 購読で読み飛ばしたことを知らせずに読み飛ばせるレコードの数
+// これを超えると、レコードを送らなくても読み飛ばした範囲を知らせて、クライアントが進捗を記録できるようにする
+const maxSkippedRecords = 1000
+
+// 読み飛ばしたレコードのオフセットの範囲
+// Fromから、Toを含まないToの手前までのオフセットになる
+type Gap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// filterパラメーターの式とConsumeFiltersを合わせて、レコードを返すかどうかを決める関数を返す
+// 式が空の場合はConsumeFiltersだけで決める
+func (s *httpServer) consumeFilter(ctx context.Context, expr string) (func(*api.Record) bool, error) {
+	var f *filter.Filter
+	if expr != "" {
+		var err error
+		if f, err = filter.Parse(expr); err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	return func(record *api.Record) bool {
+		if f != nil && !f.Match(record) {
+			return false
+		}
+		return s.accept(ctx, record)
+	}, nil
+}
+
+// 購読で読み飛ばしたレコードの範囲を追跡する
+type gapTracker struct {
+	// 最後に送ったレコードか、最後に知らせた範囲の次のオフセット
+	next uint64
+}
+
+// レコードを送ったことを記録する
+func (t *gapTracker) sent(off uint64) {
+	t.next = off + 1
+}
+
+// イテレータが次にoffを読み込むときに、知らせるべき読み飛ばした範囲を返す
+// 末尾に達したときは読み飛ばした範囲をすべて返し、それ以外では読み飛ばしたレコードがmaxSkippedRecordsに達したときだけ返す
+func (t *gapTracker) gap(off uint64, eof bool) (Gap, bool) {
+	if off <= t.next || (!eof && off-t.next < maxSkippedRecords) {
+		return Gap{}, false
+	}
+	g := Gap{From: t.next, To: off}
+	t.next = off
+	return g, true
+}
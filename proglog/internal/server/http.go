@@ -1,90 +1,672 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/queue"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/schema"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/gorilla/mux"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// 一度のリクエストで返すレコードの数とバイト数の上限
+const (
+	maxConsumeRecords = 1000
+	maxConsumeBytes   = 1 << 20
+)
+
+// 追加するレコードのリクエストボディの大きさの上限
+const maxProduceBytes = 1 << 20
+
+// リクエストとレスポンスのボディの形式
+const (
+	contentTypeJSON        = "application/json"
+	contentTypeOctetStream = "application/octet-stream"
+	contentTypeProtobuf    = "application/x-protobuf"
+)
+
+// レコードを追加する前に呼び出す関数
+// レコードを書き換えることができ、エラーを返すとレコードを追加せずにリクエストを拒否する
+type ProduceInterceptor func(ctx context.Context, record *api.Record) error
+
+// レコードを返す前に呼び出す関数
+// falseを返したレコードはクライアントに返さない
+type ConsumeFilter func(ctx context.Context, record *api.Record) bool
+
+type Config struct {
+	// レコードを追加する前に、指定した順に呼び出す
+	ProduceInterceptors []ProduceInterceptor
+	// レコードを返す前に呼び出し、すべてがtrueを返したレコードだけを返す
+	ConsumeFilters []ConsumeFilter
+	// 指定すると、スキーマレジストリのAPIを提供し、
+	// schema-idヘッダーを持つレコードを追加するときにそのスキーマに合うかを調べる
+	Schemas *schema.Registry
+	// 指定すると、コンシューマーが処理できなかったレコードを退避するAPIを提供する
+	DeadLetter *log.Log
+	// デッドレターログのレコードに、元のログの名前として記録する
+	Topic string
+	// 指定すると、acks=quorumで追加したレコードを過半数のレプリカに複製するまで応答を待つ
+	// nilの場合、acks=quorumの追加はレコードを追加せずに400で拒否する
+	// 複製したレコードだけをコンシューマーに返すには、ログのConfig.Replication.Enabledも有効にする
+	Replicator Replicator
+	// acks=quorumで複製を待つ時間
+	// 0の場合は10秒にする
+	AckTimeout time.Duration
+	// 指定すると、ログのレコードをリースしてAckするワークキューのAPIを提供する
+	Queue *queue.Queue
+	// acks=noneで追加に失敗したときのように、クライアントに返せないエラーを記録する
+	// nilの場合は標準のロガーを使う
+	ErrorLog *stdlog.Logger
+}
+
+func NewHTTPServer(addr string, commitLog *log.Log, config Config) *http.Server {
+	httpsrv := newHTTPServer(commitLog, config)
 	r := mux.NewRouter()
-	r.HandleFunc("/", httpsrv.handleProduce).Methods(http.MethodPost)
-	r.HandleFunc("/", httpsrv.handleConsume).Methods(http.MethodGet)
+	r.HandleFunc("/records", httpsrv.handleProduce).Methods(http.MethodPost)
+	r.HandleFunc("/records", httpsrv.handleConsumeRecords).Methods(http.MethodGet)
+	r.HandleFunc("/records/{offset:[0-9]+}", httpsrv.handleConsume).Methods(http.MethodGet)
+	r.HandleFunc("/stream", httpsrv.handleStream).Methods(http.MethodGet)
+	r.HandleFunc("/ws", httpsrv.handleWebSocket).Methods(http.MethodGet)
+	if config.Schemas != nil {
+		httpsrv.registerSchemaRoutes(r)
+	}
+	if config.DeadLetter != nil {
+		httpsrv.registerDeadLetterRoutes(r)
+	}
+	if config.Queue != nil {
+		httpsrv.registerQueueRoutes(r)
+	}
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %s", r.Method, r.URL.Path))
+	})
 	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+		Addr:     addr,
+		Handler:  r,
+		ErrorLog: config.ErrorLog,
 	}
 }
 
 type httpServer struct {
-	Log *Log
+	Log    *log.Log
+	Config Config
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(commitLog *log.Log, config Config) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log:    commitLog,
+		Config: config,
+	}
+}
+
+// クライアントに返せないエラーをConfig.ErrorLogに記録する
+func (s *httpServer) logf(format string, args ...interface{}) {
+	if s.Config.ErrorLog != nil {
+		s.Config.ErrorLog.Printf(format, args...)
+		return
+	}
+	stdlog.Printf(format, args...)
+}
+
+// レコードを追加する前にインターセプターを呼び出す
+func (s *httpServer) intercept(ctx context.Context, record *api.Record) error {
+	for _, interceptor := range s.Config.ProduceInterceptors {
+		if err := interceptor(ctx, record); err != nil {
+			return fmt.Errorf("record rejected: %w", err)
+		}
+	}
+	return nil
+}
+
+// レコードをクライアントに返すかどうかをフィルターで決める
+func (s *httpServer) accept(ctx context.Context, record *api.Record) bool {
+	for _, filter := range s.Config.ConsumeFilters {
+		if !filter(ctx, record) {
+			return false
+		}
+	}
+	return true
+}
+
+type Record struct {
+	Value  []byte `json:"value"`
+	Offset uint64 `json:"offset"`
+	// レコードのキー
+	// filterパラメーターの式でkeyとして参照できる
+	Key []byte `json:"key,omitempty"`
+	// 冪等なプロデューサーのIDとシーケンス番号
+	// リトライしたリクエストが重複して追加されないように、プロデューサーはシーケンス番号を1ずつ増やして送る
+	ProducerID string `json:"producer_id,omitempty"`
+	Sequence   uint64 `json:"sequence,omitempty"`
+	// レコードを追加したトランザクションのIDと、制御レコードの種類(commitかabort)
+	// 読み込むときだけ使い、追加するときは無視する
+	TransactionID string `json:"transaction_id,omitempty"`
+	Control       string `json:"control,omitempty"`
+	// レコードのヘッダー
+	// 同じキーのヘッダーを複数持つこともでき、追加したときの並びのまま返す
+	Headers []Header `json:"headers,omitempty"`
+	// 指定すると、この時刻になるまでコンシューマーに配信しない
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// 指定すると、この時刻を過ぎたらコンシューマーに返さない
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// レコードのヘッダー
+// 値はバイト列なので、JSONではBase64で表す
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newRecord(record *api.Record) Record {
+	r := Record{
+		Value:         record.Value,
+		Offset:        record.Offset,
+		Key:           record.Key,
+		ProducerID:    record.ProducerId,
+		Sequence:      record.Sequence,
+		TransactionID: record.TransactionId,
+	}
+	if record.Control != api.ControlType_CONTROL_TYPE_UNSPECIFIED {
+		r.Control = strings.ToLower(strings.TrimPrefix(record.Control.String(), "CONTROL_TYPE_"))
+	}
+	r.DeliverAt = unixTime(record.DeliverAt)
+	r.ExpiresAt = unixTime(record.ExpiresAt)
+	for _, h := range record.Headers {
+		r.Headers = append(r.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return r
+}
+
+func (r Record) proto() *api.Record {
+	record := &api.Record{
+		Value:      r.Value,
+		Key:        r.Key,
+		ProducerId: r.ProducerID,
+		Sequence:   r.Sequence,
+	}
+	if r.DeliverAt != nil {
+		record.DeliverAt = r.DeliverAt.UnixNano()
+	}
+	if r.ExpiresAt != nil {
+		record.ExpiresAt = r.ExpiresAt.UnixNano()
 	}
+	for _, h := range r.Headers {
+		record.AddHeader(h.Key, h.Value)
+	}
+	return record
 }
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
+// レコードのUnix時間のナノ秒を時刻にする
+// 0の場合は指定されていないのでnilを返す
+func unixTime(nsec int64) *time.Time {
+	if nsec == 0 {
+		return nil
+	}
+	t := time.Unix(0, nsec).UTC()
+	return &t
 }
 
+// application/octet-streamのリクエストで、プロデューサーのIDとシーケンス番号、
+// 配信する時刻と有効期限(RFC 3339)を指定するヘッダー
+const (
+	headerProducerID       = "X-Producer-Id"
+	headerProducerSequence = "X-Producer-Sequence"
+	headerDeliverAt        = "X-Deliver-At"
+	headerExpiresAt        = "X-Expires-At"
+)
+
+// GET /records/{offset}の応答で、コンシューマーが遅れを測れるように返すヘッダー
+const (
+	headerHighWatermark = "X-High-Watermark"
+	headerLogEndOffset  = "X-Log-End-Offset"
+)
+
 type ProduceResponse struct {
 	Offset uint64 `json:"offset"`
 }
 
+// リクエストボディのレコードを追加する
+// Content-Typeがapplication/octet-streamの場合はボディ全体を、application/x-protobufの場合はapi.Recordを、
+// それ以外の場合はJSONのRecordをレコードとして読み込む
+// 冪等なプロデューサーが重複して送ったレコードは追加せず、元のレコードのオフセットを返す
+// ヘッダーで指定したスキーマに合わないレコードは追加せずに422を返す
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	level, err := s.parseAckLevel(r.URL.Query().Get("acks"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	record, err := readRecord(limitBody(w, r), r.Header)
+	if errors.Is(err, errUnsupportedMediaType) {
+		writeError(w, http.StatusUnsupportedMediaType, err)
 		return
 	}
-	off, err := s.Log.Append(req.Record)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, bodyErrorStatus(err), err)
 		return
 	}
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
+	if err = s.intercept(r.Context(), record); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = s.validate(record); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	// 追加を待たずに応答するので、追加に失敗してもプロデューサーには伝わらず、ErrorLogに記録するだけにする
+	// 応答した後はリクエストのコンテキストがキャンセルされることがあるので使わない
+	if level == AckNone {
+		w.WriteHeader(http.StatusAccepted)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if _, err = s.produce(context.Background(), record, level); err != nil {
+			s.logf("failed to produce record with acks=none: %v", err)
+		}
+		return
+	}
+	off, err := s.produce(r.Context(), record, level)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, ackErrorStatus(err), err)
 		return
 	}
+	w.Header().Set("Location", fmt.Sprintf("/records/%d", off))
+	writeJSON(w, http.StatusCreated, ProduceResponse{Offset: off})
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+// Content-Typeに従ってリクエストボディからレコードを読み込む
+func readRecord(body io.Reader, header http.Header) (*api.Record, error) {
+	mediaType := contentTypeJSON
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("%s: %w", contentType, errUnsupportedMediaType)
+		}
+	}
+	switch mediaType {
+	case contentTypeOctetStream:
+		value, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		record := &api.Record{Value: value, ProducerId: header.Get(headerProducerID)}
+		if seq := header.Get(headerProducerSequence); seq != "" {
+			if record.Sequence, err = strconv.ParseUint(seq, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", headerProducerSequence, err)
+			}
+		}
+		if record.DeliverAt, err = parseTimeHeader(header, headerDeliverAt); err != nil {
+			return nil, err
+		}
+		if record.ExpiresAt, err = parseTimeHeader(header, headerExpiresAt); err != nil {
+			return nil, err
+		}
+		return record, nil
+	case contentTypeProtobuf:
+		p, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal record: %w", err)
+		}
+		// オフセットとトランザクションはログが決めるので、リクエストで指定されたものは使わない
+		// JSONのRecordと同じく、他のプロデューサーのトランザクションにレコードを加えたりできないようにする
+		record.Offset = 0
+		record.TransactionId = ""
+		record.Control = api.ControlType_CONTROL_TYPE_UNSPECIFIED
+		return record, nil
+	case contentTypeJSON:
+		var record Record
+		if err := json.NewDecoder(body).Decode(&record); err != nil {
+			return nil, fmt.Errorf("failed to decode record: %w", err)
+		}
+		return record.proto(), nil
+	default:
+		return nil, fmt.Errorf("%s: %w", mediaType, errUnsupportedMediaType)
+	}
 }
 
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+// RFC 3339の時刻のヘッダーを、Unix時間のナノ秒として読み込む
+// ヘッダーが無い場合は0を返す
+func parseTimeHeader(header http.Header, name string) (int64, error) {
+	v := header.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t.UnixNano(), nil
 }
 
+// レコードの追加に失敗したときのステータスコードを返す
+// シーケンス番号の誤りはプロデューサーが直すべきものなので、サーバーのエラーとは区別する
+func produceErrorStatus(err error) int {
+	if errors.Is(err, log.ErrOutOfOrderSequence) || errors.Is(err, log.ErrDuplicateSequence) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// 与えられたオフセットのレコードを返す
+// Acceptヘッダーに従って、JSONのRecord、api.Record、レコードの値そのもののいずれかで返す
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var req ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	off, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %w", err))
 		return
 	}
-	record, err := s.Log.Read(req.Offset)
-	if errors.Is(err, ErrOffsetNotFound) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	contentType, ok := negotiate(r, contentTypeJSON, contentTypeProtobuf, contentTypeOctetStream)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable, fmt.Errorf("%s: %w", r.Header.Get("Accept"), errUnsupportedMediaType))
+		return
+	}
+	w.Header().Set(headerHighWatermark, strconv.FormatUint(s.Log.HighWatermark(), 10))
+	w.Header().Set(headerLogEndOffset, strconv.FormatUint(s.Log.LogEndOffset(), 10))
+	// 複製されていないレコードは、リーダーが替わると失われることがあるのでLog.Readが返さない
+	record, err := s.Log.Read(off)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		writeError(w, http.StatusNotFound, err)
 		return
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !s.accept(r.Context(), record) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("offset: %d: record filtered", off))
+		return
+	}
+	// 遅延レコードは配信されるまで見せず、配信されると別のオフセットで読み込める
+	if record.DeliverAt != 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("offset: %d: record is delayed", off))
+		return
+	}
+	if record.ExpiresAt != 0 && record.ExpiresAt <= time.Now().UnixNano() {
+		writeError(w, http.StatusNotFound, fmt.Errorf("offset: %d: record expired", off))
 		return
 	}
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+	switch contentType {
+	case contentTypeOctetStream:
+		w.Header().Set("Content-Type", contentTypeOctetStream)
+		_, _ = w.Write(record.Value)
+	case contentTypeProtobuf:
+		p, err := proto.Marshal(record)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		_, _ = w.Write(p)
+	default:
+		writeJSON(w, http.StatusOK, newRecord(record))
+	}
+}
+
+type ConsumeRecordsResponse struct {
+	Records []Record `json:"records"`
+	// 次のリクエストで指定するオフセット
+	NextOffset uint64 `json:"next_offset"`
+	// コンシューマーが読み込めるレコードの上限のオフセット
+	// next_offsetとの差が、コンシューマーの遅れになる
+	HighWatermark uint64 `json:"high_watermark"`
+	// ログに次に追加されるレコードのオフセット
+	// high_watermarkとの差が、まだ複製されていないレコードの数になる
+	LogEndOffset uint64 `json:"log_end_offset"`
+	// フィルターなどで読み飛ばしたレコードのオフセットの範囲
+	Gaps []Gap `json:"gaps,omitempty"`
+}
+
+// offsetパラメーターから順に、ログの末尾かmax_recordsかmax_bytesに達するまでのレコードをまとめて返す
+// max_recordsとmax_bytesが無い場合やmaxConsumeRecordsとmaxConsumeBytesより大きい場合は、それらを上限にする
+// isolationパラメーターにread_committedを指定すると、コミットされたトランザクションのレコードだけを返す
+// Acceptヘッダーにapplication/x-protobufを指定すると、JSONでは失われる情報も含めてapi.RecordBatchで返す
+// filterパラメーターに式を指定すると、式を満たすレコードだけを返す
+// 読み飛ばしたレコードの範囲はgapsで返し、条件に合うレコードが無くてもnext_offsetはその先に進む
+func (s *httpServer) handleConsumeRecords(w http.ResponseWriter, r *http.Request) {
+	s.consumeRecords(w, r, s.Log)
+}
+
+// lからレコードをまとめて返す
+func (s *httpServer) consumeRecords(w http.ResponseWriter, r *http.Request, l *log.Log) {
+	query := r.URL.Query()
+	off, err := parseUintParam(query, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	maxRecords, err := parseUintParam(query, "max_records", maxConsumeRecords)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	maxBytes, err := parseUintParam(query, "max_bytes", maxConsumeBytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	isolation, err := parseIsolation(query.Get("isolation"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	accept, err := s.consumeFilter(r.Context(), query.Get("filter"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	if maxRecords == 0 || maxRecords > maxConsumeRecords {
+		maxRecords = maxConsumeRecords
+	}
+	if maxBytes == 0 || maxBytes > maxConsumeBytes {
+		maxBytes = maxConsumeBytes
+	}
+	contentType, ok := negotiate(r, contentTypeJSON, contentTypeProtobuf)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable, fmt.Errorf("%s: %w", r.Header.Get("Accept"), errUnsupportedMediaType))
+		return
+	}
+	rng, err := l.ReadRange(off, log.ReadOptions{
+		MaxRecords: int(maxRecords),
+		MaxBytes:   maxBytes,
+		Isolation:  isolation,
+		Filter:     accept,
+		MaxScan:    maxConsumeScan,
+	})
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if contentType == contentTypeProtobuf {
+		batch := &api.RecordBatch{
+			Records:       rng.Records,
+			NextOffset:    rng.NextOffset,
+			HighWatermark: rng.HighWatermark,
+			LogEndOffset:  rng.LogEndOffset,
+		}
+		for _, gap := range rng.Gaps {
+			batch.Gaps = append(batch.Gaps, &api.OffsetRange{From: gap.From, To: gap.To})
+		}
+		p, err := proto.Marshal(batch)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		_, _ = w.Write(p)
+		return
+	}
+	res := ConsumeRecordsResponse{
+		Records:       make([]Record, 0, len(rng.Records)),
+		NextOffset:    rng.NextOffset,
+		HighWatermark: rng.HighWatermark,
+		LogEndOffset:  rng.LogEndOffset,
+	}
+	for _, record := range rng.Records {
+		res.Records = append(res.Records, newRecord(record))
+	}
+	for _, gap := range rng.Gaps {
+		res.Gaps = append(res.Gaps, Gap{From: gap.From, To: gap.To})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// トランザクションのレコードをどう読み込むかを表す文字列を読み込む
+// 指定されていない場合はすべてのレコードを読み込む
+func parseIsolation(v string) (log.IsolationLevel, error) {
+	switch v {
+	case "", "read_uncommitted":
+		return log.ReadUncommitted, nil
+	case "read_committed":
+		return log.ReadCommitted, nil
+	default:
+		return 0, fmt.Errorf("invalid isolation: %s", v)
+	}
+}
+
+// isolationに従ってログのイテレータを作る
+func newIterator(l *log.Log, off uint64, isolation log.IsolationLevel) (*log.Iterator, error) {
+	if isolation == log.ReadCommitted {
+		return l.NewReadCommittedIterator(off)
+	}
+	return l.NewIterator(off)
+}
+
+// クエリパラメーターを符号なし整数として読み込む
+// パラメーターが無い場合はdefを返す
+func parseUintParam(query map[string][]string, name string, def uint64) (uint64, error) {
+	v, ok := query[name]
+	if !ok || len(v) == 0 || v[0] == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// リクエストボディやAcceptヘッダーの形式を扱えないときに返すエラー
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// リクエストボディがmaxProduceBytesより大きいときに返すエラー
+var errRequestTooLarge = errors.New("request body too large")
+
+// リクエストボディをmaxProduceBytesまでしか読み込まないリーダー
+// 上限を超えるとerrRequestTooLargeを返し、http.MaxBytesReaderが接続を閉じるようにする
+type maxBytesReader struct {
+	r    io.Reader
+	read int64
+}
+
+func limitBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	return &maxBytesReader{r: http.MaxBytesReader(w, r.Body, maxProduceBytes)}
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && m.read >= maxProduceBytes {
+		return n, fmt.Errorf("over %d bytes: %w", int64(maxProduceBytes), errRequestTooLarge)
+	}
+	return n, err
+}
+
+// リクエストボディを読み込めなかったときのステータスコードを返す
+func bodyErrorStatus(err error) int {
+	if errors.Is(err, errRequestTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Acceptヘッダーに従って、offersの中からレスポンスの形式を選ぶ
+// Acceptヘッダーが無い場合は最初の形式を選び、どれも受け入れられない場合はfalseを返す
+func negotiate(r *http.Request, offers ...string) (string, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0], true
+	}
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+		}
+	}
+	// 品質の値が同じものは、ヘッダーに書かれた順に優先する
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	for _, rng := range ranges {
+		for _, offer := range offers {
+			if rng.mediaType == offer || rng.mediaType == "*/*" ||
+				(strings.HasSuffix(rng.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(rng.mediaType, "*"))) {
+				return offer, true
+			}
+		}
+	}
+	return "", false
+}
+
+// エラーのレスポンスボディ
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	// not_foundのような、ステータスコードを表す文字列
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// エラーをJSONのErrorResponseとして書き込む
+func writeError(w http.ResponseWriter, status int, err error) {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	writeJSON(w, status, ErrorResponse{Error: Error{Code: code, Message: err.Error()}})
+}
+
+// vをJSONとして書き込む
+// ステータスコードを書き込んだ後はエラーを返せないので、エンコードのエラーは無視する
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
 }
@@ -0,0 +1,418 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHTTPServer(t *testing.T) {
+	testcases := map[string]func(t *testing.T, url string){
+		"produce and consume json":     testProduceConsumeJSON,
+		"produce and consume raw":      testProduceConsumeRaw,
+		"produce and consume protobuf": testProduceConsumeProtobuf,
+		"consume range":                testConsumeRange,
+		"idempotent produce":           testIdempotentProduce,
+		"error responses":              testErrorResponses,
+		"consume with filter":          testConsumeFilter,
+		"skip expired records":         testConsumeExpired,
+		"preserve headers":             testPreserveHeaders,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, newTestServer(t, server.Config{}))
+		})
+	}
+}
+
+// インターセプターがヘッダーを加えたりレコードを拒否したりでき、フィルターがレコードを隠せるかテストする
+func TestHTTPServerInterceptors(t *testing.T) {
+	url := newTestServer(t, server.Config{
+		ProduceInterceptors: []server.ProduceInterceptor{
+			func(ctx context.Context, record *api.Record) error {
+				if _, ok := record.Header("content-type"); !ok {
+					return errors.New("content-type header is required")
+				}
+				record.SetHeader("intercepted", []byte("true"))
+				return nil
+			},
+		},
+		ConsumeFilters: []server.ConsumeFilter{
+			func(ctx context.Context, record *api.Record) bool {
+				v, _ := record.Header("content-type")
+				return string(v) != "secret"
+			},
+		},
+	})
+
+	res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	for _, contentType := range []string{"text/plain", "secret", "text/plain"} {
+		body, err := json.Marshal(server.Record{
+			Value:   []byte("hello"),
+			Headers: []server.Header{{Key: "content-type", Value: []byte(contentType)}},
+		})
+		require.NoError(t, err)
+		res = do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var record server.Record
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&record))
+	require.Equal(t, []server.Header{
+		{Key: "content-type", Value: []byte("text/plain")},
+		{Key: "intercepted", Value: []byte("true")},
+	}, record.Headers)
+
+	res = do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/records", "", "", "")
+	var page server.ConsumeRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	require.Len(t, page.Records, 2)
+	require.Equal(t, uint64(2), page.Records[1].Offset)
+	require.Equal(t, uint64(3), page.NextOffset)
+}
+
+// ログを作り、そのログを使うサーバーを起動してURLを返す
+func newTestServer(t *testing.T, config server.Config) string {
+	t.Helper()
+	return newTestServerWithLog(t, newTestLog(t, log.Config{}), config)
+}
+
+// lを使うサーバーを起動してURLを返す
+func newTestServerWithLog(t *testing.T, l *log.Log, config server.Config) string {
+	t.Helper()
+	srv := httptest.NewServer(server.NewHTTPServer("", l, config).Handler)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// cの設定で一時ディレクトリにログを作る
+// ログとディレクトリはテストの終わりに閉じて削除する
+func newTestLog(t *testing.T, c log.Config) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func testProduceConsumeJSON(t *testing.T, url string) {
+	res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, "/records/0", res.Header.Get("Location"))
+	var produced server.ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&produced))
+	require.Equal(t, uint64(0), produced.Offset)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var record server.Record
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&record))
+	require.Equal(t, []byte("hello"), record.Value)
+}
+
+func testProduceConsumeRaw(t *testing.T, url string) {
+	res := do(t, http.MethodPost, url+"/records", "application/octet-stream", "hello", "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "application/octet-stream")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), body)
+}
+
+func testProduceConsumeProtobuf(t *testing.T, url string) {
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	res := do(t, http.MethodPost, url+"/records", "application/x-protobuf", string(p), "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "application/x-protobuf, application/json;q=0.5")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-protobuf", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var record api.Record
+	require.NoError(t, proto.Unmarshal(body, &record))
+	require.Equal(t, []byte("hello"), record.Value)
+}
+
+// api.Recordで指定したオフセットやトランザクションを無視して追加するかテストする
+func TestProduceProtobufServerFields(t *testing.T) {
+	l := newTestLog(t, log.Config{})
+	url := newTestServerWithLog(t, l, server.Config{})
+	tx, err := l.BeginTransaction("tx")
+	require.NoError(t, err)
+
+	for _, record := range []*api.Record{
+		{Value: []byte("hello"), Offset: 5, TransactionId: "tx"},
+		{Value: []byte("hello"), Control: api.ControlType_CONTROL_TYPE_COMMIT, TransactionId: "tx"},
+	} {
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+		res := do(t, http.MethodPost, url+"/records", "application/x-protobuf", string(p), "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	// 開いているトランザクションのレコードにはならないので、コミットする前でも読み込める
+	page := consumeRecords(t, url+"/records?isolation=read_committed")
+	require.Len(t, page.Records, 2)
+	for i, record := range page.Records {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Empty(t, record.TransactionID)
+		require.Empty(t, record.Control)
+	}
+	_, err = tx.Abort()
+	require.NoError(t, err)
+	require.Len(t, consumeRecords(t, url+"/records?isolation=read_committed").Records, 2)
+}
+
+func testConsumeRange(t *testing.T, url string) {
+	for i := 0; i < 5; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/octet-stream", "hello", "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	res := do(t, http.MethodGet, url+"/records?offset=1&max_records=3", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var page server.ConsumeRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	require.Len(t, page.Records, 3)
+	require.Equal(t, uint64(1), page.Records[0].Offset)
+	require.Equal(t, uint64(4), page.NextOffset)
+	require.Equal(t, uint64(5), page.HighWatermark)
+	require.Equal(t, uint64(5), page.LogEndOffset)
+}
+
+// セグメントをまたいでレコードを順に返し、削除されたオフセットは404になるかテストする
+func TestConsumeRecordsAcrossSegments(t *testing.T) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	l := newTestLog(t, c)
+	url := newTestServerWithLog(t, l, server.Config{})
+	for i := 0; i < 10; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/octet-stream", "hello", "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	var offsets []uint64
+	for off := uint64(0); off < 10; {
+		page := consumeRecords(t, fmt.Sprintf("%s/records?offset=%d&max_records=4", url, off))
+		require.NotEmpty(t, page.Records)
+		for _, record := range page.Records {
+			offsets = append(offsets, record.Offset)
+		}
+		off = page.NextOffset
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, offsets)
+
+	require.NoError(t, l.Truncate(5))
+	res := do(t, http.MethodGet, url+"/records?offset=0", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	page := consumeRecords(t, fmt.Sprintf("%s/records?offset=%d", url, lowest))
+	require.Equal(t, lowest, page.Records[0].Offset)
+	require.Equal(t, uint64(10), page.NextOffset)
+}
+
+func testIdempotentProduce(t *testing.T, url string) {
+	for i := 0; i < 2; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8=","producer_id":"a","sequence":1}`, "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+		var produced server.ProduceResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&produced))
+		require.Equal(t, uint64(0), produced.Offset)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url+"/records", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Producer-Id", "a")
+	req.Header.Set("X-Producer-Sequence", "3")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func testErrorResponses(t *testing.T, url string) {
+	testcases := []struct {
+		method, path, contentType, body, accept string
+		status                                  int
+		code                                    string
+	}{
+		{http.MethodGet, "/records/0", "", "", "", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/records?offset=x", "", "", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodGet, "/records/0", "", "", "text/html", http.StatusNotAcceptable, "not_acceptable"},
+		{http.MethodPost, "/records", "text/plain", "hello", "", http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{http.MethodPost, "/records", "application/octet-stream", strings.Repeat("a", 1<<20+1), "", http.StatusRequestEntityTooLarge, "request_entity_too_large"},
+		{http.MethodPost, "/records", "application/json", `{"value":"` + strings.Repeat("a", 1<<20) + `"}`, "", http.StatusRequestEntityTooLarge, "request_entity_too_large"},
+		{http.MethodPost, "/records", "application/json", "{", "", http.StatusBadRequest, "bad_request"},
+		{http.MethodDelete, "/records", "", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodGet, "/unknown", "", "", "", http.StatusNotFound, "not_found"},
+	}
+	for _, tc := range testcases {
+		res := do(t, tc.method, url+tc.path, tc.contentType, tc.body, tc.accept)
+		require.Equal(t, tc.status, res.StatusCode, tc.path)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		var e server.ErrorResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&e))
+		require.Equal(t, tc.code, e.Error.Code)
+		require.NotEmpty(t, e.Error.Message)
+	}
+}
+
+// filterパラメーターの式を満たすレコードだけを返し、読み飛ばした範囲を返すかテストする
+func testConsumeFilter(t *testing.T, url string) {
+	for _, record := range []server.Record{
+		{Key: []byte("a"), Value: []byte(`{"amount":50}`)},
+		{Key: []byte("b"), Value: []byte(`{"amount":150}`)},
+		{Key: []byte("a"), Value: []byte(`{"amount":200}`)},
+		{Key: []byte("b"), Value: []byte(`{"amount":10}`)},
+	} {
+		body, err := json.Marshal(record)
+		require.NoError(t, err)
+		res := do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	filter := neturl.QueryEscape(`key == "a" && value.amount > 100`)
+
+	res := do(t, http.MethodGet, url+"/records?filter="+filter, "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var page server.ConsumeRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(2), page.Records[0].Offset)
+	require.Equal(t, []byte("a"), page.Records[0].Key)
+	require.Equal(t, []server.Gap{{From: 0, To: 2}, {From: 3, To: 4}}, page.Gaps)
+	require.Equal(t, uint64(4), page.NextOffset)
+
+	// ストリームでは、末尾に達したときに読み飛ばした範囲を送る
+	res = do(t, http.MethodGet, url+"/stream?format=ndjson&offset=1&filter="+filter, "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+	var record server.Record
+	require.NoError(t, dec.Decode(&record))
+	require.Equal(t, uint64(2), record.Offset)
+	var gap struct {
+		Gap server.Gap `json:"gap"`
+	}
+	require.NoError(t, dec.Decode(&gap))
+	require.Equal(t, server.Gap{From: 3, To: 4}, gap.Gap)
+
+	res = do(t, http.MethodGet, url+"/records?filter="+neturl.QueryEscape(`key ==`), "", "", "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// バイナリの値や同じキーを持つヘッダーを、追加したときの並びのまま返すかテストする
+func testPreserveHeaders(t *testing.T, url string) {
+	headers := []server.Header{
+		{Key: "trace", Value: []byte{0xff, 0x00, 0xfe}},
+		{Key: "hop", Value: []byte("a")},
+		{Key: "hop", Value: []byte("b")},
+	}
+	body, err := json.Marshal(server.Record{Value: []byte("hello"), Headers: headers})
+	require.NoError(t, err)
+	res := do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var record server.Record
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&record))
+	require.Equal(t, headers, record.Headers)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "application/x-protobuf")
+	p, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var pb api.Record
+	require.NoError(t, proto.Unmarshal(p, &pb))
+	require.Len(t, pb.Headers, 3)
+	require.Equal(t, []byte{0xff, 0x00, 0xfe}, pb.Headers[0].Value)
+	require.Equal(t, "b", string(pb.Headers[2].Value))
+
+	res = do(t, http.MethodGet, url+"/records?offset=0", "", "", "application/x-protobuf")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-protobuf", res.Header.Get("Content-Type"))
+	p, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var batch api.RecordBatch
+	require.NoError(t, proto.Unmarshal(p, &batch))
+	require.Equal(t, uint64(1), batch.NextOffset)
+	require.Len(t, batch.Records, 1)
+	require.True(t, proto.Equal(&pb, batch.Records[0]))
+}
+
+// 有効期限が切れたレコードを返さないかテストする
+func testConsumeExpired(t *testing.T, url string) {
+	for _, at := range []time.Time{time.Now().Add(-time.Second), time.Now().Add(time.Hour)} {
+		req, err := http.NewRequest(http.MethodPost, url+"/records", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Expires-At", at.Format(time.RFC3339Nano))
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	res := do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var record server.Record
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&record))
+	require.NotNil(t, record.ExpiresAt)
+
+	page := consumeRecords(t, url+"/records")
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(1), page.Records[0].Offset)
+	require.Equal(t, []server.Gap{{From: 0, To: 1}}, page.Gaps)
+}
+
+func do(t *testing.T, method, url, contentType, body, accept string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/queue"
+
+	"github.com/gorilla/mux"
+)
+
+// 一度のリクエストでリースするレコードの数の上限
+const maxReceiveRecords = 100
+
+// ワークキューのAPIのルートを登録する
+func (s *httpServer) registerQueueRoutes(r *mux.Router) {
+	r.HandleFunc("/queue/receive", s.handleReceive).Methods(http.MethodPost)
+	r.HandleFunc("/queue/ack", s.handleAck).Methods(http.MethodPost)
+	r.HandleFunc("/queue/nack", s.handleNack).Methods(http.MethodPost)
+}
+
+type ReceiveRequest struct {
+	// レコードをリースするコンシューマーの名前
+	Consumer string `json:"consumer"`
+	// リースするレコードの数の上限
+	// 0の場合は1つだけリースする
+	MaxRecords int `json:"max_records"`
+}
+
+type ReceiveResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// コンシューマーにリースしたレコード
+type Delivery struct {
+	Record Record `json:"record"`
+	// AckやNackで指定するリースのID
+	LeaseID string `json:"lease_id"`
+	// このリースを含めて、レコードを配った回数
+	Attempts int `json:"attempts"`
+	// Ackされなければ、この時刻を過ぎると再び配る
+	Deadline time.Time `json:"deadline"`
+}
+
+type AckRequest struct {
+	Offset  uint64 `json:"offset"`
+	LeaseID string `json:"lease_id"`
+	// Nackで、レコードを処理できなかった理由
+	Reason string `json:"reason,omitempty"`
+}
+
+// キューのレコードをリースする
+// 他のAPIと同じく、ConsumeFiltersがすべてtrueを返したレコードだけを返す
+// リースするレコードが無い場合は空の配列を返す
+func (s *httpServer) handleReceive(w http.ResponseWriter, r *http.Request) {
+	var req ReceiveRequest
+	if err := json.NewDecoder(limitBody(w, r)).Decode(&req); err != nil {
+		writeError(w, bodyErrorStatus(err), fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	if req.Consumer == "" {
+		writeError(w, http.StatusBadRequest, errors.New("consumer is required"))
+		return
+	}
+	if req.MaxRecords < 0 || req.MaxRecords > maxReceiveRecords {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("max_records must be between 0 and %d", maxReceiveRecords))
+		return
+	}
+	if req.MaxRecords == 0 {
+		req.MaxRecords = 1
+	}
+	// ConsumeFiltersで返さないレコードはリースせず、まだ配っていなければキューから読み飛ばす
+	deliveries, err := s.Config.Queue.Receive(req.Consumer, req.MaxRecords, func(record *api.Record) bool {
+		return s.accept(r.Context(), record)
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := ReceiveResponse{Deliveries: make([]Delivery, 0, len(deliveries))}
+	for _, d := range deliveries {
+		res.Deliveries = append(res.Deliveries, Delivery{
+			Record:   newRecord(d.Record),
+			LeaseID:  d.LeaseID,
+			Attempts: d.Attempts,
+			Deadline: d.Deadline,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// リースしたレコードの処理が完了したことを記録する
+func (s *httpServer) handleAck(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAckRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Config.Queue.Ack(req.Offset, req.LeaseID); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// リースしたレコードを処理できなかったことを記録し、再び配るかデッドレターログに移す
+func (s *httpServer) handleNack(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAckRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Config.Queue.Nack(req.Offset, req.LeaseID, req.Reason); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeAckRequest(w http.ResponseWriter, r *http.Request) (*AckRequest, bool) {
+	var req AckRequest
+	if err := json.NewDecoder(limitBody(w, r)).Decode(&req); err != nil {
+		writeError(w, bodyErrorStatus(err), fmt.Errorf("failed to decode request: %w", err))
+		return nil, false
+	}
+	if req.LeaseID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("lease_id is required"))
+		return nil, false
+	}
+	return &req, true
+}
+
+// リースがタイムアウトして別のコンシューマーに配られた場合などは、409を返す
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrLeaseNotFound) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,99 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/queue"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// リースしたレコードをAckすると配られなくなり、Nackすると再び配られるかテストする
+func TestQueue(t *testing.T) {
+	l := newTestLog(t, log.Config{})
+	url := newTestServerWithLog(t, l, server.Config{Queue: newTestQueue(t, l)})
+
+	for i := 0; i < 2; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8="}`, "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	deliveries := receiveQueue(t, url, 2)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, uint64(0), deliveries[0].Record.Offset)
+	require.Equal(t, []byte("hello"), deliveries[0].Record.Value)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Empty(t, receiveQueue(t, url, 1))
+
+	ack := fmt.Sprintf(`{"offset":0,"lease_id":%q}`, deliveries[0].LeaseID)
+	res := do(t, http.MethodPost, url+"/queue/ack", "application/json", ack, "")
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	res = do(t, http.MethodPost, url+"/queue/ack", "application/json", ack, "")
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+
+	nack := fmt.Sprintf(`{"offset":1,"lease_id":%q,"reason":"busy"}`, deliveries[1].LeaseID)
+	res = do(t, http.MethodPost, url+"/queue/nack", "application/json", nack, "")
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	deliveries = receiveQueue(t, url, 2)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, uint64(1), deliveries[0].Record.Offset)
+	require.Equal(t, 2, deliveries[0].Attempts)
+
+	res = do(t, http.MethodPost, url+"/queue/receive", "application/json", `{}`, "")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// ConsumeFiltersで返さないレコードは、キューからも配らないかテストする
+func TestQueueFilter(t *testing.T) {
+	l := newTestLog(t, log.Config{})
+	url := newTestServerWithLog(t, l, server.Config{
+		Queue: newTestQueue(t, l),
+		ConsumeFilters: []server.ConsumeFilter{
+			func(ctx context.Context, record *api.Record) bool {
+				return string(record.Key) != "secret"
+			},
+		},
+	})
+
+	for _, key := range []string{"public", "secret", "public"} {
+		body, err := json.Marshal(server.Record{Key: []byte(key), Value: []byte("hello")})
+		require.NoError(t, err)
+		res := do(t, http.MethodPost, url+"/records", "application/json", string(body), "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+
+	deliveries := receiveQueue(t, url, 3)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, uint64(0), deliveries[0].Record.Offset)
+	require.Equal(t, uint64(2), deliveries[1].Record.Offset)
+	require.Empty(t, receiveQueue(t, url, 3))
+}
+
+// lのレコードを配るキューを一時ディレクトリに作る
+func newTestQueue(t *testing.T, l *log.Log) *queue.Queue {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "queue-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	q, err := queue.New(dir, l, queue.Config{})
+	require.NoError(t, err)
+	return q
+}
+
+func receiveQueue(t *testing.T, url string, max int) []server.Delivery {
+	t.Helper()
+	body := fmt.Sprintf(`{"consumer":"worker","max_records":%d}`, max)
+	res := do(t, http.MethodPost, url+"/queue/receive", "application/json", body, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var received server.ReceiveResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&received))
+	return received.Deliveries
+}
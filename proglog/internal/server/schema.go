@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/schema"
+
+	"github.com/gorilla/mux"
+)
+
+// スキーマレジストリのAPIのルートを登録する
+func (s *httpServer) registerSchemaRoutes(r *mux.Router) {
+	r.HandleFunc("/subjects", s.handleListSubjects).Methods(http.MethodGet)
+	r.HandleFunc("/subjects/{subject}/versions", s.handleRegisterSchema).Methods(http.MethodPost)
+	r.HandleFunc("/subjects/{subject}/versions", s.handleListVersions).Methods(http.MethodGet)
+	r.HandleFunc("/subjects/{subject}/versions/{version:[0-9]+|latest}", s.handleGetVersion).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{id:[0-9]+}", s.handleGetSchema).Methods(http.MethodGet)
+	r.HandleFunc("/config/{subject}", s.handleGetCompatibility).Methods(http.MethodGet)
+	r.HandleFunc("/config/{subject}", s.handleSetCompatibility).Methods(http.MethodPut)
+}
+
+// レコードのヘッダーが指すスキーマに、レコードの値が合うかを調べる
+// スキーマレジストリが無い場合は調べない
+func (s *httpServer) validate(record *api.Record) error {
+	if s.Config.Schemas == nil {
+		return nil
+	}
+	return s.Config.Schemas.Validate(record)
+}
+
+type RegisterSchemaRequest struct {
+	// JSONかPROTOBUF
+	// 指定しない場合はJSON
+	SchemaType schema.Type `json:"schema_type"`
+	// JSONではJSON Schemaの文書、PROTOBUFではシリアライズしたFileDescriptorSetをBase64でエンコードしたもの
+	Schema string `json:"schema"`
+	// PROTOBUFで、レコードの値として使うメッセージの完全修飾名
+	Message string `json:"message,omitempty"`
+}
+
+type SchemaResponse struct {
+	ID         uint64      `json:"id"`
+	Subject    string      `json:"subject"`
+	Version    int         `json:"version"`
+	SchemaType schema.Type `json:"schema_type"`
+	Schema     string      `json:"schema"`
+	Message    string      `json:"message,omitempty"`
+}
+
+func newSchemaResponse(sc *schema.Schema) SchemaResponse {
+	res := SchemaResponse{
+		ID:         sc.ID,
+		Subject:    sc.Subject,
+		Version:    sc.Version,
+		SchemaType: sc.Type,
+		Schema:     string(sc.Definition),
+		Message:    sc.Message,
+	}
+	if sc.Type == schema.TypeProtobuf {
+		res.Schema = base64.StdEncoding.EncodeToString(sc.Definition)
+	}
+	return res
+}
+
+type CompatibilityRequest struct {
+	Compatibility schema.Compatibility `json:"compatibility"`
+}
+
+// スキーマをサブジェクトの新しいバージョンとして登録する
+// スキーマを解析できない場合は422を、最新のバージョンと互換性が無い場合は409を返す
+func (s *httpServer) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	var req RegisterSchemaRequest
+	if err := json.NewDecoder(limitBody(w, r)).Decode(&req); err != nil {
+		writeError(w, bodyErrorStatus(err), fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	if req.SchemaType == "" {
+		req.SchemaType = schema.TypeJSON
+	}
+	def := []byte(req.Schema)
+	if req.SchemaType == schema.TypeProtobuf {
+		var err error
+		if def, err = base64.StdEncoding.DecodeString(req.Schema); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid schema: %w", err))
+			return
+		}
+	}
+	sc, err := s.Config.Schemas.Register(mux.Vars(r)["subject"], req.SchemaType, def, req.Message)
+	if err != nil {
+		writeError(w, schemaErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSchemaResponse(sc))
+}
+
+func (s *httpServer) handleListSubjects(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Config.Schemas.Subjects())
+}
+
+func (s *httpServer) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := s.Config.Schemas.Versions(mux.Vars(r)["subject"])
+	if err != nil {
+		writeError(w, schemaErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// サブジェクトのバージョンのスキーマを返す
+// バージョンにlatestを指定すると最新のバージョンを返す
+func (s *httpServer) handleGetVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := 0
+	if v := vars["version"]; v != "latest" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version: %s", v))
+			return
+		}
+	}
+	sc, err := s.Config.Schemas.Version(vars["subject"], version)
+	if err != nil {
+		writeError(w, schemaErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSchemaResponse(sc))
+}
+
+func (s *httpServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid id: %w", err))
+		return
+	}
+	sc, err := s.Config.Schemas.Schema(id)
+	if err != nil {
+		writeError(w, schemaErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSchemaResponse(sc))
+}
+
+func (s *httpServer) handleGetCompatibility(w http.ResponseWriter, r *http.Request) {
+	c := s.Config.Schemas.Compatibility(mux.Vars(r)["subject"])
+	writeJSON(w, http.StatusOK, CompatibilityRequest{Compatibility: c})
+}
+
+// サブジェクトの互換性を設定する
+// サブジェクトにまだスキーマが無くても、最初のバージョンを登録する前に設定できる
+func (s *httpServer) handleSetCompatibility(w http.ResponseWriter, r *http.Request) {
+	var req CompatibilityRequest
+	if err := json.NewDecoder(limitBody(w, r)).Decode(&req); err != nil {
+		writeError(w, bodyErrorStatus(err), fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	if err := s.Config.Schemas.SetCompatibility(mux.Vars(r)["subject"], req.Compatibility); err != nil {
+		writeError(w, schemaErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// スキーマレジストリのエラーのステータスコードを返す
+func schemaErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, schema.ErrSchemaNotFound), errors.Is(err, schema.ErrSubjectNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, schema.ErrIncompatibleSchema):
+		return http.StatusConflict
+	case errors.Is(err, schema.ErrInvalidSchema):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,71 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/schema"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// スキーマを登録し、そのスキーマに合わないレコードの追加を拒否するかテストする
+func TestSchemaRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	schemaLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer schemaLog.Close()
+	registry, err := schema.NewRegistry(schemaLog)
+	require.NoError(t, err)
+	url := newTestServer(t, server.Config{Schemas: registry})
+
+	body := `{"schema":"{\"type\":\"object\",\"properties\":{\"id\":{\"type\":\"string\"}},\"required\":[\"id\"]}"}`
+	res := do(t, http.MethodPost, url+"/subjects/orders/versions", "application/json", body, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var registered server.SchemaResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&registered))
+	require.Equal(t, uint64(1), registered.ID)
+	require.Equal(t, 1, registered.Version)
+
+	// schema-idヘッダーで指定したスキーマに合うレコードだけを追加する
+	for value, status := range map[string]int{
+		`{"id":"a"}`:    http.StatusCreated,
+		`{"name":"a"}`:  http.StatusUnprocessableEntity,
+		`{"id":1}`:      http.StatusUnprocessableEntity,
+		`not json data`: http.StatusUnprocessableEntity,
+	} {
+		record, err := json.Marshal(server.Record{Value: []byte(value), Headers: []server.Header{{Key: schema.HeaderSchemaID, Value: []byte("1")}}})
+		require.NoError(t, err)
+		res = do(t, http.MethodPost, url+"/records", "application/json", string(record), "")
+		require.Equal(t, status, res.StatusCode, value)
+	}
+	res = do(t, http.MethodPost, url+"/records", "application/json", `{"value":"e30=","headers":[{"key":"schema-id","value":"OQ=="}]}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	// 必須のプロパティを追加すると後方互換ではない
+	body = `{"schema":"{\"type\":\"object\",\"required\":[\"id\",\"amount\"]}"}`
+	res = do(t, http.MethodPost, url+"/subjects/orders/versions", "application/json", body, "")
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	res = do(t, http.MethodPut, url+"/config/orders", "application/json", `{"compatibility":"NONE"}`, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = do(t, http.MethodPost, url+"/subjects/orders/versions", "application/json", body, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = do(t, http.MethodGet, url+"/subjects/orders/versions/latest", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var latest server.SchemaResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&latest))
+	require.Equal(t, 2, latest.Version)
+	require.Equal(t, schema.TypeJSON, latest.SchemaType)
+
+	res = do(t, http.MethodGet, url+"/schemas/3", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(t, http.MethodPost, url+"/subjects/orders/versions", "application/json", `{"schema":"{\"type\":\"decimal\"}"}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+}
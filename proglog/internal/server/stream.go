@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+)
+
+const (
+	contentTypeEventStream = "text/event-stream"
+	contentTypeNDJSON      = "application/x-ndjson"
+)
+
+// Server-Sent Eventsで接続を保つために、レコードが追加されない間に送るコメントの間隔
+// テストで短くできるように変数にしている
+var streamKeepAliveInterval = 15 * time.Second
+
+// offsetから順にレコードを送り続け、末尾に達したら追加されるのを待って送る
+// AcceptヘッダーかformatパラメーターでServer-Sent Events(sse)か改行区切りのJSON(ndjson)を選べる
+// Server-Sent Eventsではイベントのidをレコードのオフセットにするので、
+// 再接続したクライアントはLast-Event-IDヘッダーの次のオフセットから続けて受け取れる
+// isolationパラメーターにread_committedを指定すると、コミットされたトランザクションのレコードだけを送る
+// filterパラメーターに式を指定すると、式を満たすレコードだけを送る
+// 読み飛ばしたレコードの範囲は、末尾に達したときか読み飛ばしたレコードが溜まったときにgapとして送る
+func (s *httpServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	off, err := streamOffset(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	isolation, err := parseIsolation(r.URL.Query().Get("isolation"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	accept, err := s.consumeFilter(r.Context(), r.URL.Query().Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sse, err := streamFormat(r)
+	if err != nil {
+		writeError(w, http.StatusNotAcceptable, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+	it, err := newIterator(s.Log, off, isolation)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// クライアントが切断したときにイテレータが参照しているセグメントを解放する
+	defer it.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", contentTypeEventStream)
+	} else {
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	enc := json.NewEncoder(w)
+	gaps := &gapTracker{next: off}
+	for {
+		// 末尾に達してから待ち始めるまでの間の追加を見逃さないように、読み込む前に取得する
+		appended := s.Log.Appended()
+		record, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			if gap, ok := gaps.gap(it.Offset(), true); ok {
+				if err = writeStreamGap(w, enc, sse, gap); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-appended:
+			case <-keepAlive.C:
+				if sse {
+					if _, err = io.WriteString(w, ": keep-alive\n\n"); err != nil {
+						return
+					}
+					flusher.Flush()
+				}
+			}
+			continue
+		}
+		// ヘッダーはすでに送っているので、エラーはストリームを閉じることで知らせる
+		if err != nil {
+			return
+		}
+		if !accept(record) {
+			if gap, ok := gaps.gap(it.Offset(), false); ok {
+				if err = writeStreamGap(w, enc, sse, gap); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		gaps.sent(record.Offset)
+		rec := newRecord(record)
+		if sse {
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: record\ndata: ", record.Offset); err != nil {
+				return
+			}
+			// Encodeは末尾に改行を書き込むので、空行を1つ足すとイベントの終わりになる
+			if err = enc.Encode(rec); err != nil {
+				return
+			}
+			if _, err = io.WriteString(w, "\n"); err != nil {
+				return
+			}
+		} else if err = enc.Encode(rec); err != nil {
+			return
+		}
+	}
+}
+
+// NDJSONで送る読み飛ばしたレコードの範囲
+// レコードと区別できるように、gapフィールドに入れて送る
+type streamGap struct {
+	Gap Gap `json:"gap"`
+}
+
+// 読み飛ばしたレコードの範囲を送る
+// Server-Sent Eventsではイベントのidを範囲の最後のオフセットにするので、再接続したクライアントはその先から続けて受け取れる
+func writeStreamGap(w io.Writer, enc *json.Encoder, sse bool, gap Gap) error {
+	if !sse {
+		return enc.Encode(streamGap{Gap: gap})
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: gap\ndata: ", gap.To-1); err != nil {
+		return err
+	}
+	if err := enc.Encode(gap); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// 読み込みを始めるオフセットを返す
+// Last-Event-IDヘッダーがあれば、そのイベントの次のオフセットから再開する
+func streamOffset(r *http.Request) (uint64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		off, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID: %w", err)
+		}
+		return off + 1, nil
+	}
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		return 0, nil
+	}
+	off, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %w", err)
+	}
+	return off, nil
+}
+
+// Server-Sent Eventsで送る場合はtrueを返す
+// formatパラメーターが無い場合はAcceptヘッダーから決め、どちらも無ければServer-Sent Eventsにする
+func streamFormat(r *http.Request) (bool, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "sse":
+		return true, nil
+	case "ndjson":
+		return false, nil
+	case "":
+	default:
+		return false, fmt.Errorf("format %s: %w", format, errUnsupportedMediaType)
+	}
+	contentType, ok := negotiate(r, contentTypeEventStream, contentTypeNDJSON, contentTypeJSON)
+	if !ok {
+		return false, fmt.Errorf("%s: %w", r.Header.Get("Accept"), errUnsupportedMediaType)
+	}
+	return contentType == contentTypeEventStream, nil
+}
@@ -0,0 +1,175 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	testcases := map[string]func(t *testing.T, url string){
+		"send records as events":       testStreamEvents,
+		"resume from last event id":    testStreamResume,
+		"follow appended records":      testStreamFollow,
+		"send keep-alive comments":     testStreamKeepAlive,
+		"send records as ndjson":       testStreamNDJSON,
+		"error on out of range offset": testStreamOutOfRange,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, newTestServer(t, server.Config{}))
+		})
+	}
+}
+
+// レコードごとにid、event、dataの行と空行からなるイベントを送るかテストする
+func testStreamEvents(t *testing.T, url string) {
+	produceValues(t, url, "a", "b")
+	r := openStream(t, url+"/stream", "")
+	require.Equal(t, []string{"id: 0", "event: record", `data: {"value":"YQ==","offset":0}`}, readEventLines(t, r))
+	require.Equal(t, []string{"id: 1", "event: record", `data: {"value":"Yg==","offset":1}`}, readEventLines(t, r))
+}
+
+// Last-Event-IDヘッダーのイベントの次のオフセットから送るかテストする
+func testStreamResume(t *testing.T, url string) {
+	produceValues(t, url, "a", "b", "c")
+	r := openStream(t, url+"/stream?offset=0", "1")
+	requireEvent(t, r, 2, "c")
+}
+
+// 末尾に達した後に追加されたレコードを送るかテストする
+func testStreamFollow(t *testing.T, url string) {
+	produceValues(t, url, "a")
+	r := openStream(t, url+"/stream", "")
+	requireEvent(t, r, 0, "a")
+	produceValues(t, url, "b")
+	requireEvent(t, r, 1, "b")
+}
+
+// レコードが追加されない間はキープアライブのコメントを送るかテストする
+func testStreamKeepAlive(t *testing.T, url string) {
+	defer server.ExportSetStreamKeepAliveInterval(10 * time.Millisecond)()
+	r := openStream(t, url+"/stream", "")
+	require.Equal(t, ": keep-alive\n", readLine(t, r))
+	require.Equal(t, "\n", readLine(t, r))
+}
+
+// formatパラメーターにndjsonを指定すると、レコードを1行ずつのJSONで送るかテストする
+func testStreamNDJSON(t *testing.T, url string) {
+	produceValues(t, url, "a", "b")
+	r := openStream(t, url+"/stream?format=ndjson&offset=1", "")
+	var record server.Record
+	require.NoError(t, json.Unmarshal([]byte(readLine(t, r)), &record))
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, []byte("b"), record.Value)
+}
+
+func testStreamOutOfRange(t *testing.T, url string) {
+	res := do(t, http.MethodGet, url+"/stream?offset=10", "", "", "text/event-stream")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(t, http.MethodGet, url+"/stream?format=xml", "", "", "")
+	require.Equal(t, http.StatusNotAcceptable, res.StatusCode)
+}
+
+// クライアントが切断すると、末尾で追加を待っているハンドラーが終わってイテレータを閉じるかテストする
+func TestStreamDisconnect(t *testing.T) {
+	l := newTestLog(t, log.Config{})
+	srv := httptest.NewServer(server.NewHTTPServer("", l, server.Config{}).Handler)
+	defer srv.Close()
+	produceValues(t, srv.URL, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/stream", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	requireEvent(t, bufio.NewReader(res.Body), 0, "a")
+	cancel()
+
+	// Closeはすべてのリクエストのハンドラーが終わるまで戻らない
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler did not return after the client disconnected")
+	}
+}
+
+func produceValues(t *testing.T, url string, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		res := do(t, http.MethodPost, url+"/records", "application/octet-stream", v, "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+}
+
+// Server-Sent Eventsのストリームを開く
+// lastEventIDが空でなければLast-Event-IDヘッダーに指定する
+func openStream(t *testing.T, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	if !strings.Contains(url, "format=ndjson") {
+		require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(res.Body)
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+// 空行までのイベントの行を、改行を除いて返す
+func readEventLines(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line := strings.TrimSuffix(readLine(t, r), "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// 次のイベントが、offのオフセットとvalueの値を持つレコードであることを確認する
+func requireEvent(t *testing.T, r *bufio.Reader, off uint64, value string) {
+	t.Helper()
+	lines := readEventLines(t, r)
+	require.Len(t, lines, 3)
+	require.Equal(t, "event: record", lines[1])
+	var record server.Record
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &record))
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, []byte(value), record.Value)
+	require.Equal(t, "id: "+strconv.FormatUint(off, 10), lines[0])
+}
@@ -0,0 +1,198 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// 複製されたレコードだけを返し、ハイウォーターマークとログの末尾のオフセットを返すかテストする
+func TestHighWatermark(t *testing.T) {
+	c := log.Config{}
+	c.Replication.Enabled = true
+	l := newTestLog(t, c)
+	url := newTestServerWithLog(t, l, server.Config{})
+
+	for i := 0; i < 2; i++ {
+		res := do(t, http.MethodPost, url+"/records", "application/json", `{"value":"aGVsbG8="}`, "")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	page := consumeRecords(t, url+"/records")
+	require.Empty(t, page.Records)
+	require.Equal(t, uint64(0), page.NextOffset)
+	require.Equal(t, uint64(0), page.HighWatermark)
+	require.Equal(t, uint64(2), page.LogEndOffset)
+	res := do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	require.NoError(t, l.SetHighWatermark(1))
+	page = consumeRecords(t, url+"/records")
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(1), page.NextOffset)
+	require.Equal(t, uint64(1), page.HighWatermark)
+	require.Equal(t, uint64(2), page.LogEndOffset)
+
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("X-High-Watermark"))
+	require.Equal(t, "2", res.Header.Get("X-Log-End-Offset"))
+	var record server.Record
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&record))
+	require.Equal(t, uint64(0), record.Offset)
+	res = do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+// 過半数のレプリカが永続化したオフセットをテストから指定するReplicator
+type quorumReplicator struct {
+	offset uint64
+}
+
+func (r *quorumReplicator) WaitForQuorum(ctx context.Context, off uint64) error {
+	return nil
+}
+
+func (r *quorumReplicator) QuorumOffset() uint64 {
+	return atomic.LoadUint64(&r.offset)
+}
+
+// acks=quorumで追加したレコードは、前のレコードもすべて過半数に複製された後に読み込めるようになるかテストする
+func TestQuorumAdvancesHighWatermark(t *testing.T) {
+	c := log.Config{}
+	c.Replication.Enabled = true
+	l := newTestLog(t, c)
+	replicator := &quorumReplicator{}
+	url := newTestServerWithLog(t, l, server.Config{Replicator: replicator})
+
+	atomic.StoreUint64(&replicator.offset, 1)
+	res := do(t, http.MethodPost, url+"/records?acks=quorum", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, uint64(1), l.HighWatermark())
+	res = do(t, http.MethodGet, url+"/records/0", "", "", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// 複製を待たずに追加したレコードは、ハイウォーターマークを進めない
+	res = do(t, http.MethodPost, url+"/records?acks=leader-fsync", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, uint64(1), l.HighWatermark())
+	res = do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// 後のレコードの確認が先に届いても、複製されていない前のレコードを飛ばしてハイウォーターマークを進めない
+	res = do(t, http.MethodPost, url+"/records?acks=quorum", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, uint64(1), l.HighWatermark())
+	res = do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	atomic.StoreUint64(&replicator.offset, 3)
+	res = do(t, http.MethodPost, url+"/records?acks=quorum", "application/json", `{"value":"aGVsbG8="}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, uint64(3), l.HighWatermark())
+}
+
+// 範囲の読み込み、ストリーム、WebSocketの購読、キューのいずれでも、複製されていないレコードを返さないかテストする
+func TestHighWatermarkReads(t *testing.T) {
+	testcases := map[string]func(t *testing.T, url string, l *log.Log){
+		"read range":           testHighWatermarkRange,
+		"stream records":       testHighWatermarkStream,
+		"subscribe websocket":  testHighWatermarkWebSocket,
+		"receive from queue":   testHighWatermarkQueue,
+		"dead-letter a record": testHighWatermarkDeadLetter,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			c := log.Config{}
+			c.Replication.Enabled = true
+			l := newTestLog(t, c)
+			url := newTestServerWithLog(t, l, server.Config{
+				Queue:      newTestQueue(t, l),
+				DeadLetter: newTestLog(t, log.Config{}),
+			})
+			fn(t, url, l)
+		})
+	}
+}
+
+func testHighWatermarkRange(t *testing.T, url string, l *log.Log) {
+	produceValues(t, url, "a", "b")
+	require.NoError(t, l.SetHighWatermark(1))
+
+	page := consumeRecords(t, url+"/records")
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(1), page.NextOffset)
+	page = consumeRecords(t, url+"/records?offset=1")
+	require.Empty(t, page.Records)
+	require.Equal(t, uint64(1), page.NextOffset)
+	res := do(t, http.MethodGet, url+"/records/1", "", "", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func testHighWatermarkStream(t *testing.T, url string, l *log.Log) {
+	defer server.ExportSetStreamKeepAliveInterval(10 * time.Millisecond)()
+	produceValues(t, url, "a", "b")
+	require.NoError(t, l.SetHighWatermark(1))
+
+	r := openStream(t, url+"/stream", "")
+	requireEvent(t, r, 0, "a")
+	// 複製されるまでは、レコードの代わりにキープアライブを送る
+	require.Equal(t, ": keep-alive\n", readLine(t, r))
+	require.Equal(t, "\n", readLine(t, r))
+
+	require.NoError(t, l.SetHighWatermark(2))
+	for {
+		line, err := r.Peek(1)
+		require.NoError(t, err)
+		if line[0] != ':' {
+			break
+		}
+		readLine(t, r)
+		readLine(t, r)
+	}
+	requireEvent(t, r, 1, "b")
+}
+
+func testHighWatermarkWebSocket(t *testing.T, url string, l *log.Log) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Credit: 10}))
+	require.Equal(t, "subscribed", receive(t, conn).Type)
+
+	// 複製されていないレコードは送られないので、追加の応答だけが届く
+	require.Equal(t, uint64(0), produce(t, conn, "p").Offset)
+	require.Equal(t, uint64(1), produce(t, conn, "p").Offset)
+
+	require.NoError(t, l.SetHighWatermark(1))
+	requireRecord(t, receive(t, conn), 0)
+}
+
+func testHighWatermarkQueue(t *testing.T, url string, l *log.Log) {
+	produceValues(t, url, "a", "b")
+	require.NoError(t, l.SetHighWatermark(1))
+
+	deliveries := receiveQueue(t, url, 2)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, uint64(0), deliveries[0].Record.Offset)
+	require.Empty(t, receiveQueue(t, url, 2))
+}
+
+func testHighWatermarkDeadLetter(t *testing.T, url string, l *log.Log) {
+	produceValues(t, url, "a")
+
+	res := do(t, http.MethodPost, url+"/records/0/dead-letter", "application/json", `{"reason":"bad"}`, "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	require.NoError(t, l.SetHighWatermark(1))
+	res = do(t, http.MethodPost, url+"/records/0/dead-letter", "application/json", `{"reason":"bad"}`, "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	api "github.com/shuymn-sandbox/tjgo/proglog/api/log/v1"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketでやり取りするメッセージの種類
+const (
+	// クライアントからサーバーへ送るメッセージ
+	wsTypeProduce     = "produce"
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeCredit      = "credit"
+	// サーバーからクライアントへ送るメッセージ
+	wsTypeAck        = "ack"
+	wsTypeSubscribed = "subscribed"
+	wsTypeRecord     = "record"
+	wsTypeGap        = "gap"
+	wsTypeError      = "error"
+)
+
+const (
+	// クライアントから受け取るメッセージの大きさの上限
+	wsMaxMessageBytes = 1 << 20
+	// クライアントに送るのを待っているメッセージの数の上限
+	wsSendBuffer = 64
+	// 購読で受け取りきれていないレコードの数として、クライアントが与えられるクレジットの上限
+	wsMaxCredit = 1000
+)
+
+// WebSocketでやり取りするメッセージ
+// Typeによって使うフィールドが決まる
+type WebSocketMessage struct {
+	Type string `json:"type"`
+	// リクエストとその応答を対応付けるためにクライアントが付けるID
+	ID string `json:"id,omitempty"`
+	// produceで追加するレコードか、recordで送るレコード
+	Record *Record `json:"record,omitempty"`
+	// ackでは追加したレコードのオフセット、subscribeとsubscribedでは購読を始めるオフセット、
+	// gapでは読み飛ばした範囲の次のオフセット
+	Offset uint64 `json:"offset"`
+	// subscribeとcreditで、クライアントが新たに受け取れるレコードの数
+	Credit int `json:"credit,omitempty"`
+	// subscribeでread_committedを指定すると、コミットされたトランザクションのレコードだけを送る
+	Isolation string `json:"isolation,omitempty"`
+	// subscribeで指定すると、式を満たすレコードだけを送る
+	Filter string `json:"filter,omitempty"`
+	// produceで、追加したレコードをどこまで永続化してから応答するか
+	// noneの場合は追加してもackを送らない
+	Acks string `json:"acks,omitempty"`
+	// gapで送る、読み飛ばしたレコードのオフセットの範囲
+	Gap   *Gap   `json:"gap,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	// ハンドシェイクのエラーも他のエンドポイントと同じ形式で返す
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, reason)
+	},
+}
+
+// 一つのWebSocketの接続で、レコードの追加と購読を行う
+// 購読ではクレジットによるフロー制御を行い、クライアントが与えたクレジットの数までしかレコードを送らない
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgradeがエラーの応答を書き込む
+		return
+	}
+	conn.SetReadLimit(wsMaxMessageBytes)
+	ctx, cancel := context.WithCancel(r.Context())
+	c := &wsConn{
+		srv:    s,
+		conn:   conn,
+		out:    make(chan *WebSocketMessage, wsSendBuffer),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.writeLoop()
+	}()
+	c.readLoop()
+
+	// 購読を止めてから送信を終えるので、送信用のチャネルに書き込むゴルーチンは残らない
+	cancel()
+	c.unsubscribe()
+	close(c.out)
+	<-writerDone
+	_ = conn.Close()
+}
+
+// WebSocketの接続ごとの状態
+type wsConn struct {
+	srv  *httpServer
+	conn *websocket.Conn
+	// クライアントに送るメッセージ
+	// 書き込みはwriteLoopだけが行う
+	out    chan *WebSocketMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 購読は接続ごとに一つまで
+	sub *wsSubscription
+}
+
+// クライアントからのメッセージを読み込んで処理する
+// 接続が切断されるまで戻らない
+func (c *wsConn) readLoop() {
+	for {
+		var msg WebSocketMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case wsTypeProduce:
+			c.produce(&msg)
+		case wsTypeSubscribe:
+			c.subscribe(&msg)
+		case wsTypeUnsubscribe:
+			c.unsubscribe()
+		case wsTypeCredit:
+			if c.sub != nil {
+				c.sub.addCredit(msg.Credit)
+			}
+		default:
+			c.sendError(msg.ID, fmt.Errorf("unknown message type: %s", msg.Type))
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// 送信用のチャネルのメッセージをクライアントに書き込む
+// 書き込みに失敗したら接続を閉じて、読み込みと購読を終わらせる
+func (c *wsConn) writeLoop() {
+	for msg := range c.out {
+		if c.ctx.Err() != nil {
+			continue
+		}
+		if err := c.conn.WriteJSON(msg); err != nil {
+			c.cancel()
+			_ = c.conn.Close()
+		}
+	}
+}
+
+// メッセージを送信用のチャネルに入れる
+// 接続が終わっている場合はfalseを返す
+func (c *wsConn) send(msg *WebSocketMessage) bool {
+	select {
+	case c.out <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *wsConn) sendError(id string, err error) {
+	c.send(&WebSocketMessage{Type: wsTypeError, ID: id, Error: err.Error()})
+}
+
+func (c *wsConn) produce(msg *WebSocketMessage) {
+	if msg.Record == nil {
+		c.sendError(msg.ID, errors.New("record is required"))
+		return
+	}
+	level, err := c.srv.parseAckLevel(msg.Acks)
+	if err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	record := msg.Record.proto()
+	if err := c.srv.intercept(c.ctx, record); err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	if err := c.srv.validate(record); err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	off, err := c.srv.produce(c.ctx, record, level)
+	if err != nil {
+		// acks=noneのクライアントはエラーを待っていないことがあるので、ErrorLogにも記録する
+		if level == AckNone {
+			c.srv.logf("failed to produce record with acks=none: %v", err)
+		}
+		c.sendError(msg.ID, err)
+		return
+	}
+	if level == AckNone {
+		return
+	}
+	c.send(&WebSocketMessage{Type: wsTypeAck, ID: msg.ID, Offset: off})
+}
+
+// 購読を始める
+// すでに購読している場合は、その購読を止めてから新しく始める
+func (c *wsConn) subscribe(msg *WebSocketMessage) {
+	c.unsubscribe()
+	isolation, err := parseIsolation(msg.Isolation)
+	if err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	accept, err := c.srv.consumeFilter(c.ctx, msg.Filter)
+	if err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	it, err := newIterator(c.srv.Log, msg.Offset, isolation)
+	if err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	sub := &wsSubscription{
+		id:     msg.ID,
+		accept: accept,
+		gaps:   &gapTracker{next: msg.Offset},
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	sub.addCredit(msg.Credit)
+	c.sub = sub
+	if !c.send(&WebSocketMessage{Type: wsTypeSubscribed, ID: msg.ID, Offset: msg.Offset}) {
+		cancel()
+		close(sub.done)
+		_ = it.Close()
+		return
+	}
+	go func() {
+		defer close(sub.done)
+		defer it.Close()
+		c.push(ctx, sub, it)
+	}()
+}
+
+// 購読を止め、レコードを送っているゴルーチンが終わるのを待つ
+func (c *wsConn) unsubscribe() {
+	if c.sub == nil {
+		return
+	}
+	c.sub.cancel()
+	<-c.sub.done
+	c.sub = nil
+}
+
+// クレジットがある間はイテレータから読み込んだレコードを送り、末尾に達したら追加されるのを待つ
+// 読み飛ばしたレコードの範囲はクレジットを使わずにgapとして送る
+func (c *wsConn) push(ctx context.Context, sub *wsSubscription, it *log.Iterator) {
+	for {
+		if !sub.takeCredit() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.wake:
+			}
+			continue
+		}
+		// 末尾に達してから待ち始めるまでの間の追加を見逃さないように、読み込む前に取得する
+		appended := c.srv.Log.Appended()
+		record, err := it.Next()
+		if errors.Is(err, io.EOF) {
+			sub.returnCredit()
+			if !c.pushGap(ctx, sub, it.Offset(), true) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-appended:
+			}
+			continue
+		}
+		if err != nil {
+			c.sendError(sub.id, err)
+			return
+		}
+		// フィルターで除いたレコードは送らないので、クレジットも使わない
+		if !sub.accept(record) {
+			sub.returnCredit()
+			if !c.pushGap(ctx, sub, it.Offset(), false) {
+				return
+			}
+			continue
+		}
+		sub.gaps.sent(record.Offset)
+		rec := newRecord(record)
+		msg := &WebSocketMessage{
+			Type:   wsTypeRecord,
+			ID:     sub.id,
+			Record: &rec,
+			Offset: record.Offset,
+		}
+		select {
+		case c.out <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 知らせるべき読み飛ばしたレコードの範囲があれば送る
+// 購読が止められた場合はfalseを返す
+func (c *wsConn) pushGap(ctx context.Context, sub *wsSubscription, off uint64, eof bool) bool {
+	gap, ok := sub.gaps.gap(off, eof)
+	if !ok {
+		return true
+	}
+	msg := &WebSocketMessage{
+		Type:   wsTypeGap,
+		ID:     sub.id,
+		Offset: gap.To,
+		Gap:    &gap,
+	}
+	select {
+	case c.out <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 購読とそのクレジット
+type wsSubscription struct {
+	id     string
+	accept func(*api.Record) bool
+	gaps   *gapTracker
+	cancel context.CancelFunc
+	// クレジットが増えたことを知らせる
+	wake chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	credit int
+}
+
+// クライアントが与えたクレジットを加える
+func (s *wsSubscription) addCredit(n int) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.credit += n
+	if s.credit > wsMaxCredit {
+		s.credit = wsMaxCredit
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// クレジットを一つ使う
+// クレジットが無い場合はfalseを返す
+func (s *wsSubscription) takeCredit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credit == 0 {
+		return false
+	}
+	s.credit--
+	return true
+}
+
+// レコードを送らなかったときに、使ったクレジットを戻す
+func (s *wsSubscription) returnCredit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit++
+}
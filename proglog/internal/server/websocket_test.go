@@ -0,0 +1,189 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/log"
+	"github.com/shuymn-sandbox/tjgo/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	testcases := map[string]func(t *testing.T, conn *websocket.Conn){
+		"produce and ack":            testWebSocketProduce,
+		"subscribe with credits":     testWebSocketSubscribe,
+		"push appended records":      testWebSocketFollow,
+		"resubscribe from offset":    testWebSocketResubscribe,
+		"error on unknown message":   testWebSocketUnknown,
+		"error on out of range read": testWebSocketOutOfRange,
+		"report filtered records":    testWebSocketFilter,
+	}
+
+	for scenario, fn := range testcases {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "websocket-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			l, err := log.NewLog(dir, log.Config{})
+			require.NoError(t, err)
+			defer l.Close()
+
+			srv := httptest.NewServer(server.NewHTTPServer("", l, server.Config{}).Handler)
+			defer srv.Close()
+			url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			fn(t, conn)
+		})
+	}
+}
+
+// 追加したレコードのオフセットが、リクエストのIDとともに返されるかテストする
+func testWebSocketProduce(t *testing.T, conn *websocket.Conn) {
+	for i := uint64(0); i < 3; i++ {
+		msg := produce(t, conn, "p")
+		require.Equal(t, "p", msg.ID)
+		require.Equal(t, i, msg.Offset)
+	}
+}
+
+// 与えたクレジットの数までしかレコードが送られないかテストする
+func testWebSocketSubscribe(t *testing.T, conn *websocket.Conn) {
+	for i := 0; i < 5; i++ {
+		produce(t, conn, "p")
+	}
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Offset: 1, Credit: 2}))
+	msg := receive(t, conn)
+	require.Equal(t, "subscribed", msg.Type)
+	requireRecord(t, receive(t, conn), 1)
+	requireRecord(t, receive(t, conn), 2)
+	// クレジットを使い切ったので、レコードより先に追加の応答が届く
+	require.Equal(t, uint64(5), produce(t, conn, "p").Offset)
+
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "credit", Credit: 3}))
+	requireRecord(t, receive(t, conn), 3)
+	requireRecord(t, receive(t, conn), 4)
+	requireRecord(t, receive(t, conn), 5)
+	requireNoMessage(t, conn)
+}
+
+// 購読している間に追加されたレコードが送られ、同じ接続で追加の応答も受け取れるかテストする
+func testWebSocketFollow(t *testing.T, conn *websocket.Conn) {
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Credit: 10}))
+	require.Equal(t, "subscribed", receive(t, conn).Type)
+
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{
+		Type:   "produce",
+		ID:     "p",
+		Record: &server.Record{Value: []byte("hello world")},
+	}))
+	// 応答と送られたレコードの順番は決まっていない
+	var ack, record *server.WebSocketMessage
+	for i := 0; i < 2; i++ {
+		msg := receive(t, conn)
+		switch msg.Type {
+		case "ack":
+			ack = msg
+		case "record":
+			record = msg
+		}
+	}
+	require.NotNil(t, ack)
+	require.NotNil(t, record)
+	requireRecord(t, record, ack.Offset)
+}
+
+// 購読し直すと、新しいオフセットから送られるかテストする
+func testWebSocketResubscribe(t *testing.T, conn *websocket.Conn) {
+	for i := 0; i < 3; i++ {
+		produce(t, conn, "p")
+	}
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Credit: 1}))
+	require.Equal(t, "subscribed", receive(t, conn).Type)
+	requireRecord(t, receive(t, conn), 0)
+
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s2", Offset: 2, Credit: 1}))
+	require.Equal(t, "subscribed", receive(t, conn).Type)
+	msg := receive(t, conn)
+	require.Equal(t, "s2", msg.ID)
+	requireRecord(t, msg, 2)
+}
+
+func testWebSocketUnknown(t *testing.T, conn *websocket.Conn) {
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "unknown", ID: "u"}))
+	msg := receive(t, conn)
+	require.Equal(t, "error", msg.Type)
+	require.Equal(t, "u", msg.ID)
+
+	// エラーの後も接続は使える
+	produce(t, conn, "p")
+}
+
+func testWebSocketOutOfRange(t *testing.T, conn *websocket.Conn) {
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Offset: 10}))
+	msg := receive(t, conn)
+	require.Equal(t, "error", msg.Type)
+	require.Contains(t, msg.Error, "offset out of range")
+}
+
+// フィルターで除いたレコードの範囲が、クレジットを使わずに送られるかテストする
+func testWebSocketFilter(t *testing.T, conn *websocket.Conn) {
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Filter: "key =="}))
+	require.Equal(t, "error", receive(t, conn).Type)
+
+	for i := 0; i < 3; i++ {
+		produce(t, conn, "p")
+	}
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{Type: "subscribe", ID: "s", Credit: 1, Filter: "key"}))
+	require.Equal(t, "subscribed", receive(t, conn).Type)
+	msg := receive(t, conn)
+	require.Equal(t, "gap", msg.Type, msg.Error)
+	require.Equal(t, &server.Gap{From: 0, To: 3}, msg.Gap)
+	require.Equal(t, uint64(3), msg.Offset)
+}
+
+func produce(t *testing.T, conn *websocket.Conn, id string) *server.WebSocketMessage {
+	t.Helper()
+	require.NoError(t, conn.WriteJSON(server.WebSocketMessage{
+		Type:   "produce",
+		ID:     id,
+		Record: &server.Record{Value: []byte("hello world")},
+	}))
+	msg := receive(t, conn)
+	require.Equal(t, "ack", msg.Type, msg.Error)
+	return msg
+}
+
+func receive(t *testing.T, conn *websocket.Conn) *server.WebSocketMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var msg server.WebSocketMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	return &msg
+}
+
+// しばらく待ってもメッセージが送られてこないことを確認する
+// 読み込みがタイムアウトした接続はそれ以降使えないので、最後に確認する
+func requireNoMessage(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	var msg server.WebSocketMessage
+	err := conn.ReadJSON(&msg)
+	require.Error(t, err, msg.Type)
+}
+
+func requireRecord(t *testing.T, msg *server.WebSocketMessage, off uint64) {
+	t.Helper()
+	require.Equal(t, "record", msg.Type, msg.Error)
+	require.NotNil(t, msg.Record)
+	require.Equal(t, off, msg.Record.Offset)
+	require.Equal(t, []byte("hello world"), msg.Record.Value)
+}